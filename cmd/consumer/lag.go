@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+)
+
+// A lagTracker is a consumer that remembers where it's committed up to in each partition, so it
+// can report how many messages behind the end of each partition the consumer is.
+type lagTracker struct {
+	broker.Consumer
+	seeker    broker.Seeker
+	mu        sync.Mutex
+	committed map[broker.TopicPartition]int64
+}
+
+// newLagTracker wraps consumer to track its lag, or returns nil when consumer can't query the
+// watermarks its commits are compared with.
+func newLagTracker(consumer broker.Consumer) *lagTracker {
+	seeker, ok := consumer.(broker.Seeker)
+	if !ok {
+		return nil
+	}
+	return &lagTracker{
+		Consumer:  consumer,
+		seeker:    seeker,
+		committed: map[broker.TopicPartition]int64{},
+	}
+}
+
+func (t *lagTracker) Commit(ctx context.Context, env messages.Envelope) error {
+	if err := t.Consumer.Commit(ctx, env); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.committed[broker.TopicPartition{Topic: env.Topic, Partition: env.Partition}] = env.Offset + 1
+	return nil
+}
+
+// run sets the lag gauge of every partition the consumer has committed in every interval until ctx
+// is cancelled.
+func (t *lagTracker) run(ctx context.Context, clk clock.Clock, gauges *metrics.Gauge, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+		if err := t.sample(ctx, gauges); err != nil && !isCancelled(ctx) {
+			fmt.Printf("error: sample lag: %v\n", err)
+		}
+	}
+}
+
+// sample sets the lag gauge of each partition the consumer has committed to the number of
+// messages after its last commit. Partitions the consumer hasn't committed in yet aren't reported
+// since it doesn't know where the group's position is.
+func (t *lagTracker) sample(ctx context.Context, gauges *metrics.Gauge) error {
+	t.mu.Lock()
+	committed := make(map[broker.TopicPartition]int64, len(t.committed))
+	for tp, offset := range t.committed {
+		committed[tp] = offset
+	}
+	t.mu.Unlock()
+
+	for tp, offset := range committed {
+		_, high, err := t.seeker.Watermarks(ctx, tp)
+		if err != nil {
+			return fmt.Errorf("query watermarks of %v: %w", tp, err)
+		}
+		gauges.Set("lag", metrics.Labels{"partition": tp.String()}, float64(max(0, high-offset)))
+	}
+	return nil
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/config"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/otlp"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/pipeline"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
 )
 
 type appConfig struct {
@@ -21,6 +25,54 @@ type appConfig struct {
 	BootstrapServers string `config_key:"kafka.consumer.bootstrap-servers"`
 	ConsumerGroupID  string `config_key:"kafka.consumer.group-id"`
 	ConsumeTopic     string `config_key:"kafka.consumer.topic"`
+	DeferTopic       string `config_key:"kafka.consumer.defer-topic"`
+
+	// LimiterLimit is the number of messages per key allowed per LimiterWindow. Zero disables
+	// limiting.
+	LimiterLimit  int           `config_key:"limiter.limit"`
+	LimiterWindow time.Duration `config_key:"limiter.window"`
+
+	// LimiterActions chooses what happens to limited messages per topic as a comma separated list
+	// of topic=action pairs where action is "defer" or "pause". Unlisted topics defer.
+	LimiterActions string `config_key:"limiter.actions"`
+
+	// LimiterPartitioning says how producers partition messages: "unkeyed" (the default) spreads
+	// each key over every partition so the limit is scaled to this consumer's share of partitions,
+	// and "keyed" puts each key on a single partition so the whole limit applies.
+	LimiterPartitioning string `config_key:"limiter.partitioning"`
+
+	// DeferralBackoff decides when deferred messages are retried: "refill" (the default) waits
+	// until the limiter expects capacity for the key, "exponential" waits DeferralBackoffBase
+	// doubled per deferral up to DeferralBackoffMax, and "none" retries immediately.
+	DeferralBackoff     string        `config_key:"deferral.backoff"`
+	DeferralBackoffBase time.Duration `config_key:"deferral.backoff-base"`
+	DeferralBackoffMax  time.Duration `config_key:"deferral.backoff-max"`
+
+	BrokerType           string        `config_key:"broker.type"`
+	BrokerPartitioner    string        `config_key:"broker.partitioner"`
+	FileBrokerDir        string        `config_key:"broker.file.dir"`
+	FileBrokerPartitions int           `config_key:"broker.file.partitions"`
+	FileSegmentBytes     int64         `config_key:"broker.file.segment-bytes"`
+	FileRetentionBytes   int64         `config_key:"broker.file.retention-bytes"`
+	FileRetentionAge     time.Duration `config_key:"broker.file.retention-age"`
+
+	// OTLPEndpoint is the OTLP/HTTP endpoint of a collector to push metrics and spans to, like
+	// http://localhost:4318. Empty disables pushing.
+	OTLPEndpoint string        `config_key:"otlp.endpoint"`
+	OTLPInterval time.Duration `config_key:"otlp.interval"`
+	// OTLPMaxPendingSpans is how many finished spans are kept waiting to be pushed before new ones
+	// are dropped. It defaults to enough for a few thousand spans a second over OTLPInterval.
+	OTLPMaxPendingSpans int `config_key:"otlp.max-pending-spans"`
+
+	// MetricsRetention is the resolutions metrics are kept at and for how long, as comma separated
+	// resolution:retention tiers like "1s:10m,10s:6h,1m:7d", which is the default.
+	MetricsRetention string `config_key:"metrics.retention"`
+
+	// MetricsSnapshotPath is a file the metrics are saved to every MetricsSnapshotInterval, which
+	// defaults to 30s, and when the process stops, and restored from when it starts. Empty disables
+	// snapshots.
+	MetricsSnapshotPath     string        `config_key:"metrics.snapshot-path"`
+	MetricsSnapshotInterval time.Duration `config_key:"metrics.snapshot-interval"`
 }
 
 func main() {
@@ -40,11 +92,86 @@ func run() error {
 		return fmt.Errorf("parse app config: %v", err)
 	}
 
-	stats := metrics.NewCount(5 * 60)
+	actions, err := pipeline.ParseActions(cfg.LimiterActions)
+	if err != nil {
+		return fmt.Errorf("parse limiter actions: %v", err)
+	}
+
+	if cfg.DeferTopic == "" {
+		cfg.DeferTopic = cfg.ConsumeTopic + "-deferred"
+	}
+	if cfg.OTLPInterval == 0 {
+		cfg.OTLPInterval = 10 * time.Second
+	}
+	if cfg.OTLPMaxPendingSpans <= 0 {
+		cfg.OTLPMaxPendingSpans = tracing.DefaultMaxPending(cfg.OTLPInterval)
+	}
+
+	retention, err := metrics.ParseRetention(cfg.MetricsRetention)
+	if err != nil {
+		return fmt.Errorf("parse metrics retention: %v", err)
+	}
+
+	consumer, deferrals, err := buildBroker(cfg)
+	if err != nil {
+		return fmt.Errorf("build broker: %v", err)
+	}
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			fmt.Printf("error: close consumer: %v\n", err)
+		}
+		if err := deferrals.Close(); err != nil {
+			fmt.Printf("error: close deferral producer: %v\n", err)
+		}
+	}()
+
+	stats := metrics.NewSet(clock.Real{}, retention, deferralBounds)
+	defer stats.Close()
+	// Stop the goroutines that record stats before they're closed, rather than when run returns.
+	defer stop()
+	describeStats(stats)
+
+	if cfg.MetricsSnapshotPath != "" {
+		if err := stats.LoadSnapshot(cfg.MetricsSnapshotPath); err != nil {
+			fmt.Printf("error: restore metrics snapshot: %v\n", err)
+		}
+		// Deferred after Close so it runs first and saves the final snapshot while the metrics are open.
+		defer func() {
+			if err := stats.SaveSnapshot(cfg.MetricsSnapshotPath); err != nil {
+				fmt.Printf("error: save metrics snapshot: %v\n", err)
+			}
+		}()
+		interval := cfg.MetricsSnapshotInterval
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+		go stats.SnapshotEvery(ctx, clock.Real{}, cfg.MetricsSnapshotPath, interval)
+	}
+
+	var tracer *tracing.Tracer
+	if cfg.OTLPEndpoint != "" {
+		exporter := otlp.NewExporter(cfg.OTLPEndpoint, "consumer")
+		tracer = tracing.NewTracer(clock.Real{}, exporter, cfg.OTLPMaxPendingSpans)
+		go tracer.Run(ctx, cfg.OTLPInterval)
+		go exporter.PushMetrics(ctx, clock.Real{}, stats, cfg.OTLPInterval)
+		fmt.Printf("info: pushing metrics and spans to %s every %v\n", cfg.OTLPEndpoint, cfg.OTLPInterval)
+	}
+
+	tracked := consumer
+	if lag := newLagTracker(consumer); lag != nil {
+		go lag.run(ctx, clock.Real{}, stats.Gauges, 10*time.Second)
+		tracked = lag
+	}
+
+	// Deferred messages and messages on paused topics are held until they're due rather than being
+	// retried immediately.
+	queue := pipeline.NewDelayQueue(tracked, clock.Real{}, stats.Counts)
+	go samplePauses(ctx, clock.Real{}, queue, stats.Gauges)
 
 	statsServer, err := newStatsServer(
 		fmt.Sprintf(":%s", cfg.HTTPPort),
 		stats,
+		queue,
 		cfg.HTTPWWWDir)
 	if err != nil {
 		return fmt.Errorf("serve stats page: %w", err)
@@ -55,113 +182,167 @@ func run() error {
 		}
 	}()
 
-	consumer, err := buildConsumer(cfg)
+	policy := policyFor(cfg)
+	limiter := policy.Limiter(clock.Real{})
+	if err := scaleLimiter(ctx, cfg, consumer, limiter); err != nil {
+		return err
+	}
+	backoff, err := policy.NewBackoff(limiter, clock.Real{})
 	if err != nil {
-		return fmt.Errorf("build Kafka consumer: %v", err)
+		return fmt.Errorf("build backoff: %v", err)
 	}
-	defer func() {
-		if err := consumer.Close(); err != nil {
-			fmt.Printf("error: close consumer: %v\n", err)
-		}
-	}()
 
-	handler := newHandler(stats)
+	handler := pipeline.NewHandler(
+		stats.Counts,
+		limiter,
+		// There's no real dependency in the POC so processing a message is just recording how many
+		// times it was deferred first.
+		pipeline.DependencyFunc(func(_ context.Context, env messages.Envelope) error {
+			stats.Histograms.Observe("deferrals", nil, float64(pipeline.DeferralCount(env)))
+			return nil
+		}),
+		deferrals,
+		cfg.DeferTopic,
+		backoff,
+		actions,
+		tracer)
 
-	for !isCancelled(ctx) {
-		msg, err := consumer.Consume(ctx)
+	return consume(ctx, queue, handler, tracer)
+}
+
+// buildBroker creates a consumer for the consume and defer topics and a producer for deferring
+// messages using the configured broker type, which defaults to Kafka.
+func buildBroker(cfg appConfig) (broker.Consumer, broker.Producer, error) {
+	switch cfg.BrokerType {
+	case "", "kafka":
+		consumer, err := broker.NewKafkaConsumer(cfg.BootstrapServers, cfg.ConsumerGroupID, cfg.ConsumeTopic, cfg.DeferTopic)
 		if err != nil {
-			fmt.Printf("error: consume: %v", err)
-			<-time.After(5 * time.Second)
-			continue
+			return nil, nil, err
 		}
-
-		if err := handler.Handle(ctx, msg); err != nil {
-			return fmt.Errorf("handle msg: %v", err)
+		producer, err := broker.NewKafkaProducer(broker.KafkaProducerConfig{
+			BootstrapServers: cfg.BootstrapServers,
+			Partitioner:      cfg.BrokerPartitioner,
+		})
+		if err != nil {
+			consumer.Close()
+			return nil, nil, err
 		}
-
-		if err := consumer.Commit(ctx); err != nil {
-			return fmt.Errorf("commit: %v\n", err)
+		return consumer, producer, nil
+	case "file":
+		fb, err := broker.NewFile(broker.FileConfig{
+			Dir:            cfg.FileBrokerDir,
+			Partitions:     cfg.FileBrokerPartitions,
+			SegmentBytes:   cfg.FileSegmentBytes,
+			RetentionBytes: cfg.FileRetentionBytes,
+			RetentionAge:   cfg.FileRetentionAge,
+			Partitioner:    cfg.BrokerPartitioner,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		consumer, err := fb.Consumer(cfg.ConsumerGroupID, cfg.ConsumeTopic, cfg.DeferTopic)
+		if err != nil {
+			return nil, nil, err
 		}
+		// The file broker allows one producer per partition, so the defer topic is opened up front
+		// to fail fast while a replay is deferring to the same directory.
+		producer := fb.Producer()
+		if err := producer.Open(cfg.DeferTopic); err != nil {
+			consumer.Close()
+			return nil, nil, fmt.Errorf("open defer topic: %v", err)
+		}
+		return consumer, producer, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported broker type %q", cfg.BrokerType)
 	}
-
-	return nil
 }
 
-type kafkaConsumer struct {
-	kc *kafka.Consumer
+// policyFor returns the limiting and backoff policy in cfg.
+func policyFor(cfg appConfig) pipeline.Policy {
+	return pipeline.Policy{
+		Limit:       cfg.LimiterLimit,
+		Window:      cfg.LimiterWindow,
+		Backoff:     cfg.DeferralBackoff,
+		BackoffBase: cfg.DeferralBackoffBase,
+		BackoffMax:  cfg.DeferralBackoffMax,
+	}
 }
 
-func (kc kafkaConsumer) Close() error {
-	return kc.kc.Close()
+// scaleLimiter starts scaling limiter to the consumer's share of the consume and defer topics'
+// partitions when producers don't key messages by the limiter key.
+func scaleLimiter(ctx context.Context, cfg appConfig, consumer broker.Consumer, limiter pipeline.Limiter) error {
+	switch cfg.LimiterPartitioning {
+	case "", partitioningUnkeyed:
+	case partitioningKeyed:
+		return nil
+	default:
+		return fmt.Errorf("unsupported limiter partitioning %q", cfg.LimiterPartitioning)
+	}
+	keyed, ok := limiter.(*ratelimit.Keyed)
+	if !ok {
+		return nil
+	}
+	if scaler := newLimitScaler(consumer, keyed, cfg.ConsumeTopic, cfg.DeferTopic); scaler != nil {
+		go scaler.run(ctx, clock.Real{}, 10*time.Second)
+	}
+	return nil
 }
 
-func (kc kafkaConsumer) Consume(ctx context.Context) (messages.Message, error) {
+// consume handles and commits messages from consumer until ctx is cancelled. Messages that can't
+// be decoded are logged and committed so they don't block the partition. Messages the handler
+// asks to pause for are held, uncommitted, with their partition paused until they can be retried.
+func consume(ctx context.Context, consumer *pipeline.DelayQueue, handler *pipeline.Handler, tracer *tracing.Tracer) error {
 	for !isCancelled(ctx) {
-		event := kc.kc.Poll(50)
-		switch event := event.(type) {
-		case *kafka.Message:
-			msg := messages.Message{}
-			if err := json.Unmarshal(event.Value, &msg); err != nil {
-				fmt.Printf("error: consume: %v\n", err)
-				continue
+		env, err := consumer.Consume(ctx)
+		if err != nil {
+			if isCancelled(ctx) {
+				break
 			}
-			return msg, nil
-		case kafka.PartitionEOF:
-			<-time.After(time.Second)
-		case kafka.Error:
-			fmt.Printf("error: consume: %v\n", event.Error())
+			fmt.Printf("error: consume: %v\n", err)
+			<-time.After(5 * time.Second)
+			continue
+		}
+		if err := handle(ctx, consumer, handler, tracer, env); err != nil {
+			return err
 		}
 	}
 
-	return messages.Message{}, ctx.Err()
-}
-
-func (kc kafkaConsumer) Commit(_ context.Context) error {
-	_, err := kc.kc.Commit()
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
-func buildConsumer(cfg appConfig) (kafkaConsumer, error) {
+// handle decodes, handles, and commits env under a span that the handler's and the commit's spans
+// are children of. It only returns errors that should stop the consumer.
+func handle(ctx context.Context, consumer *pipeline.DelayQueue, handler *pipeline.Handler, tracer *tracing.Tracer, env messages.Envelope) error {
+	ctx, span := tracer.Start(ctx, "consume", tracing.KindConsumer, pipeline.SpanAttributes(env))
+	defer span.End()
 
-	kc, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":  cfg.BootstrapServers,
-		"group.id":           cfg.ConsumerGroupID,
-		"auto.offset.reset":  "latest",
-		"enable.auto.commit": "false",
-	})
-	if err != nil {
-		return kafkaConsumer{}, fmt.Errorf("create Kafka consumer: %w", err)
+	// The message's customer and type are only known once it's decoded. Messages that can't be
+	// decoded are committed so they don't block the partition.
+	if err := messages.Decode(&env); err != nil {
+		span.SetError(err)
+		fmt.Printf("error: decode %s[%d]@%d: %v\n", env.Topic, env.Partition, env.Offset, err)
+	} else {
+		span.SetAttributes(pipeline.SpanAttributes(env))
+		var pause *pipeline.PauseError
+		if err := handler.Handle(ctx, env); errors.As(err, &pause) {
+			span.SetAttributes(tracing.Attributes{"paused": true})
+			if err := consumer.Hold(env, pause.Until); err != nil {
+				return fmt.Errorf("hold msg: %v", err)
+			}
+			return nil
+		} else if err != nil {
+			span.SetError(err)
+			return fmt.Errorf("handle msg: %v", err)
+		}
 	}
 
-	err = kc.Subscribe("messages", func(c *kafka.Consumer, e kafka.Event) error {
-		fmt.Printf("rebalance: %v\n", e)
-		return nil
-	})
+	_, commit := tracer.Start(ctx, "commit", tracing.KindInternal, pipeline.SpanAttributes(env))
+	err := consumer.Commit(ctx, env)
+	commit.SetError(err)
+	commit.End()
 	if err != nil {
-		return kafkaConsumer{}, fmt.Errorf("subscribe: %w", err)
+		return fmt.Errorf("commit: %v", err)
 	}
-
-	return kafkaConsumer{
-		kc: kc,
-	}, nil
-}
-
-func newHandler(stats *metrics.Count) handler {
-	return handler{
-		stats: stats,
-	}
-}
-
-type handler struct {
-	stats *metrics.Count
-}
-
-func (c handler) Handle(_ context.Context, msg messages.Message) error {
-	c.stats.Record(fmt.Sprintf("%s:%s", msg.CustomerID, msg.Type), 1)
-	// fmt.Printf("message: customer_id=%q type=%q body=%q\n", msg.CustomerID, msg.Type, msg.Body)
 	return nil
 }
 
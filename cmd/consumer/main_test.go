@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/pipeline"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+)
+
+func TestConsume(t *testing.T) {
+
+	t.Run("handles and commits produced messages", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		producer := m.Producer()
+		for _, customerID := range []string{"a", "b", "a"} {
+			data, headers, err := messages.Encode(messages.Avro{}, messages.CurrentSchemaVersion, messages.Message{
+				CustomerID: customerID,
+				Type:       "foo",
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, producer.Produce(context.Background(), messages.Envelope{
+				Topic:   "messages",
+				Headers: headers,
+				Raw:     data,
+			}))
+		}
+		// An undecodable message should be skipped rather than blocking the partition.
+		assert.NoError(t, producer.Produce(context.Background(), messages.Envelope{
+			Topic: "messages",
+			Raw:   []byte("not json"),
+		}))
+
+		stats := metrics.NewCount(clock.Real{}, metrics.Seconds(60))
+		defer stats.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			handler := pipeline.NewHandler(
+				stats,
+				ratelimit.Unlimited{},
+				pipeline.DependencyFunc(func(context.Context, messages.Envelope) error { return nil }),
+				m.Producer(),
+				"messages-deferred",
+				nil,
+				nil,
+				nil)
+			done <- consume(ctx, pipeline.NewDelayQueue(m.Consumer("consumer", "messages"), clock.Real{}, stats), handler, nil)
+		}()
+
+		tp := broker.TopicPartition{Topic: "messages", Partition: 0}
+		assert.Eventually(t, func() bool {
+			return m.Committed("consumer", tp) == 4
+		}, time.Second, 10*time.Millisecond)
+
+		cancel()
+		assert.NoError(t, <-done)
+
+		assert.Eventually(t, func() bool {
+			handled := metrics.Aggregate(stats.Select("handled", nil), metrics.Sum, "customer")
+			return total(handled[`handled{customer="a"}`]) == 2 && total(handled[`handled{customer="b"}`]) == 1
+		}, 3*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("pauses limited partitions instead of deferring", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		for range 2 {
+			data, headers, err := messages.Encode(messages.JSON{}, messages.CurrentSchemaVersion, messages.Message{
+				CustomerID: "a",
+				Type:       "foo",
+			})
+			assert.NoError(t, err)
+			assert.NoError(t, m.Producer().Produce(context.Background(), messages.Envelope{
+				Topic:   "orders",
+				Headers: headers,
+				Raw:     data,
+			}))
+		}
+
+		stats := metrics.NewCount(clock.Real{}, metrics.Seconds(60))
+		defer stats.Close()
+
+		queue := pipeline.NewDelayQueue(m.Consumer("consumer", "orders"), clock.Real{}, stats)
+		handler := pipeline.NewHandler(
+			stats,
+			ratelimit.NewKeyed(1, 300*time.Millisecond, clock.Real{}),
+			pipeline.DependencyFunc(func(context.Context, messages.Envelope) error { return nil }),
+			m.Producer(),
+			"orders-deferred",
+			nil,
+			map[string]pipeline.Action{"orders": pipeline.Pause},
+			nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- consume(ctx, queue, handler, nil)
+		}()
+
+		tp := broker.TopicPartition{Topic: "orders", Partition: 0}
+		assert.Eventually(t, func() bool {
+			_, paused := queue.Paused()[tp]
+			return m.Committed("consumer", tp) == 1 && paused
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Eventually(t, func() bool {
+			return m.Committed("consumer", tp) == 2
+		}, time.Second, 10*time.Millisecond)
+		assert.Empty(t, queue.Paused())
+		assert.Zero(t, m.Len(broker.TopicPartition{Topic: "orders-deferred", Partition: 0}))
+
+		cancel()
+		assert.NoError(t, <-done)
+	})
+}
+
+func total(buckets metrics.TimeBuckets) int {
+	sum := 0
+	for _, count := range buckets {
+		sum += count
+	}
+	return sum
+}
+
+// assignedConsumer is a memory consumer that reports a fixed subset of partitions as assigned, as
+// a Kafka consumer sharing its group would.
+type assignedConsumer struct {
+	*broker.MemoryConsumer
+	assignment []broker.TopicPartition
+}
+
+func (c assignedConsumer) Assignment() ([]broker.TopicPartition, error) {
+	return c.assignment, nil
+}
+
+func TestLimitScaler(t *testing.T) {
+
+	t.Run("scales the limit by the assigned share of every topic's partitions", func(t *testing.T) {
+		m := broker.NewMemory(4)
+		consumer := assignedConsumer{
+			MemoryConsumer: m.Consumer("consumer", "messages"),
+			assignment: []broker.TopicPartition{
+				{Topic: "messages", Partition: 0},
+				{Topic: "messages-deferred", Partition: 0},
+			},
+		}
+		limiter := ratelimit.NewKeyed(10, time.Second, clock.Real{})
+		scaler := newLimitScaler(consumer, limiter, "messages", "messages-deferred")
+		assert.NotNil(t, scaler)
+
+		// Two of the eight partitions.
+		assert.NoError(t, scaler.rescale(context.Background()))
+		assert.Equal(t, 3, limiter.Limit())
+
+		consumer.assignment = append(consumer.assignment,
+			broker.TopicPartition{Topic: "messages", Partition: 1},
+			broker.TopicPartition{Topic: "messages-deferred", Partition: 1})
+		scaler.assigned = consumer
+		assert.NoError(t, scaler.rescale(context.Background()))
+		assert.Equal(t, 5, limiter.Limit())
+	})
+
+	t.Run("keeps the limit until partitions are assigned", func(t *testing.T) {
+		m := broker.NewMemory(4)
+		limiter := ratelimit.NewKeyed(10, time.Second, clock.Real{})
+		scaler := newLimitScaler(assignedConsumer{MemoryConsumer: m.Consumer("consumer", "messages")}, limiter, "messages")
+		assert.NoError(t, scaler.rescale(context.Background()))
+		assert.Equal(t, 10, limiter.Limit())
+	})
+
+	t.Run("does nothing for consumers assigned every partition", func(t *testing.T) {
+		m := broker.NewMemory(4)
+		limiter := ratelimit.NewKeyed(10, time.Second, clock.Real{})
+		assert.Nil(t, newLimitScaler(m.Consumer("consumer", "messages"), limiter, "messages"))
+	})
+}
+
+func TestLagTracker(t *testing.T) {
+
+	t.Run("reports the messages after the last commit in each partition", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		for range 5 {
+			assert.NoError(t, m.Producer().Produce(context.Background(), messages.Envelope{Topic: "messages", Raw: []byte("raw")}))
+		}
+		lag := newLagTracker(m.Consumer("consumer", "messages"))
+		gauges := metrics.NewGauge(clock.Real{}, metrics.Seconds(60))
+		defer gauges.Close()
+
+		for range 2 {
+			env, err := lag.Consume(context.Background())
+			assert.NoError(t, err)
+			assert.NoError(t, lag.Commit(context.Background(), env))
+		}
+		assert.NoError(t, lag.sample(context.Background(), gauges))
+
+		assert.Eventually(t, func() bool {
+			for _, v := range gauges.Data()[`lag{partition="messages[0]"}`] {
+				if v.Last == 3 {
+					return true
+				}
+			}
+			return false
+		}, 3*time.Second, 50*time.Millisecond)
+	})
+}
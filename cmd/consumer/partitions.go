@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+)
+
+// Partitioning modes for limiter.partitioning.
+const (
+	// partitioningKeyed means producers key messages so every message for a limiter key lands on
+	// the same partition, and so is handled by a single consumer which can apply the whole limit.
+	partitioningKeyed = "keyed"
+
+	// partitioningUnkeyed means a limiter key's messages are spread across every partition, so
+	// each consumer in the group sees a share of them and applies a matching share of the limit.
+	partitioningUnkeyed = "unkeyed"
+)
+
+// A limitScaler keeps the per-key limit of a consumer reading unkeyed topics proportional to the
+// share of the topics' partitions it's assigned, so the group as a whole allows limit messages per
+// key however many consumers it has. The share counts every topic the limiter applies to, since a
+// key's messages are spread over the defer topic's partitions as well as the consume topic's.
+type limitScaler struct {
+	consumer broker.Seeker
+	assigned broker.Assigned
+	limiter  *ratelimit.Keyed
+	limit    int
+	topics   []string
+}
+
+// newLimitScaler returns a scaler for consumer's share of topics, or nil when consumer is assigned
+// every partition and there's nothing to scale.
+func newLimitScaler(consumer broker.Consumer, limiter *ratelimit.Keyed, topics ...string) *limitScaler {
+	seeker, ok := consumer.(broker.Seeker)
+	if !ok {
+		return nil
+	}
+	assigned, ok := consumer.(broker.Assigned)
+	if !ok {
+		return nil
+	}
+	return &limitScaler{
+		consumer: seeker,
+		assigned: assigned,
+		limiter:  limiter,
+		limit:    limiter.Limit(),
+		topics:   topics,
+	}
+}
+
+// run rescales the limit every interval until ctx is cancelled. Group membership changes as
+// consumers join and leave, so the assignment is re-checked rather than read once.
+func (s *limitScaler) run(ctx context.Context, clk clock.Clock, interval time.Duration) {
+	for {
+		if err := s.rescale(ctx); err != nil && !isCancelled(ctx) {
+			fmt.Printf("error: scale limit: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+	}
+}
+
+// rescale sets the limiter's limit from the consumer's current assignment. A consumer that isn't
+// assigned any partitions yet keeps its current limit.
+func (s *limitScaler) rescale(ctx context.Context) error {
+	partitions := 0
+	for _, topic := range s.topics {
+		ps, err := s.consumer.Partitions(ctx, topic)
+		if err != nil {
+			return fmt.Errorf("get partitions of %q: %w", topic, err)
+		}
+		partitions += len(ps)
+	}
+	assignment, err := s.assigned.Assignment()
+	if err != nil {
+		return fmt.Errorf("get assignment: %w", err)
+	}
+	assigned := 0
+	for _, tp := range assignment {
+		if slices.Contains(s.topics, tp.Topic) {
+			assigned++
+		}
+	}
+	if assigned == 0 || partitions == 0 {
+		return nil
+	}
+
+	limit := scaledLimit(s.limit, assigned, partitions)
+	if limit != s.limiter.Limit() {
+		fmt.Printf("info: limiting to %d per key for %d of %d partitions\n", limit, assigned, partitions)
+		s.limiter.SetLimit(limit)
+	}
+	return nil
+}
+
+// scaledLimit returns limit scaled by the assigned share of partitions. It rounds up so a consumer
+// with any partitions allows at least one message per key, which means a group can slightly exceed
+// the limit when it doesn't divide evenly.
+func scaledLimit(limit int, assigned int, partitions int) int {
+	return int(math.Ceil(float64(limit) * float64(assigned) / float64(partitions)))
+}
@@ -1,35 +1,75 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
-	"golang.org/x/exp/maps"
 )
 
+// A pauseReporter reports the partitions the consumer has paused and how long they've been paused.
+type pauseReporter interface {
+	Paused() map[broker.TopicPartition]time.Duration
+}
+
+// deferralBounds are the histogram buckets for the number of times handled messages were deferred.
+var deferralBounds = []float64{0, 1, 2, 5, 10, 20, 50}
+
+// describeStats sets the help text exported with each of the consumer's metrics.
+func describeStats(stats *metrics.Set) {
+	stats.Describe("handled", "Messages handled by calling the dependency.")
+	stats.Describe("deferred", "Messages deferred to the defer topic because their key was over its limit.")
+	stats.Describe("paused", "Messages that paused their partition because their key was over its limit.")
+	stats.Describe("pause-ms", "Milliseconds partitions were paused for.")
+	stats.Describe("deferrals", "How many times handled messages had been deferred.")
+	stats.Describe("paused-partitions", "Partitions currently paused.")
+	stats.Describe("lag", "Messages after the consumer's last commit in each partition.")
+}
+
+// samplePauses sets the paused-partitions gauge to the number of partitions pauses has paused
+// every second until ctx is cancelled.
+func samplePauses(ctx context.Context, clk clock.Clock, pauses pauseReporter, gauges *metrics.Gauge) {
+	for {
+		gauges.Set("paused-partitions", nil, float64(len(pauses.Paused())))
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(time.Second):
+		}
+	}
+}
+
 func newStatsServer(
 	addr string,
-	stats *metrics.Count,
+	stats *metrics.Set,
+	pauses pauseReporter,
 	wwwDir string,
 ) (*http.Server, error) {
 	mux := http.NewServeMux()
 
+	mux.Handle("/metrics", stats.Handler("consumer"))
+
 	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		data := stats.Data()
+		view, err := metrics.ParseView(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		accept := strings.Split(r.Header.Get("Accept"), ",")
 		if slices.Contains(accept, "application/json") {
-			serveJSON(data, w)
+			serveJSON(stats.Data(view), w)
 			return
 		}
-		serveHTML(wwwDir, data, w)
+		serveHTML(wwwDir, view, stats.LabelNames(view), stats.Ranges(), stats.Panels(view), pauses.Paused(), w)
 	})
 
 	staticDir := filepath.Join(wwwDir, "static")
@@ -43,14 +83,14 @@ func newStatsServer(
 
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
-			fmt.Printf("error: listen and serve: %w", err)
+			fmt.Printf("error: listen and serve: %v\n", err)
 		}
 	}()
 
 	return srv, nil
 }
 
-func serveJSON(data map[string]metrics.TimeBuckets, w http.ResponseWriter) {
+func serveJSON(data map[string]any, w http.ResponseWriter) {
 	body, err := json.MarshalIndent(data, "", "   ")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -60,63 +100,20 @@ func serveJSON(data map[string]metrics.TimeBuckets, w http.ResponseWriter) {
 	w.Write(body)
 }
 
-func serveHTML(wwwDir string, data map[string]metrics.TimeBuckets, w http.ResponseWriter) {
-	params := make(map[string]struct {
-		Points string
-	}, len(data))
-
-	orderedElements := maps.Keys(data)
-	slices.Sort(orderedElements)
-	for _, element := range orderedElements {
-		buckets := data[element]
-
-		orderedBucketTimes := maps.Keys(buckets)
-		slices.SortFunc(orderedBucketTimes, func(a time.Time, b time.Time) int {
-			delta := a.Sub(b).Nanoseconds()
-			if delta < 0 {
-				return -1
-			}
-			if delta > 0 {
-				return 1
-			}
-			return 0
-		})
-
-		max := slices.Max(maps.Values(buckets))
-
-		// HACK: I don't know how to make each panel the same height when they have different max
-		// values without affecting the scaling of other components in the panel (like the legend)
-		// so normalize the Y coordinates instead.
-		verticalScalingFactor := float64(100) / float64(max)
-
-		sb := strings.Builder{}
-		for i, k := range orderedBucketTimes {
-			count := buckets[k]
-
-			// HACK: This right aligns the polyline by figuring out how much empty space there is
-			// (the difference between the figure width and the number of data points) and shifting
-			// the existing data points to the right that distance.
-			x := (300 - len(buckets)) + i
-
-			// HACK: SVG Y coordinates put y=0 at the top of the figure. This inverts our values to
-			// compensate.
-			y := max - count
-
-			// HACK: Scale Y coordinate.
-			y = int(float64(y) * verticalScalingFactor)
-
-			if sb.Len() > 0 {
-				sb.WriteString(" ")
-			}
-			sb.WriteString(strconv.Itoa(x))
-			sb.WriteString(",")
-			sb.WriteString(strconv.Itoa(y))
-		}
-		params[element] = struct {
-			Points string
-		}{Points: sb.String()}
-	}
+type pausedPartition struct {
+	Partition string
+	Duration  string
+}
 
+func serveHTML(
+	wwwDir string,
+	view metrics.View,
+	labels []string,
+	ranges []string,
+	panels map[string]metrics.Panel,
+	paused map[broker.TopicPartition]time.Duration,
+	w http.ResponseWriter,
+) {
 	t := template.New("t")
 	t, err := t.ParseFiles(filepath.Join(wwwDir, "templates", "page.html"))
 	if err != nil {
@@ -124,7 +121,37 @@ func serveHTML(wwwDir string, data map[string]metrics.TimeBuckets, w http.Respon
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	if err := t.ExecuteTemplate(w, "page.html", params); err != nil {
+	pausedPartitions := make([]pausedPartition, 0, len(paused))
+	for tp, d := range paused {
+		pausedPartitions = append(pausedPartitions, pausedPartition{
+			Partition: tp.String(),
+			Duration:  d.Round(time.Millisecond).String(),
+		})
+	}
+	slices.SortFunc(pausedPartitions, func(a, b pausedPartition) int {
+		return strings.Compare(a.Partition, b.Partition)
+	})
+
+	page := struct {
+		Title  string
+		View   metrics.View
+		By     string
+		Range  string
+		Labels []string
+		Ranges []string
+		Panels map[string]metrics.Panel
+		Paused []pausedPartition
+	}{
+		Title:  "Consumer Stats",
+		View:   view,
+		By:     strings.Join(view.By, ","),
+		Range:  metrics.FormatDuration(view.Range),
+		Labels: labels,
+		Ranges: ranges,
+		Panels: panels,
+		Paused: pausedPartitions,
+	}
+	if err := t.ExecuteTemplate(w, "page.html", page); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Printf("fatal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run serves a stand-in for an OpenTelemetry collector that accepts OTLP/HTTP JSON and logs what
+// it receives, so the consumer's and producer's exports can be checked without running one.
+func run() error {
+
+	addr := flag.String("addr", ":4318", "address to listen on")
+	verbose := flag.Bool("v", false, "log each request's body")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/traces", receive("spans", *verbose, countSpans))
+	mux.Handle("POST /v1/metrics", receive("metrics", *verbose, countMetrics))
+
+	fmt.Printf("info: receiving OTLP/HTTP JSON on %s\n", *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// receive logs the service and how many items counter finds in each request to an endpoint.
+func receive(kind string, verbose bool, counter func(request) int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			fmt.Printf("error: decode %s: %v\n", kind, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("info: received %d %s from %v\n", counter(req), kind, req.services())
+		if verbose {
+			fmt.Printf("%s\n", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+}
+
+// request is the parts of an export request the stub counts.
+type request struct {
+	ResourceSpans []struct {
+		Resource   resource `json:"resource"`
+		ScopeSpans []struct {
+			Spans []json.RawMessage `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+	ResourceMetrics []struct {
+		Resource     resource `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []json.RawMessage `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type resource struct {
+	Attributes []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+}
+
+func (r resource) service() string {
+	for _, attr := range r.Attributes {
+		if attr.Key == "service.name" {
+			return attr.Value.StringValue
+		}
+	}
+	return "unknown"
+}
+
+func (r request) services() []string {
+	services := []string{}
+	for _, rs := range r.ResourceSpans {
+		services = append(services, rs.Resource.service())
+	}
+	for _, rm := range r.ResourceMetrics {
+		services = append(services, rm.Resource.service())
+	}
+	return services
+}
+
+func countSpans(r request) int {
+	n := 0
+	for _, rs := range r.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			n += len(ss.Spans)
+		}
+	}
+	return n
+}
+
+func countMetrics(r request) int {
+	n := 0
+	for _, rm := range r.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			n += len(sm.Metrics)
+		}
+	}
+	return n
+}
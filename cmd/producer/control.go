@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/scenario"
+)
+
+// control is the producer's traffic as its scenario describes it, adjusted by the overrides set
+// through the control API while the producer runs. It's safe for concurrent use.
+type control struct {
+	mu       sync.Mutex
+	clock    clock.Clock
+	scenario *scenario.Scenario
+	maxRPS   int
+	start    time.Time
+
+	// rate overrides the scenario's base rate, including its steps and ramps, when it's set.
+	rate *float64
+
+	// bursts enables the scenario's spike and noisy phases.
+	bursts bool
+
+	// customers and types are the weights currently in use.
+	customers []scenario.Weighted
+	types     []scenario.Weighted
+
+	// effective is the scenario with the overrides applied.
+	effective *scenario.Scenario
+
+	// initialFaults are the fault settings the producer started with; faults are the current ones.
+	initialFaults faultSettings
+	faults        faultSettings
+	faultCounts   map[string]int
+
+	achieved rateMeter
+
+	// produced is the number of messages sent since the producer started.
+	produced int
+}
+
+// controlSettings are the settings the control API reports and accepts. Fields left out of an
+// update keep their current value.
+type controlSettings struct {
+	Rate      *float64           `json:"rate"`
+	Bursts    *bool              `json:"bursts,omitempty"`
+	Customers map[string]float64 `json:"customers,omitempty"`
+	Types     map[string]float64 `json:"types,omitempty"`
+
+	// Faults holds the fault settings to change, in the form of [faultSettings].
+	Faults json.RawMessage `json:"faults,omitempty"`
+}
+
+// controlStatus describes what the producer is configured to do and what it's achieving.
+type controlStatus struct {
+	Scenario       string              `json:"scenario"`
+	MaxRPS         int                 `json:"max_rps"`
+	ConfiguredRate float64             `json:"configured_rate"`
+	AchievedRate   int                 `json:"achieved_rate"`
+	Produced       int                 `json:"produced"`
+	Rate           *float64            `json:"rate"`
+	Bursts         bool                `json:"bursts"`
+	Customers      []scenario.Weighted `json:"customers"`
+	Types          []scenario.Weighted `json:"types"`
+	Faults         faultSettings       `json:"faults"`
+
+	// FaultCounts is the number of messages that have been sent with each fault.
+	FaultCounts map[string]int `json:"fault_counts"`
+}
+
+// RateOverride describes the rate override for the status page.
+func (s controlStatus) RateOverride() string {
+	if s.Rate == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%.0f/s", *s.Rate)
+}
+
+func newControl(clk clock.Clock, sc *scenario.Scenario, maxRPS int, faults faultSettings) *control {
+	c := &control{
+		clock:         clk,
+		scenario:      sc,
+		maxRPS:        maxRPS,
+		start:         clk.Now(),
+		initialFaults: faults,
+		faultCounts:   map[string]int{},
+		achieved:      rateMeter{clock: clk},
+	}
+	c.reset()
+	return c
+}
+
+// Rate returns the number of messages per second to produce elapsed into the scenario.
+func (c *control) Rate(elapsed time.Duration) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.effective.Rate(elapsed)
+}
+
+// Pick chooses the customer and message type of a message produced elapsed into the scenario.
+func (c *control) Pick(elapsed time.Duration, rng *rand.Rand) (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.effective.Pick(elapsed, rng)
+}
+
+// sent counts a produced message towards the achieved rate.
+func (c *control) sent() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.achieved.add()
+	c.produced++
+}
+
+// faultSettings returns the current fault injection settings.
+func (c *control) faultSettings() faultSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.faults
+}
+
+// countFault counts n messages sent with fault.
+func (c *control) countFault(fault string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faultCounts[fault] += n
+}
+
+// reset discards every override.
+func (c *control) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate = nil
+	c.bursts = true
+	c.customers = slices.Clone(c.scenario.Customers)
+	c.types = slices.Clone(c.scenario.Types)
+	c.faults = c.initialFaults
+	c.rebuild()
+}
+
+// update applies the settings that are set in s. Nothing is changed if any of them are invalid.
+func (c *control) update(s controlSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s.Rate != nil && *s.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	customers, err := reweight(c.customers, s.Customers)
+	if err != nil {
+		return fmt.Errorf("customers: %w", err)
+	}
+	types, err := reweight(c.types, s.Types)
+	if err != nil {
+		return fmt.Errorf("types: %w", err)
+	}
+	faults := c.faults
+	if len(s.Faults) > 0 {
+		if err := json.Unmarshal(s.Faults, &faults); err != nil {
+			return fmt.Errorf("faults: %w", err)
+		}
+		if err := faults.validate(); err != nil {
+			return fmt.Errorf("faults: %w", err)
+		}
+	}
+
+	if s.Rate != nil {
+		rate := *s.Rate
+		c.rate = &rate
+	}
+	if s.Bursts != nil {
+		c.bursts = *s.Bursts
+	}
+	c.customers, c.types = customers, types
+	c.faults = faults
+	c.rebuild()
+	return nil
+}
+
+// reweight returns a copy of current with the weights in updates applied.
+func reweight(current []scenario.Weighted, updates map[string]float64) ([]scenario.Weighted, error) {
+	weighted := slices.Clone(current)
+	for name, weight := range updates {
+		i := slices.IndexFunc(weighted, func(w scenario.Weighted) bool { return w.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("%q isn't in the scenario", name)
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("%q has a negative weight", name)
+		}
+		weighted[i].Weight = weight
+	}
+	if !slices.ContainsFunc(weighted, func(w scenario.Weighted) bool { return w.Weight > 0 }) {
+		return nil, errors.New("at least one weight must be positive")
+	}
+	return weighted, nil
+}
+
+// rebuild derives the effective scenario from the scenario and the overrides. The caller must hold
+// c.mu.
+func (c *control) rebuild() {
+	effective := *c.scenario
+	effective.Customers = c.customers
+	effective.Types = c.types
+	effective.Phases = nil
+	for _, p := range c.scenario.Phases {
+		switch p.Kind {
+		case scenario.Step, scenario.Ramp:
+			if c.rate != nil {
+				continue
+			}
+		case scenario.Spike, scenario.Noisy:
+			if !c.bursts {
+				continue
+			}
+		}
+		effective.Phases = append(effective.Phases, p)
+	}
+	if c.rate != nil {
+		effective.BaseRate = *c.rate
+	}
+	c.effective = &effective
+}
+
+func (c *control) status() controlStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return controlStatus{
+		Scenario:       c.scenario.Name,
+		MaxRPS:         c.maxRPS,
+		ConfiguredRate: min(c.effective.Rate(c.clock.Now().Sub(c.start)), float64(c.maxRPS)),
+		AchievedRate:   c.achieved.rate(),
+		Produced:       c.produced,
+		Rate:           c.rate,
+		Bursts:         c.bursts,
+		Customers:      slices.Clone(c.customers),
+		Types:          slices.Clone(c.types),
+		Faults:         c.faults,
+		FaultCounts:    maps.Clone(c.faultCounts),
+	}
+}
+
+// rateMeter counts events per second and reports the count for the last complete second.
+type rateMeter struct {
+	clock   clock.Clock
+	second  time.Time
+	current int
+	last    int
+}
+
+func (m *rateMeter) add() {
+	m.roll()
+	m.current++
+}
+
+func (m *rateMeter) rate() int {
+	m.roll()
+	return m.last
+}
+
+func (m *rateMeter) roll() {
+	second := m.clock.Now().Truncate(time.Second)
+	if second.Equal(m.second) {
+		return
+	}
+	if second.Sub(m.second) == time.Second {
+		m.last = m.current
+	} else {
+		m.last = 0
+	}
+	m.second, m.current = second, 0
+}
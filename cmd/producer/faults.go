@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// Faults the producer can inject to exercise the consumer's defenses.
+const (
+	// faultDuplicate follows a message with a burst of identical copies.
+	faultDuplicate = "duplicate"
+
+	// faultMalformed truncates a message's encoded payload.
+	faultMalformed = "malformed"
+
+	// faultUnknownType gives a message a type the consumer has never seen.
+	faultUnknownType = "unknown-type"
+
+	// faultOversized pads a message's body to an unreasonable size.
+	faultOversized = "oversized"
+
+	// faultRunaway multiplies one customer's traffic, as if a bug made it produce every message
+	// several times over.
+	faultRunaway = "runaway"
+)
+
+// unknownType is the message type of messages with the unknown-type fault.
+const unknownType = "unknown"
+
+// faultSettings configures fault injection. Rates are the probability that a message gets the
+// fault, so zero disables it.
+type faultSettings struct {
+	DuplicateRate float64 `json:"duplicate_rate"`
+
+	// DuplicateBurst is the number of copies that follow a duplicated message.
+	DuplicateBurst int `json:"duplicate_burst"`
+
+	MalformedRate   float64 `json:"malformed_rate"`
+	UnknownTypeRate float64 `json:"unknown_type_rate"`
+	OversizedRate   float64 `json:"oversized_rate"`
+	OversizedBytes  int     `json:"oversized_bytes"`
+
+	// RunawayCustomer's messages are each sent RunawayFactor times when it's set.
+	RunawayCustomer string `json:"runaway_customer"`
+	RunawayFactor   int    `json:"runaway_factor"`
+}
+
+func (f faultSettings) validate() error {
+	for name, rate := range map[string]float64{
+		"duplicate_rate":    f.DuplicateRate,
+		"malformed_rate":    f.MalformedRate,
+		"unknown_type_rate": f.UnknownTypeRate,
+		"oversized_rate":    f.OversizedRate,
+	} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+	if f.DuplicateRate > 0 && f.DuplicateBurst < 1 {
+		return errors.New("duplicate_burst must be positive when duplicates are enabled")
+	}
+	if f.OversizedRate > 0 && f.OversizedBytes < 1 {
+		return errors.New("oversized_bytes must be positive when oversized bodies are enabled")
+	}
+	if f.RunawayCustomer != "" && f.RunawayFactor < 1 {
+		return errors.New("runaway_factor must be positive when there's a runaway customer")
+	}
+	return nil
+}
+
+// copies returns how many times a message for customerID is sent.
+func (f faultSettings) copies(customerID string) int {
+	if f.RunawayCustomer != "" && customerID == f.RunawayCustomer {
+		return f.RunawayFactor
+	}
+	return 1
+}
+
+// inject applies the message faults to msg and returns the faults it applied.
+func (f faultSettings) inject(msg *messages.Message, rng *rand.Rand) []string {
+	faults := []string{}
+	if chance(rng, f.UnknownTypeRate) {
+		msg.Type = unknownType
+		faults = append(faults, faultUnknownType)
+	}
+	if chance(rng, f.OversizedRate) && len(msg.Body) < f.OversizedBytes {
+		msg.Body += strings.Repeat(".", f.OversizedBytes-len(msg.Body))
+		faults = append(faults, faultOversized)
+	}
+	return faults
+}
+
+// malformed returns data without its last byte. Every codec ends a message with a non-empty
+// string field, so the result is cut off part way through a field whatever codec encoded it.
+func malformed(data []byte) []byte {
+	return data[:max(len(data)-1, 0)]
+}
+
+// chance reports whether an event with probability p happens. It doesn't use rng when p is zero so
+// disabled faults don't change a seeded scenario's traffic.
+func chance(rng *rand.Rand, p float64) bool {
+	return p > 0 && rng.Float64() < p
+}
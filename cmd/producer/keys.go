@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// A keyField names the message fields the producer keys messages by. Keying by any of them puts
+// every message for a consumer's limiter key on a single partition.
+type keyField string
+
+const (
+	keyNone         keyField = "none"
+	keyCustomer     keyField = "customer"
+	keyType         keyField = "type"
+	keyCustomerType keyField = "customer-type"
+)
+
+// parseKeyField parses a producer.key setting. An empty string means [keyNone].
+func parseKeyField(s string) (keyField, error) {
+	switch k := keyField(s); k {
+	case "":
+		return keyNone, nil
+	case keyNone, keyCustomer, keyType, keyCustomerType:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unsupported producer key %q", s)
+	}
+}
+
+// key returns the key to produce msg with, or nil when messages aren't keyed.
+func (k keyField) key(msg messages.Message) []byte {
+	switch k {
+	case keyCustomer:
+		return []byte(msg.CustomerID)
+	case keyType:
+		return []byte(msg.Type)
+	case keyCustomerType:
+		return []byte(msg.CustomerID + ":" + msg.Type)
+	default:
+		return nil
+	}
+}
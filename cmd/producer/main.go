@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
@@ -10,16 +9,91 @@ import (
 	"sync"
 	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/config"
 	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
-	"github.com/ttd2089/rate-limited-consumer-poc/internal/ringbuf"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/otlp"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/recording"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/scenario"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
 )
 
 type appConfig struct {
+	// HTTPPort serves the control API and status page when it's set.
+	HTTPPort   string `config_key:"http.listen-port"`
+	HTTPWWWDir string `config_key:"http.www-dir"`
+
 	BootstrapServers string `config_key:"kafka.consumer.bootstrap-servers"`
 	ProduceTopic     string `config_key:"kafka.consumer.topic"`
+	Codec            string `config_key:"messages.codec"`
+	SchemaVersion    int    `config_key:"messages.schema-version"`
+
+	// Scenario is the path of a scenario file describing the traffic to produce. Without one the
+	// producer uses scenario.Default.
+	Scenario string `config_key:"producer.scenario"`
+
+	// Key chooses the message fields produced messages are keyed by: "none" (the default),
+	// "customer", "type", or "customer-type".
+	Key string `config_key:"producer.key"`
+
+	// MaxRPS caps the send rate regardless of the scenario. Defaults to 1000.
+	MaxRPS int `config_key:"producer.max-rps"`
+
+	// Workers is the number of goroutines generating and sending messages. They share MaxRPS and
+	// the scenario's rate. Defaults to 1.
+	Workers int `config_key:"producer.workers"`
+
+	// KafkaLingerMs and KafkaBatchSize are passed through to librdkafka's linger.ms and batch.size
+	// when they're set, to trade latency for throughput at high rates.
+	KafkaLingerMs  int `config_key:"kafka.producer.linger-ms"`
+	KafkaBatchSize int `config_key:"kafka.producer.batch-size"`
+
+	// Record is the path of a JSON Lines trace to write every produced message to.
+	Record string `config_key:"producer.record"`
+
+	// Replay is the path of a trace to produce instead of a scenario. The producer exits when the
+	// trace ends. ReplaySpeed scales the trace's timing and defaults to 1.
+	Replay      string  `config_key:"producer.replay"`
+	ReplaySpeed float64 `config_key:"producer.replay-speed"`
+
+	// Fault injection. Rates are the probability a message gets the fault. They can also be
+	// changed through the control API.
+	FaultDuplicateRate   float64 `config_key:"faults.duplicate-rate"`
+	FaultDuplicateBurst  int     `config_key:"faults.duplicate-burst"`
+	FaultMalformedRate   float64 `config_key:"faults.malformed-rate"`
+	FaultUnknownTypeRate float64 `config_key:"faults.unknown-type-rate"`
+	FaultOversizedRate   float64 `config_key:"faults.oversized-rate"`
+	FaultOversizedBytes  int     `config_key:"faults.oversized-bytes"`
+	FaultRunawayCustomer string  `config_key:"faults.runaway-customer"`
+	FaultRunawayFactor   int     `config_key:"faults.runaway-factor"`
+
+	BrokerType           string        `config_key:"broker.type"`
+	BrokerPartitioner    string        `config_key:"broker.partitioner"`
+	FileBrokerDir        string        `config_key:"broker.file.dir"`
+	FileBrokerPartitions int           `config_key:"broker.file.partitions"`
+	FileSegmentBytes     int64         `config_key:"broker.file.segment-bytes"`
+	FileRetentionBytes   int64         `config_key:"broker.file.retention-bytes"`
+	FileRetentionAge     time.Duration `config_key:"broker.file.retention-age"`
+
+	// OTLPEndpoint is the OTLP/HTTP endpoint of a collector to push metrics and spans to, like
+	// http://localhost:4318. Empty disables pushing.
+	OTLPEndpoint string        `config_key:"otlp.endpoint"`
+	OTLPInterval time.Duration `config_key:"otlp.interval"`
+	// OTLPMaxPendingSpans is how many finished spans are kept waiting to be pushed before new ones
+	// are dropped. It defaults to enough for a few thousand spans a second over OTLPInterval.
+	OTLPMaxPendingSpans int `config_key:"otlp.max-pending-spans"`
+
+	// MetricsRetention is the resolutions metrics are kept at and for how long, as comma separated
+	// resolution:retention tiers like "1s:10m,10s:6h,1m:7d", which is the default.
+	MetricsRetention string `config_key:"metrics.retention"`
+
+	// MetricsSnapshotPath is a file the metrics are saved to every MetricsSnapshotInterval, which
+	// defaults to 30s, and when the process stops, and restored from when it starts. Empty disables
+	// snapshots.
+	MetricsSnapshotPath     string        `config_key:"metrics.snapshot-path"`
+	MetricsSnapshotInterval time.Duration `config_key:"metrics.snapshot-interval"`
 }
 
 func main() {
@@ -39,107 +113,407 @@ func run() error {
 		return fmt.Errorf("parse app config: %v", err)
 	}
 
-	producer, err := buildProducer(cfg)
+	codec, version, err := messageFormat(cfg)
 	if err != nil {
-		return fmt.Errorf("build Kafka consumer: %v", err)
+		return err
 	}
 
-	wg := sync.WaitGroup{}
+	key, err := parseKeyField(cfg.Key)
+	if err != nil {
+		return err
+	}
+
+	sc := scenario.Default()
+	if cfg.Scenario != "" {
+		if sc, err = scenario.Load(cfg.Scenario); err != nil {
+			return fmt.Errorf("load scenario: %v", err)
+		}
+	}
+	maxRPS := cfg.MaxRPS
+	if maxRPS <= 0 {
+		maxRPS = 1000
+	}
+	retention, err := metrics.ParseRetention(cfg.MetricsRetention)
+	if err != nil {
+		return fmt.Errorf("parse metrics retention: %v", err)
+	}
+
+	// The trace is opened first so it's closed after the producer flushes it.
+	var trace *os.File
+	if cfg.Record != "" {
+		if trace, err = os.Create(cfg.Record); err != nil {
+			return fmt.Errorf("create trace: %v", err)
+		}
+		defer func() {
+			if err := trace.Close(); err != nil {
+				fmt.Printf("error: close trace: %v\n", err)
+			}
+		}()
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		defer producer.Close()
+	set := metrics.NewSet(clock.Real{}, retention, latencyBounds)
+	defer set.Close()
 
-		customerIDs := []string{
-			"faa108f9-0815-4035-89c4-403b4f2f7948",
-			"e62358f4-47bb-4a45-9db3-a1c5ad6cdab2",
-			"139b70a3-60e8-47a0-9b7d-d8a369d18417",
-			"432556b3-0a3b-4dbb-83fc-187115228f67",
+	if cfg.MetricsSnapshotPath != "" {
+		if err := set.LoadSnapshot(cfg.MetricsSnapshotPath); err != nil {
+			fmt.Printf("error: restore metrics snapshot: %v\n", err)
 		}
-		types := []string{
-			"foo",
-			"bar",
-			"baz",
+		// Deferred after Close so it runs first and saves the final snapshot while the metrics are open.
+		defer func() {
+			if err := set.SaveSnapshot(cfg.MetricsSnapshotPath); err != nil {
+				fmt.Printf("error: save metrics snapshot: %v\n", err)
+			}
+		}()
+		interval := cfg.MetricsSnapshotInterval
+		if interval <= 0 {
+			interval = 30 * time.Second
 		}
+		go set.SnapshotEvery(ctx, clock.Real{}, cfg.MetricsSnapshotPath, interval)
+	}
+	stats := newProducerStats(set)
 
-		const maxRPS = 1000
-		sends := ringbuf.New[time.Time](maxRPS)
+	var tracer *tracing.Tracer
+	if cfg.OTLPEndpoint != "" {
+		interval := cfg.OTLPInterval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		maxPending := cfg.OTLPMaxPendingSpans
+		if maxPending <= 0 {
+			maxPending = tracing.DefaultMaxPending(interval)
+		}
+		exporter := otlp.NewExporter(cfg.OTLPEndpoint, "producer")
+		tracer = tracing.NewTracer(clock.Real{}, exporter, maxPending)
+		go tracer.Run(ctx, interval)
+		go exporter.PushMetrics(ctx, clock.Real{}, set, interval)
+		fmt.Printf("info: pushing metrics and spans to %s every %v\n", cfg.OTLPEndpoint, interval)
+	}
 
-		for !isCancelled(ctx) {
+	producer, err := buildProducer(cfg, stats.delivered)
+	if err != nil {
+		return fmt.Errorf("build producer: %v", err)
+	}
+	if trace != nil {
+		producer = recording.NewRecorder(producer, recording.NewWriter(trace, clock.Real{}))
+	}
+	defer func() {
+		if err := producer.Close(); err != nil {
+			fmt.Printf("error: close producer: %v\n", err)
+		}
+	}()
 
-			// Make message publishing "natrually" use ~90% of its rate limit. This will ensure we
-			// hit the rate limit but smooth it out some instead of sending in predictable batches.
-			naturalDelay := (rand.Int63n(time.Second.Nanoseconds()/maxRPS) * 9) / 10
-			<-time.After(time.Duration(naturalDelay))
+	if cfg.Replay != "" {
+		return replayTrace(ctx, cfg, producer, codec, version)
+	}
 
-			customerID := customerIDs[rand.Int()%len(customerIDs)]
-			type_ := types[rand.Int()%len(types)]
-			body := fmt.Sprintf("[%v]: %q message for customer %q", time.Now(), type_, customerID)
+	faults := faultConfig(cfg)
+	if err := faults.validate(); err != nil {
+		return fmt.Errorf("invalid fault config: %v", err)
+	}
 
-			msgValue, err := json.Marshal(messages.Message{
-				CustomerID: customerID,
-				Type:       type_,
-				Body:       body,
-			})
-			if err != nil {
-				panic(fmt.Errorf("failed to marshal messsages.Message to JSON: %v", err))
+	ctl := newControl(clock.Real{}, sc, maxRPS, faults)
+	if cfg.HTTPPort != "" {
+		statusServer, err := newStatusServer(fmt.Sprintf(":%s", cfg.HTTPPort), ctl, set, cfg.HTTPWWWDir)
+		if err != nil {
+			return fmt.Errorf("serve status page: %w", err)
+		}
+		defer func() {
+			if err := statusServer.Shutdown(context.Background()); err != nil {
+				fmt.Printf("error: shutdown status server: %v\n", err)
 			}
+		}()
+	}
+
+	workers := max(1, cfg.Workers)
+	fmt.Printf("info: producing scenario %q capped at %d messages per second with %d workers\n", sc.Name, maxRPS, workers)
+	go reportThroughput(ctx, clock.Real{}, ctl, 10*time.Second)
+	produce(ctx, clock.Real{}, producer, produceOptions{
+		Topic:   cfg.ProduceTopic,
+		Key:     key,
+		Codec:   codec,
+		Version: version,
+		Workers: workers,
+		Tracer:  tracer,
+	}, ctl, stats)
+
+	return nil
+}
+
+// produceOptions describes where and how produce sends messages.
+type produceOptions struct {
+	Topic   string
+	Key     keyField
+	Codec   messages.Codec
+	Version int
 
-			timestamp := time.Now()
+	// Workers is the number of goroutines generating and sending messages. Defaults to 1.
+	Workers int
 
-			if sends.Len() == maxRPS {
-				anchor, _ := sends.Get(0)
-				nextAllowedSend := anchor.Add(time.Second)
-				delay := nextAllowedSend.Sub(timestamp)
+	// Tracer records a span for each send. It may be nil.
+	Tracer *tracing.Tracer
+}
+
+// batchSize is the most messages a worker takes from the schedule at once. Taking them in batches
+// keeps workers from contending for the schedule at high rates.
+const batchSize = 100
+
+// produce sends messages to opts.Topic at the rate ctl describes, picking customers and message
+// types as ctl describes, until ctx is cancelled. The scenario's rate never exceeds ctl's max
+// however many workers share it, but duplicate and runaway copies are sent on top of it. Messages are keyed by opts.Key's fields, and what's sent is recorded in stats.
+func produce(
+	ctx context.Context,
+	clk clock.Clock,
+	producer broker.Producer,
+	opts produceOptions,
+	ctl *control,
+	stats *producerStats,
+) {
+	workers := max(1, opts.Workers)
+	// The schedule and every worker get their own random source seeded from the scenario's, so a
+	// seeded scenario is repeatable but the schedule's arrival gaps aren't drawn from the same
+	// sequence as a worker's picks.
+	seeds := ctl.scenario.NewRand()
+	sched := newSchedule(clk, ctl, rand.New(rand.NewSource(seeds.Int63())))
+	pacer := newPacer(clk, ctl.maxRPS)
+	rngs := make([]*rand.Rand, 0, workers)
+	for range workers {
+		rngs = append(rngs, rand.New(rand.NewSource(seeds.Int63())))
+	}
+
+	wg := sync.WaitGroup{}
+	for _, rng := range rngs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n, elapsed, err := sched.take(ctx, batchSize)
+				if err != nil {
+					return
+				}
+				stats.target(min(ctl.Rate(elapsed), float64(ctl.maxRPS)))
+				for range n {
+					if err := produceOne(ctx, clk, producer, opts, ctl, stats, pacer, rng, elapsed); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// produceOne generates a message elapsed into the scenario, injects ctl's faults into it, and
+// sends it. It only returns an error when ctx is cancelled; failed sends are logged.
+func produceOne(
+	ctx context.Context,
+	clk clock.Clock,
+	producer broker.Producer,
+	opts produceOptions,
+	ctl *control,
+	stats *producerStats,
+	pacer *pacer,
+	rng *rand.Rand,
+	elapsed time.Duration,
+) error {
+	customerID, type_ := ctl.Pick(elapsed, rng)
+	faults := ctl.faultSettings()
+
+	for i := range faults.copies(customerID) {
+		if i > 0 {
+			ctl.countFault(faultRunaway, 1)
+		}
+
+		msg := messages.Message{
+			CustomerID: customerID,
+			Type:       type_,
+			Body:       fmt.Sprintf("[%v]: %q message for customer %q", clk.Now(), type_, customerID),
+			ID:         fmt.Sprintf("%016x", rng.Uint64()),
+		}
+		for _, fault := range faults.inject(&msg, rng) {
+			ctl.countFault(fault, 1)
+		}
+
+		msgValue, msgHeaders, err := messages.Encode(opts.Codec, opts.Version, msg)
+		if err != nil {
+			panic(fmt.Errorf("failed to encode messsages.Message as %s: %v", opts.Codec.ContentType(), err))
+		}
+		if chance(rng, faults.MalformedRate) {
+			msgValue = malformed(msgValue)
+			ctl.countFault(faultMalformed, 1)
+		}
+
+		sends := 1
+		if chance(rng, faults.DuplicateRate) {
+			sends += faults.DuplicateBurst
+			ctl.countFault(faultDuplicate, faults.DuplicateBurst)
+		}
+
+		for j := range sends {
+			// Only the scenario's message waits for the max rate. Copies are sent straight after it
+			// like a buggy producer's, so a runaway customer adds to the traffic rather than taking
+			// capacity from the other customers.
+			if i == 0 && j == 0 {
+				delay, err := pacer.wait(ctx)
+				if err != nil {
+					return err
+				}
 				if delay > 0 {
-					fmt.Printf("info: delaying %v for rate limit\n", delay)
-					<-time.After(delay)
+					stats.delayed(delay)
 				}
 			}
 
-			err = producer.Produce(&kafka.Message{
-				TopicPartition: kafka.TopicPartition{
-					Topic: &cfg.ProduceTopic,
-				},
-				Value:     msgValue,
-				Timestamp: timestamp,
-			}, nil)
+			produceCtx, span := opts.Tracer.Start(ctx, "produce", tracing.KindProducer, tracing.Attributes{
+				"customer": msg.CustomerID,
+				"type":     msg.Type,
+				"topic":    opts.Topic,
+			})
+			err = producer.Produce(produceCtx, messages.Envelope{
+				Topic:     opts.Topic,
+				Key:       opts.Key.key(msg),
+				Headers:   msgHeaders,
+				Timestamp: clk.Now(),
+				Raw:       msgValue,
+				// The message isn't produced, but delivery reports label their stats with it.
+				Message: msg,
+			})
+			span.SetError(err)
+			span.End()
 			if err != nil {
-				fmt.Printf("error: produce message: %v", err)
+				fmt.Printf("error: produce message: %v\n", err)
 				continue
 			}
 
-			sends.Push(timestamp)
+			ctl.sent()
+			stats.produced(msg)
 		}
-	}()
+	}
+	return nil
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for e := range producer.Events() {
-			switch ev := e.(type) {
-			case *kafka.Message:
-				if ev.TopicPartition.Error != nil {
-					fmt.Printf("error: produce message: %v\n", ev.TopicPartition.Error)
-				}
-			}
+// reportThroughput logs the average rate messages were produced at every interval until ctx is
+// cancelled.
+func reportThroughput(ctx context.Context, clk clock.Clock, ctl *control, interval time.Duration) {
+	last := ctl.status().Produced
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
 		}
-	}()
+		produced := ctl.status().Produced
+		fmt.Printf("info: produced %.0f messages per second\n", float64(produced-last)/interval.Seconds())
+		last = produced
+	}
+}
 
-	wg.Wait()
+// faultConfig returns the configured fault injection settings. Duplicate bursts default to 10
+// copies, oversized bodies to 256KiB, and runaway customers to 10 times their traffic.
+func faultConfig(cfg appConfig) faultSettings {
+	f := faultSettings{
+		DuplicateRate:   cfg.FaultDuplicateRate,
+		DuplicateBurst:  cfg.FaultDuplicateBurst,
+		MalformedRate:   cfg.FaultMalformedRate,
+		UnknownTypeRate: cfg.FaultUnknownTypeRate,
+		OversizedRate:   cfg.FaultOversizedRate,
+		OversizedBytes:  cfg.FaultOversizedBytes,
+		RunawayCustomer: cfg.FaultRunawayCustomer,
+		RunawayFactor:   cfg.FaultRunawayFactor,
+	}
+	if f.DuplicateBurst == 0 {
+		f.DuplicateBurst = 10
+	}
+	if f.OversizedBytes == 0 {
+		f.OversizedBytes = 256 << 10
+	}
+	if f.RunawayFactor == 0 {
+		f.RunawayFactor = 10
+	}
+	return f
+}
+
+// replayTrace produces the trace at cfg.Replay to the produce topic with its recorded timing.
+func replayTrace(
+	ctx context.Context,
+	cfg appConfig,
+	producer broker.Producer,
+	codec messages.Codec,
+	version int,
+) error {
+	f, err := os.Open(cfg.Replay)
+	if err != nil {
+		return fmt.Errorf("open trace: %v", err)
+	}
+	defer f.Close()
 
+	fmt.Printf("info: replaying trace %q to %q\n", cfg.Replay, cfg.ProduceTopic)
+	n, err := recording.Replay(ctx, clock.Real{}, recording.NewReader(f), producer, recording.ReplayOptions{
+		Speed:   cfg.ReplaySpeed,
+		Topic:   cfg.ProduceTopic,
+		Codec:   codec,
+		Version: version,
+	})
+	fmt.Printf("info: replayed %d messages\n", n)
+	if err != nil && !isCancelled(ctx) {
+		return fmt.Errorf("replay trace: %v", err)
+	}
+	if err := producer.Flush(ctx); err != nil && !isCancelled(ctx) {
+		return fmt.Errorf("flush producer: %v", err)
+	}
 	return nil
 }
 
-func buildProducer(cfg appConfig) (*kafka.Producer, error) {
-	kp, err := kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": cfg.BootstrapServers,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("create Kafka producer: %w", err)
+// idleInterval is the longest the producer waits before checking whether the rate has changed.
+const idleInterval = 100 * time.Millisecond
+
+// buildProducer creates a producer for the configured broker type, which defaults to Kafka.
+// onDelivery is called with the outcome of every message it produces.
+func buildProducer(cfg appConfig, onDelivery func(broker.DeliveryReport)) (broker.Producer, error) {
+	switch cfg.BrokerType {
+	case "", "kafka":
+		return broker.NewKafkaProducer(broker.KafkaProducerConfig{
+			BootstrapServers: cfg.BootstrapServers,
+			Partitioner:      cfg.BrokerPartitioner,
+			LingerMs:         cfg.KafkaLingerMs,
+			BatchSize:        cfg.KafkaBatchSize,
+			OnDelivery:       onDelivery,
+		})
+	case "file":
+		fb, err := broker.NewFile(broker.FileConfig{
+			Dir:            cfg.FileBrokerDir,
+			Partitions:     cfg.FileBrokerPartitions,
+			SegmentBytes:   cfg.FileSegmentBytes,
+			RetentionBytes: cfg.FileRetentionBytes,
+			RetentionAge:   cfg.FileRetentionAge,
+			Partitioner:    cfg.BrokerPartitioner,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return broker.ReportDeliveries(fb.Producer(), onDelivery), nil
+	default:
+		return nil, fmt.Errorf("unsupported broker type %q", cfg.BrokerType)
+	}
+}
+
+// messageFormat returns the codec and schema version to produce messages with. The codec defaults
+// to JSON and the schema version defaults to the latest.
+func messageFormat(cfg appConfig) (messages.Codec, int, error) {
+	codecName := cfg.Codec
+	if codecName == "" {
+		codecName = "json"
+	}
+	codec, ok := messages.LookupCodec(codecName)
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported message codec %q", cfg.Codec)
+	}
+	version := cfg.SchemaVersion
+	if version == 0 {
+		version = messages.CurrentSchemaVersion
+	}
+	if version < messages.SchemaVersion1 || version > messages.CurrentSchemaVersion {
+		return nil, 0, fmt.Errorf("%w: %d", messages.ErrUnsupportedSchemaVersion, version)
 	}
-	return kp, nil
+	return codec, version, nil
 }
 
 func isCancelled(ctx context.Context) bool {
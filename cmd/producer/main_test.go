@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/scenario"
+)
+
+func TestProduce(t *testing.T) {
+
+	t.Run("produces the scenario's traffic at its rate", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			Seed:      1,
+			BaseRate:  10,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+			Phases: []scenario.Phase{{
+				Kind:     scenario.Noisy,
+				Start:    scenario.Duration(time.Second),
+				Customer: "noisy",
+				Type:     "bar",
+				Rate:     10,
+			}},
+		}
+		require.NoError(t, sc.Validate())
+
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(time.Unix(0, 0))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		stats := newTestStats(t)
+		go func() {
+			produce(ctx, clk, m.Producer(), produceOptions{Topic: "messages", Codec: messages.JSON{}, Version: messages.CurrentSchemaVersion}, newControl(clk, sc, 1000, faultSettings{}), stats)
+			close(done)
+		}()
+
+		// The first second produces 10 messages at 100ms intervals, the next about 20 at 50ms
+		// intervals.
+		for range 40 {
+			require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+			clk.Advance(50 * time.Millisecond)
+		}
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		tp := broker.TopicPartition{Topic: "messages", Partition: 0}
+		produced := m.Len(tp)
+		require.InDelta(t, 31, produced, 1)
+
+		consumer := m.Consumer("test", "messages")
+		noisy := 0
+		for i := range int(produced) {
+			env, err := consumer.Consume(context.Background())
+			require.NoError(t, err)
+			require.NoError(t, messages.Decode(&env))
+			require.NoError(t, consumer.Commit(context.Background(), env))
+			if env.Message.CustomerID == "noisy" {
+				assert.Equal(t, "bar", env.Message.Type)
+				assert.GreaterOrEqual(t, i, 10, "the noisy phase starts after one second")
+				noisy++
+			}
+		}
+		assert.InDelta(t, 10, noisy, 6)
+	})
+
+	t.Run("injects and counts faults", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			Seed:      1,
+			BaseRate:  1,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, sc.Validate())
+		faults := faultSettings{
+			DuplicateRate:   1,
+			DuplicateBurst:  2,
+			MalformedRate:   1,
+			UnknownTypeRate: 1,
+			OversizedRate:   1,
+			OversizedBytes:  1024,
+			RunawayCustomer: "a",
+			RunawayFactor:   3,
+		}
+		require.NoError(t, faults.validate())
+
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(time.Unix(0, 0))
+		ctl := newControl(clk, sc, 1000, faults)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		stats := newTestStats(t)
+		go func() {
+			produce(ctx, clk, m.Producer(), produceOptions{Topic: "messages", Codec: messages.JSON{}, Version: messages.CurrentSchemaVersion}, ctl, stats)
+			close(done)
+		}()
+
+		// The first message is sent immediately, then the producer waits for the next.
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		// Three runaway copies, each sent three times because of the duplicate bursts.
+		assert.Equal(t, int64(9), m.Len(broker.TopicPartition{Topic: "messages", Partition: 0}))
+		assert.Equal(t, map[string]int{
+			faultRunaway:     2,
+			faultDuplicate:   6,
+			faultMalformed:   3,
+			faultUnknownType: 3,
+			faultOversized:   3,
+		}, ctl.status().FaultCounts)
+
+		consumer := m.Consumer("test", "messages")
+		env, err := consumer.Consume(context.Background())
+		require.NoError(t, err)
+		assert.Error(t, messages.Decode(&env), "malformed messages can't be decoded")
+	})
+
+	t.Run("fault copies are sent on top of the max rate", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			Seed:      1,
+			BaseRate:  10,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, sc.Validate())
+		faults := faultSettings{RunawayCustomer: "a", RunawayFactor: 3}
+		require.NoError(t, faults.validate())
+
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(time.Unix(0, 0))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			produce(ctx, clk, m.Producer(), produceOptions{Topic: "messages", Codec: messages.JSON{}, Version: messages.CurrentSchemaVersion}, newControl(clk, sc, 10, faults), newTestStats(t))
+			close(done)
+		}()
+
+		for range 40 {
+			require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+			clk.Advance(50 * time.Millisecond)
+		}
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		// Two seconds at the max of 10 messages a second, each sent three times. Paced copies would
+		// keep the total to about 20.
+		produced := m.Len(broker.TopicPartition{Topic: "messages", Partition: 0})
+		assert.Greater(t, produced, int64(2*2*10), "a runaway customer pushes the total past the max")
+		assert.InDelta(t, 3*21, produced, 6)
+	})
+
+	t.Run("malformed payloads can't be decoded with any codec", func(t *testing.T) {
+		msg := messages.Message{CustomerID: "a", Type: "foo", Body: "body", ID: "1"}
+		for _, codec := range []messages.Codec{messages.JSON{}, messages.Protobuf{}, messages.Avro{}} {
+			for _, version := range []int{messages.SchemaVersion1, messages.SchemaVersion2} {
+				data, headers, err := messages.Encode(codec, version, msg)
+				require.NoError(t, err)
+				env := messages.Envelope{Raw: malformed(data), Headers: headers}
+				assert.Error(t, messages.Decode(&env), "%s version %d", codec.ContentType(), version)
+			}
+		}
+	})
+
+	t.Run("keys messages by the configured fields", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			Seed:      1,
+			BaseRate:  10,
+			Customers: []scenario.Weighted{{Name: "a"}, {Name: "b"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, sc.Validate())
+
+		m := broker.NewMemory(4)
+		clk := clock.NewManual(time.Unix(0, 0))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		set := metrics.NewSet(clock.Real{}, metrics.Seconds(60), latencyBounds)
+		defer set.Close()
+		stats := newProducerStats(set)
+		producer := broker.ReportDeliveries(m.Producer(), stats.delivered)
+		go func() {
+			produce(ctx, clk, producer, produceOptions{Topic: "messages", Key: keyCustomerType, Codec: messages.JSON{}, Version: messages.CurrentSchemaVersion}, newControl(clk, sc, 1000, faultSettings{}), stats)
+			close(done)
+		}()
+		for range 10 {
+			require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+			clk.Advance(100 * time.Millisecond)
+		}
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		cancel()
+		<-done
+
+		consumer := m.Consumer("test", "messages")
+		partitions := map[string]int32{}
+		for range 10 {
+			env, err := consumer.Consume(context.Background())
+			require.NoError(t, err)
+			require.NoError(t, messages.Decode(&env))
+			require.NoError(t, consumer.Commit(context.Background(), env))
+
+			key := env.Message.CustomerID + ":" + env.Message.Type
+			assert.Equal(t, key, string(env.Key))
+			if p, ok := partitions[key]; ok {
+				assert.Equal(t, p, env.Partition, "a key's messages share a partition")
+			}
+			partitions[key] = env.Partition
+		}
+
+		assert.Eventually(t, func() bool {
+			data := metrics.Aggregate(set.Counts.Select("", nil), metrics.Sum)
+			latencies := 0
+			for _, v := range set.Histograms.Data()["delivery-latency-ms"] {
+				latencies += v.Total()
+			}
+			return total(data["produced"]) >= 10 && total(data["delivered"]) >= 10 && latencies >= 10
+		}, 3*time.Second, 50*time.Millisecond)
+		assert.Equal(t, []string{"customer", "type"}, metrics.LabelNames(set.Counts.Select("delivered", nil)),
+			"deliveries are labeled like the messages produced")
+	})
+}
+
+func TestWorkers(t *testing.T) {
+
+	t.Run("the schedule hands out the rate in batches", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			BaseRate:  1000,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, sc.Validate())
+		clk := clock.NewManual(time.Unix(0, 0))
+		sched := newSchedule(clk, newControl(clk, sc, 1000, faultSettings{}), sc.NewRand())
+
+		clk.Advance(100 * time.Millisecond)
+		granted := []int{}
+		for range 3 {
+			n, elapsed, err := sched.take(context.Background(), 40)
+			require.NoError(t, err)
+			assert.Equal(t, 100*time.Millisecond, elapsed)
+			granted = append(granted, n)
+		}
+		assert.Equal(t, []int{40, 40, 21}, granted, "100ms of credit plus the first message")
+
+		n, _, wait := sched.tryTake(40)
+		assert.Zero(t, n)
+		assert.Equal(t, time.Millisecond, wait)
+	})
+
+	t.Run("poisson arrivals average out to the rate", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			Seed:      1,
+			BaseRate:  100,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+			Arrivals:  scenario.Poisson,
+		}
+		require.NoError(t, sc.Validate())
+		clk := clock.NewManual(time.Unix(0, 0))
+		sched := newSchedule(clk, newControl(clk, sc, 1000, faultSettings{}), sc.NewRand())
+
+		total := 0
+		perTick := map[int]int{}
+		for range 1000 {
+			n, _, _ := sched.tryTake(batchSize)
+			total += n
+			perTick[n]++
+			clk.Advance(10 * time.Millisecond)
+		}
+		assert.InDelta(t, 1000, total, 100)
+		assert.Greater(t, len(perTick), 2, "gaps vary rather than being spaced evenly")
+	})
+
+	t.Run("workers share the rate", func(t *testing.T) {
+		sc := &scenario.Scenario{
+			BaseRate:  200,
+			Customers: []scenario.Weighted{{Name: "a"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, sc.Validate())
+
+		m := broker.NewMemory(1)
+		ctl := newControl(clock.Real{}, sc, 1000, faultSettings{})
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		produce(ctx, clock.Real{}, m.Producer(), produceOptions{
+			Topic:   "messages",
+			Codec:   messages.JSON{},
+			Version: messages.CurrentSchemaVersion,
+			Workers: 4,
+		}, ctl, newTestStats(t))
+
+		assert.InDelta(t, 100, m.Len(broker.TopicPartition{Topic: "messages", Partition: 0}), 20)
+		assert.Equal(t, int(m.Len(broker.TopicPartition{Topic: "messages", Partition: 0})), ctl.status().Produced)
+	})
+}
+
+func newTestStats(t *testing.T) *producerStats {
+	set := metrics.NewSet(clock.Real{}, metrics.Seconds(60), latencyBounds)
+	t.Cleanup(set.Close)
+	return newProducerStats(set)
+}
+
+func total(buckets metrics.TimeBuckets) int {
+	sum := 0
+	for _, count := range buckets {
+		sum += count
+	}
+	return sum
+}
+
+func TestControl(t *testing.T) {
+
+	newScenario := func(t *testing.T) *scenario.Scenario {
+		sc := &scenario.Scenario{
+			Name:      "test",
+			BaseRate:  100,
+			Customers: []scenario.Weighted{{Name: "a"}, {Name: "b"}},
+			Types:     []scenario.Weighted{{Name: "foo"}},
+			Phases: []scenario.Phase{
+				{Kind: scenario.Step, Start: scenario.Duration(time.Minute), Rate: 200},
+				{Kind: scenario.Spike, Multiplier: 2},
+			},
+		}
+		require.NoError(t, sc.Validate())
+		return sc
+	}
+
+	rate := func(r float64) *float64 { return &r }
+	enabled := func(b bool) *bool { return &b }
+
+	t.Run("overrides the rate and bursts", func(t *testing.T) {
+		ctl := newControl(clock.NewManual(time.Unix(0, 0)), newScenario(t), 1000, faultSettings{})
+		assert.Equal(t, 200.0, ctl.Rate(0))
+		assert.Equal(t, 400.0, ctl.Rate(time.Minute))
+
+		require.NoError(t, ctl.update(controlSettings{Rate: rate(50)}))
+		assert.Equal(t, 100.0, ctl.Rate(time.Minute), "the override replaces steps but spikes still apply")
+
+		require.NoError(t, ctl.update(controlSettings{Bursts: enabled(false)}))
+		assert.Equal(t, 50.0, ctl.Rate(time.Minute))
+
+		ctl.reset()
+		assert.Equal(t, 400.0, ctl.Rate(time.Minute))
+	})
+
+	t.Run("changes weights", func(t *testing.T) {
+		ctl := newControl(clock.NewManual(time.Unix(0, 0)), newScenario(t), 1000, faultSettings{})
+		require.NoError(t, ctl.update(controlSettings{Customers: map[string]float64{"a": 0}}))
+
+		rng := ctl.scenario.NewRand()
+		for range 100 {
+			customer, _ := ctl.Pick(0, rng)
+			assert.Equal(t, "b", customer)
+		}
+	})
+
+	t.Run("rejects invalid settings without applying any", func(t *testing.T) {
+		ctl := newControl(clock.NewManual(time.Unix(0, 0)), newScenario(t), 1000, faultSettings{})
+		for _, s := range []controlSettings{
+			{Rate: rate(-1)},
+			{Rate: rate(10), Customers: map[string]float64{"c": 1}},
+			{Rate: rate(10), Customers: map[string]float64{"a": 0, "b": 0}},
+			{Rate: rate(10), Types: map[string]float64{"foo": -1}},
+		} {
+			assert.Error(t, ctl.update(s))
+		}
+		assert.Nil(t, ctl.status().Rate)
+	})
+
+	t.Run("changes and resets fault settings", func(t *testing.T) {
+		ctl := newControl(clock.NewManual(time.Unix(0, 0)), newScenario(t), 1000, faultSettings{DuplicateBurst: 10})
+		require.NoError(t, ctl.update(controlSettings{Faults: []byte(`{"duplicate_rate": 0.5}`)}))
+		assert.Equal(t, faultSettings{DuplicateRate: 0.5, DuplicateBurst: 10}, ctl.faultSettings())
+
+		assert.Error(t, ctl.update(controlSettings{Faults: []byte(`{"malformed_rate": 2}`)}))
+		assert.Error(t, ctl.update(controlSettings{Faults: []byte(`{"runaway_customer": "a"}`)}))
+
+		ctl.reset()
+		assert.Equal(t, faultSettings{DuplicateBurst: 10}, ctl.faultSettings())
+	})
+
+	t.Run("reports configured and achieved rates", func(t *testing.T) {
+		clk := clock.NewManual(time.Unix(0, 0))
+		ctl := newControl(clk, newScenario(t), 150, faultSettings{})
+		for range 120 {
+			ctl.sent()
+		}
+		assert.Zero(t, ctl.status().AchievedRate)
+
+		clk.Advance(time.Second)
+		status := ctl.status()
+		assert.Equal(t, 120, status.AchievedRate)
+		assert.Equal(t, 150.0, status.ConfiguredRate, "the configured rate is capped at the max")
+
+		clk.Advance(2 * time.Second)
+		assert.Zero(t, ctl.status().AchievedRate)
+	})
+}
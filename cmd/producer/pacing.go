@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+)
+
+// pacingLogInterval is the least time between a pacer's logs of the sends it has held back.
+const pacingLogInterval = 10 * time.Second
+
+// A pacer limits sends to maxRPS per second.
+type pacer struct {
+	clock   clock.Clock
+	limiter ratelimit.Limiter
+
+	// mu guards the delays that haven't been logged yet, since workers wait concurrently.
+	mu      sync.Mutex
+	delays  int
+	delayed time.Duration
+	logged  time.Time
+}
+
+func newPacer(clk clock.Clock, maxRPS int) *pacer {
+	return &pacer{
+		clock:   clk,
+		limiter: ratelimit.NewSlidingWindowLog(maxRPS, time.Second, clk),
+	}
+}
+
+// wait blocks until a send is allowed by the rate limit and returns how long it waited. The send
+// counts against the limit from when it's allowed.
+func (p *pacer) wait(ctx context.Context) (time.Duration, error) {
+	delay := p.limiter.Reserve()
+	if delay <= 0 {
+		return 0, nil
+	}
+	p.logDelay(delay)
+	return delay, p.sleep(ctx, delay)
+}
+
+// logDelay adds d to the delays that haven't been logged yet, and logs them if it's been at least
+// pacingLogInterval since they were last logged. A producer at its max rate delays most sends, so
+// logging each one would flood the output.
+func (p *pacer) logDelay(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.delays++
+	p.delayed += d
+	now := p.clock.Now()
+	if now.Sub(p.logged) < pacingLogInterval {
+		return
+	}
+	fmt.Printf("info: delayed %d sends by %v in total for rate limit\n", p.delays, p.delayed)
+	p.delays = 0
+	p.delayed = 0
+	p.logged = now
+}
+
+func (p *pacer) sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-p.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestPacer(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("does not wait below the rate limit", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		p := newPacer(clk, 3)
+		for i := 0; i < 3; i++ {
+			delay, err := p.wait(context.Background())
+			require.NoError(t, err)
+			assert.Zero(t, delay)
+			clk.Advance(100 * time.Millisecond)
+		}
+	})
+
+	t.Run("waits until the oldest send leaves the window", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		p := newPacer(clk, 3)
+		for i := 0; i < 3; i++ {
+			_, err := p.wait(context.Background())
+			require.NoError(t, err)
+			clk.Advance(100 * time.Millisecond)
+		}
+
+		done := make(chan time.Duration)
+		go func() {
+			delay, err := p.wait(context.Background())
+			assert.NoError(t, err)
+			done <- delay
+		}()
+
+		assert.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		clk.Advance(699 * time.Millisecond)
+		select {
+		case <-done:
+			t.Fatal("wait returned before the rate limit allowed a send")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		clk.Advance(time.Millisecond)
+		assert.Equal(t, 700*time.Millisecond, <-done)
+		assert.Equal(t, start.Add(time.Second), clk.Now())
+	})
+
+	t.Run("logs delays at most once per interval", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		p := newPacer(clk, 1)
+		p.logDelay(time.Second)
+		assert.Zero(t, p.delays, "the first delay is logged")
+
+		p.logDelay(time.Second)
+		clk.Advance(pacingLogInterval - time.Millisecond)
+		p.logDelay(time.Second)
+		assert.Equal(t, 2, p.delays)
+		assert.Equal(t, 2*time.Second, p.delayed)
+
+		clk.Advance(time.Millisecond)
+		p.logDelay(time.Second)
+		assert.Zero(t, p.delays)
+		assert.Equal(t, start.Add(pacingLogInterval), p.logged)
+	})
+
+	t.Run("stops waiting when cancelled", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		p := newPacer(clk, 1)
+		_, err := p.wait(context.Background())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = p.wait(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/scenario"
+)
+
+// A schedule hands out the messages ctl's rate allows to the workers producing them, so the rate
+// is shared however many workers there are.
+type schedule struct {
+	clock clock.Clock
+	ctl   *control
+	mu    sync.Mutex
+	start time.Time
+	last  time.Time
+
+	// credit is the number of messages the rate allows to be sent now. It starts at one so the
+	// first message is sent immediately, and it's capped at a second's worth of messages so a stall
+	// isn't followed by an unbounded burst.
+	credit float64
+
+	// poisson spaces messages with random gaps drawn from rng instead of evenly. next is when the
+	// next message arrives.
+	poisson bool
+	rng     *rand.Rand
+	next    time.Time
+}
+
+// newSchedule returns a schedule for ctl's rate that draws Poisson arrival gaps from rng.
+func newSchedule(clk clock.Clock, ctl *control, rng *rand.Rand) *schedule {
+	now := clk.Now()
+	return &schedule{
+		clock:   clk,
+		ctl:     ctl,
+		start:   now,
+		last:    now,
+		credit:  1,
+		poisson: ctl.scenario.Arrivals == scenario.Poisson,
+		rng:     rng,
+		next:    now,
+	}
+}
+
+// take blocks until the rate allows at least one message and returns how many, up to n, can be
+// sent now along with how far into the scenario they're sent. The rate is capped at ctl's max so
+// the pacer only has to hold sends back after a burst.
+func (s *schedule) take(ctx context.Context, n int) (int, time.Duration, error) {
+	for {
+		granted, elapsed, wait := s.tryTake(n)
+		if granted > 0 {
+			return granted, elapsed, nil
+		}
+		select {
+		case <-s.clock.After(wait):
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		}
+	}
+}
+
+// tryTake returns the messages that can be sent now or, when there aren't any, how long to wait
+// before trying again.
+func (s *schedule) tryTake(n int) (int, time.Duration, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	elapsed := now.Sub(s.start)
+	rate := min(s.ctl.Rate(elapsed), float64(s.ctl.maxRPS))
+	if s.poisson {
+		return s.tryTakePoisson(n, now, elapsed, rate)
+	}
+
+	s.credit = min(s.credit+rate*now.Sub(s.last).Seconds(), max(1, rate))
+	s.last = now
+
+	if s.credit < 1 {
+		// Wait for the next message, but check the rate at least every idleInterval so changes
+		// made through the control API or by a starting phase take effect promptly.
+		wait := idleInterval
+		if rate > 0 {
+			wait = min(wait, time.Duration((1-s.credit)/rate*float64(time.Second)))
+		}
+		return 0, 0, wait
+	}
+
+	granted := min(n, int(s.credit))
+	s.credit -= float64(granted)
+	return granted, elapsed, 0
+}
+
+// tryTakePoisson is tryTake for Poisson arrivals: every message whose arrival time has passed can
+// be sent. Like credit, arrivals more than a second overdue are dropped rather than sent in a
+// burst. It must be called with s.mu held.
+func (s *schedule) tryTakePoisson(n int, now time.Time, elapsed time.Duration, rate float64) (int, time.Duration, time.Duration) {
+	if rate <= 0 {
+		s.next = now
+		return 0, 0, idleInterval
+	}
+	s.next = latest(s.next, now.Add(-time.Second))
+
+	granted := 0
+	for granted < n && !s.next.After(now) {
+		granted++
+		s.next = s.next.Add(time.Duration(s.rng.ExpFloat64() / rate * float64(time.Second)))
+	}
+	if granted > 0 {
+		return granted, elapsed, 0
+	}
+	return 0, 0, min(idleInterval, s.next.Sub(now))
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
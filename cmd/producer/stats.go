@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/pipeline"
+)
+
+// producerStats records what the producer sends with the same labels the consumer records what it
+// handles with, so the two stats pages can be compared side by side.
+type producerStats struct {
+	metrics *metrics.Set
+}
+
+func newProducerStats(m *metrics.Set) *producerStats {
+	m.Describe("produced", "Messages sent to the broker.")
+	m.Describe("delivered", "Messages the broker acknowledged.")
+	m.Describe("delivery-failed", "Messages the broker failed to deliver.")
+	m.Describe("delivery-latency-ms", "Milliseconds from sending a message to the broker acknowledging it.")
+	m.Describe("target-rps", "Messages per second the producer is aiming for.")
+	m.Describe("delayed", "Sends held back to stay under the max rate.")
+	m.Describe("delay-ms", "Milliseconds sends were held back to stay under the max rate.")
+	return &producerStats{metrics: m}
+}
+
+// produced records a message sent for msg's customer and type.
+func (s *producerStats) produced(msg messages.Message) {
+	s.metrics.Counts.Record("produced", pipeline.Labels(msg), 1)
+}
+
+// target records the rate the producer is aiming for, after the max rate caps the scenario's.
+func (s *producerStats) target(rps float64) {
+	s.metrics.Gauges.Set("target-rps", nil, rps)
+}
+
+// delayed records the pacer holding a send back for d to stay under the max rate.
+func (s *producerStats) delayed(d time.Duration) {
+	s.metrics.Counts.Record("delayed", nil, 1)
+	s.metrics.Counts.Record("delay-ms", nil, int(d.Milliseconds()))
+}
+
+// delivered records the outcome of a delivery for the message's customer and type and, for
+// successful ones, its latency.
+func (s *producerStats) delivered(report broker.DeliveryReport) {
+	labels := pipeline.Labels(report.Envelope.Message)
+	if report.Err != nil {
+		s.metrics.Counts.Record("delivery-failed", labels, 1)
+		return
+	}
+	s.metrics.Counts.Record("delivered", labels, 1)
+	s.metrics.Histograms.Observe("delivery-latency-ms", nil, float64(report.Latency)/float64(time.Millisecond))
+}
+
+// latencyBounds are the histogram buckets for delivery latencies in milliseconds.
+var latencyBounds = []float64{0.5, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+)
+
+func newStatusServer(
+	addr string,
+	ctl *control,
+	stats *metrics.Set,
+	wwwDir string,
+) (*http.Server, error) {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /metrics", stats.Handler("producer"))
+
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		view, err := metrics.ParseView(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		accept := strings.Split(r.Header.Get("Accept"), ",")
+		if slices.Contains(accept, "application/json") {
+			serveJSON(stats.Data(view), w)
+			return
+		}
+		serveStatsHTML(wwwDir, view, stats.LabelNames(view), stats.Ranges(), stats.Panels(view), w)
+	})
+
+	mux.HandleFunc("GET /control", func(w http.ResponseWriter, r *http.Request) {
+		status := ctl.status()
+		accept := strings.Split(r.Header.Get("Accept"), ",")
+		if slices.Contains(accept, "application/json") {
+			serveJSON(status, w)
+			return
+		}
+		serveHTML(wwwDir, status, w)
+	})
+
+	mux.HandleFunc("POST /control", func(w http.ResponseWriter, r *http.Request) {
+		settings := controlSettings{}
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, fmt.Sprintf("parse settings: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := ctl.update(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveJSON(ctl.status(), w)
+	})
+
+	mux.HandleFunc("DELETE /control", func(w http.ResponseWriter, r *http.Request) {
+		ctl.reset()
+		serveJSON(ctl.status(), w)
+	})
+
+	staticDir := filepath.Join(wwwDir, "static")
+	fileServer := http.FileServer(http.Dir(staticDir))
+	mux.Handle("/static/", http.StripPrefix("/static/", fileServer))
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			fmt.Printf("error: listen and serve: %v\n", err)
+		}
+	}()
+
+	return srv, nil
+}
+
+func serveJSON(v any, w http.ResponseWriter) {
+	body, err := json.MarshalIndent(v, "", "   ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func serveHTML(wwwDir string, status controlStatus, w http.ResponseWriter) {
+	t := template.New("t")
+	t, err := t.ParseFiles(filepath.Join(wwwDir, "templates", "producer.html"))
+	if err != nil {
+		fmt.Printf("error: parse HTML template: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := t.ExecuteTemplate(w, "producer.html", status); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// serveStatsHTML renders the producer's stats with the same page as the consumer's.
+func serveStatsHTML(
+	wwwDir string,
+	view metrics.View,
+	labels []string,
+	ranges []string,
+	panels map[string]metrics.Panel,
+	w http.ResponseWriter,
+) {
+	t := template.New("t")
+	t, err := t.ParseFiles(filepath.Join(wwwDir, "templates", "page.html"))
+	if err != nil {
+		fmt.Printf("error: parse HTML template: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	page := struct {
+		Title  string
+		View   metrics.View
+		By     string
+		Range  string
+		Labels []string
+		Ranges []string
+		Panels map[string]metrics.Panel
+		Paused []struct{}
+	}{
+		Title:  "Producer Stats",
+		View:   view,
+		By:     strings.Join(view.By, ","),
+		Range:  metrics.FormatDuration(view.Range),
+		Labels: labels,
+		Ranges: ranges,
+		Panels: panels,
+	}
+	if err := t.ExecuteTemplate(w, "page.html", page); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
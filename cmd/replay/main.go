@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/config"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/pipeline"
+)
+
+type appConfig struct {
+	BootstrapServers string `config_key:"kafka.consumer.bootstrap-servers"`
+	ConsumeTopic     string `config_key:"kafka.consumer.topic"`
+	DeferTopic       string `config_key:"kafka.consumer.defer-topic"`
+
+	// ConsumerGroupID is the live consumer's group, which the replay refuses to commit to.
+	ConsumerGroupID string `config_key:"kafka.consumer.group-id"`
+
+	// ReplayGroupID is the consumer group the replay commits to. It must differ from the live
+	// consumer's group so the live consumer's offsets are untouched.
+	ReplayGroupID string `config_key:"replay.group-id"`
+
+	// ReplayStart and ReplayEnd are "earliest", "latest", an offset, or an RFC 3339 timestamp.
+	// Offsets apply to every partition. The range includes the start and excludes the end.
+	ReplayStart string `config_key:"replay.start"`
+	ReplayEnd   string `config_key:"replay.end"`
+
+	LimiterLimit  int           `config_key:"limiter.limit"`
+	LimiterWindow time.Duration `config_key:"limiter.window"`
+
+	// DeferralBackoff decides when deferred messages are retried: "refill" (the default) waits
+	// until the limiter expects capacity for the key, "exponential" waits DeferralBackoffBase
+	// doubled per deferral up to DeferralBackoffMax, and "none" retries immediately.
+	DeferralBackoff     string        `config_key:"deferral.backoff"`
+	DeferralBackoffBase time.Duration `config_key:"deferral.backoff-base"`
+	DeferralBackoffMax  time.Duration `config_key:"deferral.backoff-max"`
+
+	BrokerType           string        `config_key:"broker.type"`
+	BrokerPartitioner    string        `config_key:"broker.partitioner"`
+	FileBrokerDir        string        `config_key:"broker.file.dir"`
+	FileBrokerPartitions int           `config_key:"broker.file.partitions"`
+	FileSegmentBytes     int64         `config_key:"broker.file.segment-bytes"`
+	FileRetentionBytes   int64         `config_key:"broker.file.retention-bytes"`
+	FileRetentionAge     time.Duration `config_key:"broker.file.retention-age"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Printf("fatal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	cfg, err := config.Parse[appConfig](config.EnvMap{})
+	if err != nil {
+		return fmt.Errorf("parse app config: %v", err)
+	}
+	if cfg.DeferTopic == "" {
+		cfg.DeferTopic = cfg.ConsumeTopic + "-deferred"
+	}
+	if cfg.ReplayGroupID == "" {
+		cfg.ReplayGroupID = "replay"
+	}
+	if cfg.ReplayGroupID == cfg.ConsumerGroupID {
+		return fmt.Errorf("replay group %q must differ from the consumer's group", cfg.ReplayGroupID)
+	}
+	if cfg.ReplayStart == "" {
+		cfg.ReplayStart = "earliest"
+	}
+	if cfg.ReplayEnd == "" {
+		cfg.ReplayEnd = "latest"
+	}
+
+	start, err := pipeline.ParsePosition(cfg.ReplayStart)
+	if err != nil {
+		return fmt.Errorf("parse replay start: %v", err)
+	}
+	end, err := pipeline.ParsePosition(cfg.ReplayEnd)
+	if err != nil {
+		return fmt.Errorf("parse replay end: %v", err)
+	}
+
+	seeker, deferrals, err := buildBroker(cfg)
+	if err != nil {
+		return fmt.Errorf("build broker: %v", err)
+	}
+	defer func() {
+		if err := seeker.Close(); err != nil {
+			fmt.Printf("error: close consumer: %v\n", err)
+		}
+		if err := deferrals.Close(); err != nil {
+			fmt.Printf("error: close deferral producer: %v\n", err)
+		}
+	}()
+
+	stats := &tally{counts: map[string]int{}}
+	policy := policyFor(cfg)
+	limiter := policy.Limiter(clock.Real{})
+	backoff, err := policy.NewBackoff(limiter, clock.Real{})
+	if err != nil {
+		return fmt.Errorf("build backoff: %v", err)
+	}
+
+	handler := pipeline.NewHandler(
+		stats,
+		limiter,
+		pipeline.DependencyFunc(func(context.Context, messages.Envelope) error { return nil }),
+		deferrals,
+		cfg.DeferTopic,
+		backoff,
+		// Replay commits every message it handles, so limited messages are always deferred.
+		nil,
+		nil)
+
+	fmt.Printf("info: replaying %q from %v to %v as group %q\n", cfg.ConsumeTopic, start, end, cfg.ReplayGroupID)
+	n, err := pipeline.Replay(ctx, seeker, cfg.ConsumeTopic, start, end, handler.Handle)
+	if err != nil {
+		return fmt.Errorf("replay: %v", err)
+	}
+	if err := deferrals.Flush(ctx); err != nil {
+		return fmt.Errorf("flush deferrals: %v", err)
+	}
+
+	fmt.Printf("info: replayed %d messages\n", n)
+	stats.print()
+	return nil
+}
+
+// buildBroker creates a seeker for the replay group and a producer for deferring messages using
+// the configured broker type, which defaults to Kafka.
+func buildBroker(cfg appConfig) (broker.Seeker, broker.Producer, error) {
+	switch cfg.BrokerType {
+	case "", "kafka":
+		seeker, err := broker.NewKafkaSeeker(cfg.BootstrapServers, cfg.ReplayGroupID)
+		if err != nil {
+			return nil, nil, err
+		}
+		producer, err := broker.NewKafkaProducer(broker.KafkaProducerConfig{
+			BootstrapServers: cfg.BootstrapServers,
+			Partitioner:      cfg.BrokerPartitioner,
+		})
+		if err != nil {
+			seeker.Close()
+			return nil, nil, err
+		}
+		return seeker, producer, nil
+	case "file":
+		fb, err := broker.NewFile(broker.FileConfig{
+			Dir:            cfg.FileBrokerDir,
+			Partitions:     cfg.FileBrokerPartitions,
+			SegmentBytes:   cfg.FileSegmentBytes,
+			RetentionBytes: cfg.FileRetentionBytes,
+			RetentionAge:   cfg.FileRetentionAge,
+			Partitioner:    cfg.BrokerPartitioner,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		seeker, err := fb.Consumer(cfg.ReplayGroupID, cfg.ConsumeTopic)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The file broker allows one producer per partition, so the replay refuses to start while
+		// the consumer is deferring to the same directory rather than writing the same offsets.
+		producer := fb.Producer()
+		if err := producer.Open(cfg.DeferTopic); err != nil {
+			seeker.Close()
+			return nil, nil, fmt.Errorf("open defer topic (is the consumer still running?): %v", err)
+		}
+		return seeker, producer, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported broker type %q", cfg.BrokerType)
+	}
+}
+
+// policyFor returns the limiting and backoff policy in cfg.
+func policyFor(cfg appConfig) pipeline.Policy {
+	return pipeline.Policy{
+		Limit:       cfg.LimiterLimit,
+		Window:      cfg.LimiterWindow,
+		Backoff:     cfg.DeferralBackoff,
+		BackoffBase: cfg.DeferralBackoffBase,
+		BackoffMax:  cfg.DeferralBackoffMax,
+	}
+}
+
+// tally counts what the handler records so the replay can report it at the end.
+type tally struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (t *tally) Record(name string, labels metrics.Labels, value int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counts[metrics.SeriesKey(name, labels)] += value
+}
+
+func (t *tally) print() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := maps.Keys(t.counts)
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Printf("info: %s=%d\n", key, t.counts[key])
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/sim"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Printf("fatal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+
+	configPath := flag.String("config", "", "path to the simulation config (JSON)")
+	format := flag.String("format", "csv", "output format: csv or json")
+	outPath := flag.String("out", "", "path to write the results to (default stdout)")
+	flag.Parse()
+
+	if *configPath == "" {
+		return errors.New("-config is required")
+	}
+
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		return fmt.Errorf("read config: %v", err)
+	}
+	cfg := sim.Config{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse config: %v", err)
+	}
+
+	write := sim.WriteCSV
+	switch *format {
+	case "csv":
+	case "json":
+		write = sim.WriteJSON
+	default:
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	samples, err := sim.Run(cfg)
+	if err != nil {
+		return fmt.Errorf("simulate: %v", err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return fmt.Errorf("create output: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := write(out, samples); err != nil {
+		return fmt.Errorf("write results: %v", err)
+	}
+	return nil
+}
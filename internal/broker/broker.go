@@ -0,0 +1,189 @@
+// Package broker abstracts the message broker so the producer and consumer can run against Kafka or
+// against the in-memory implementation used by tests and demos.
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// A TopicPartition identifies a single partition of a topic.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s[%d]", tp.Topic, tp.Partition)
+}
+
+// A Consumer reads messages from one or more topics on behalf of a consumer group.
+//
+// Envelopes returned by Consume have their Raw bytes and broker metadata populated but their
+// Message is left empty; decoding is left to the caller so the broker doesn't need to know about
+// codecs.
+type Consumer interface {
+
+	// Consume blocks until a message is available or ctx is cancelled.
+	Consume(ctx context.Context) (messages.Envelope, error)
+
+	// Commit marks env, and every message before it in the same partition, as consumed for the
+	// consumer group.
+	Commit(ctx context.Context, env messages.Envelope) error
+
+	// Pause stops Consume from returning messages from the given partitions until they're resumed.
+	Pause(partitions ...TopicPartition) error
+
+	// Resume undoes Pause.
+	Resume(partitions ...TopicPartition) error
+
+	Close() error
+}
+
+// A Seeker is a [Consumer] that can be positioned at arbitrary offsets, which replaying a range of
+// a topic needs.
+type Seeker interface {
+	Consumer
+
+	// Partitions returns the partitions of topic.
+	Partitions(ctx context.Context, topic string) ([]int32, error)
+
+	// OffsetForTime returns the offset of the first message in tp whose timestamp is at or after t,
+	// or the high watermark if there isn't one.
+	OffsetForTime(ctx context.Context, tp TopicPartition, t time.Time) (int64, error)
+
+	// Watermarks returns the offset of the oldest message in tp and the offset the next message
+	// produced to tp will have.
+	Watermarks(ctx context.Context, tp TopicPartition) (low int64, high int64, err error)
+
+	// Seek makes Consume return messages from tp starting at offset.
+	Seek(tp TopicPartition, offset int64) error
+
+	// Position returns the offset Consume has read tp up to. It moves past offsets that don't hold
+	// a message, like transaction markers and compacted messages, without Consume returning
+	// anything for them. It's negative when the position isn't known yet.
+	Position(tp TopicPartition) (int64, error)
+}
+
+// An Assigned consumer can report the partitions its group has assigned it. Consumers that don't
+// implement it, like [Memory]'s and [File]'s, are assigned every partition of their topics.
+type Assigned interface {
+	Assignment() ([]TopicPartition, error)
+}
+
+// A Producer writes messages to topics.
+//
+// Produce uses the envelope's Topic, Key, Headers, Timestamp, and Raw fields; the partition is
+// chosen by the broker and the Message field isn't written, so Raw must already be encoded.
+type Producer interface {
+	Produce(ctx context.Context, env messages.Envelope) error
+
+	// Flush blocks until every produced message has been delivered or ctx is cancelled.
+	Flush(ctx context.Context) error
+
+	Close() error
+}
+
+// Partitioners the local brokers support for keyed messages. A producer configured with either
+// hashes keys to the same partitions whichever broker it runs against, and spreads unkeyed
+// messages over every partition: the local brokers assign them round-robin, and with Kafka the
+// names select librdkafka's "_random" partitioners, which assign them at random.
+const (
+	// PartitionerFNV1a hashes keys with 32-bit FNV-1a. It's the local brokers' default.
+	PartitionerFNV1a = "fnv1a"
+
+	// PartitionerMurmur2 hashes keys with murmur2, which is what the Java client's default
+	// partitioner uses.
+	PartitionerMurmur2 = "murmur2"
+)
+
+// A partitionHash hashes a message key to choose its partition.
+type partitionHash func(key []byte) uint32
+
+// lookupPartitioner returns the hash for the named partitioner. An empty name selects
+// [PartitionerFNV1a].
+func lookupPartitioner(name string) (partitionHash, error) {
+	switch name {
+	case "", PartitionerFNV1a:
+		return fnv1a, nil
+	case PartitionerMurmur2:
+		return murmur2, nil
+	default:
+		return nil, fmt.Errorf("unsupported partitioner %q", name)
+	}
+}
+
+// kafkaPartitioner returns librdkafka's partitioner setting for the named partitioner, or an empty
+// string to keep librdkafka's default. librdkafka's plain fnv1a and murmur2 partitioners would
+// send every unkeyed message to the same partition, so their _random variants are used instead.
+func kafkaPartitioner(name string) (string, error) {
+	switch name {
+	case "":
+		return "", nil
+	case PartitionerFNV1a, PartitionerMurmur2:
+		return name + "_random", nil
+	default:
+		return "", fmt.Errorf("unsupported partitioner %q", name)
+	}
+}
+
+// partitionFor chooses the partition for a message the way the local brokers do: keyed messages
+// are hashed so a key always maps to the same partition, and unkeyed messages are assigned
+// round-robin using next.
+func partitionFor(hash partitionHash, key []byte, partitions int, next *int) int32 {
+	if len(key) > 0 {
+		return int32(hash(key) % uint32(partitions))
+	}
+	p := *next
+	*next = (*next + 1) % partitions
+	return int32(p)
+}
+
+func fnv1a(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// murmur2 is the hash Kafka's Java client partitions keys with, masked to be positive as the
+// client does.
+func murmur2(key []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	h := uint32(seed) ^ uint32(len(key))
+	n := len(key) / 4 * 4
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(key[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch len(key) % 4 {
+	case 3:
+		h ^= uint32(key[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(key[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(key[n])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h & 0x7fffffff
+}
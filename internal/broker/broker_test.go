@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestPartitioners(t *testing.T) {
+
+	t.Run("murmur2 matches the Java client", func(t *testing.T) {
+		for key, want := range map[string]int32{
+			"21":                         -973932308,
+			"foobar":                     -790332482,
+			"a-little-bit-long-string":   -985981536,
+			"a-little-bit-longer-string": -1486304829,
+			"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+			"abc": 479470107,
+		} {
+			assert.Equal(t, uint32(want)&0x7fffffff, murmur2([]byte(key)), key)
+		}
+	})
+
+	t.Run("keys always map to the same partition", func(t *testing.T) {
+		for _, name := range []string{PartitionerFNV1a, PartitionerMurmur2} {
+			hash, err := lookupPartitioner(name)
+			require.NoError(t, err)
+			next := 0
+			first := partitionFor(hash, []byte("customer"), 8, &next)
+			for range 3 {
+				assert.Equal(t, first, partitionFor(hash, []byte("customer"), 8, &next), name)
+			}
+		}
+	})
+
+	t.Run("unknown partitioners are rejected", func(t *testing.T) {
+		_, err := lookupPartitioner("nope")
+		assert.Error(t, err)
+		_, err = kafkaPartitioner("nope")
+		assert.Error(t, err)
+	})
+
+	t.Run("unkeyed messages are spread over every partition", func(t *testing.T) {
+		for _, name := range []string{PartitionerFNV1a, PartitionerMurmur2} {
+			hash, err := lookupPartitioner(name)
+			require.NoError(t, err)
+			next := 0
+			seen := map[int32]bool{}
+			for range 4 {
+				seen[partitionFor(hash, nil, 4, &next)] = true
+			}
+			assert.Len(t, seen, 4, name)
+
+			// librdkafka's plain fnv1a and murmur2 send every unkeyed message to one partition.
+			partitioner, err := kafkaPartitioner(name)
+			require.NoError(t, err)
+			assert.Equal(t, name+"_random", partitioner)
+		}
+	})
+}
+
+func TestReportDeliveries(t *testing.T) {
+	reports := []DeliveryReport{}
+	producer := ReportDeliveries(NewMemory(1).Producer(), func(report DeliveryReport) {
+		reports = append(reports, report)
+	})
+	require.NoError(t, producer.Produce(context.Background(), messages.Envelope{Topic: "t", Raw: []byte("a")}))
+	require.Len(t, reports, 1)
+	assert.NoError(t, reports[0].Err)
+	assert.Equal(t, "a", string(reports[0].Envelope.Raw))
+}
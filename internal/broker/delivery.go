@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// A DeliveryReport is the outcome of producing a message.
+type DeliveryReport struct {
+	// Envelope is the message as it was delivered, with its partition and offset populated when
+	// delivery succeeded. Its Message is the one passed to Produce, so reports can be told apart
+	// without decoding Raw.
+	Envelope messages.Envelope
+
+	// Latency is how long the message took to be acknowledged after it was produced.
+	Latency time.Duration
+
+	// Err is why the message couldn't be delivered, or nil.
+	Err error
+}
+
+// syncReporter reports deliveries for a producer whose Produce returns once the message is
+// delivered.
+type syncReporter struct {
+	Producer
+	onDelivery func(DeliveryReport)
+}
+
+// ReportDeliveries wraps a producer whose Produce is synchronous, like [Memory]'s and [File]'s, so
+// onDelivery is called with the outcome of every message it produces. [KafkaProducer] delivers
+// asynchronously and reports deliveries through [KafkaProducerConfig.OnDelivery] instead.
+func ReportDeliveries(producer Producer, onDelivery func(DeliveryReport)) Producer {
+	return &syncReporter{Producer: producer, onDelivery: onDelivery}
+}
+
+func (r *syncReporter) Produce(ctx context.Context, env messages.Envelope) error {
+	start := time.Now()
+	err := r.Producer.Produce(ctx, env)
+	r.onDelivery(DeliveryReport{
+		Envelope: env,
+		Latency:  time.Since(start),
+		Err:      err,
+	})
+	return err
+}
@@ -0,0 +1,821 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// ErrLocked is returned when a [FileProducer] opens a partition that another producer, in this
+// process or another, is writing to. Each producer numbers the records it writes itself, so two
+// writers would give different records the same offsets.
+var ErrLocked = errors.New("partition is locked by another producer")
+
+// lockName is the file in each partition's directory that a producer holds a lock on while it
+// writes to the partition.
+const lockName = "producer.lock"
+
+// FileConfig configures a [File] broker.
+type FileConfig struct {
+	// Dir is the directory the broker stores its topics and committed offsets in.
+	Dir string
+
+	// Partitions is the number of partitions new topics are created with. Existing topics keep the
+	// number of partitions they were created with.
+	Partitions int
+
+	// SegmentBytes is the size at which a partition's active segment file is rolled.
+	SegmentBytes int64
+
+	// RetentionBytes is the maximum size of a partition's inactive segments. Zero means no limit.
+	RetentionBytes int64
+
+	// RetentionAge is how long an inactive segment is kept after it was last written. Zero means no
+	// limit.
+	RetentionAge time.Duration
+
+	// Partitioner names the hash keyed messages are partitioned with: [PartitionerFNV1a], the
+	// default, or [PartitionerMurmur2].
+	Partitioner string
+}
+
+const defaultSegmentBytes = 16 * 1024 * 1024
+
+// File is a durable broker that stores each partition as a directory of append-only segment files
+// so the producer and consumer can run as separate local processes without Kafka. The layout is:
+//
+//	<dir>/topics/<topic>/partitions                    number of partitions
+//	<dir>/topics/<topic>/<partition>/<base offset>.log segment files, one JSON record per line
+//	<dir>/topics/<topic>/<partition>/producer.lock     held by the partition's producer
+//	<dir>/groups/<group>/<topic>/<partition>.offset    committed offset
+//
+// Each partition supports a single producer at a time, which holds a lock on the partition's
+// producer.lock while it's open; other producers get [ErrLocked]. Consumers poll segment files for
+// new records, so any number of consumer processes can read while a producer is writing. As with
+// [Memory], every consumer in a group is assigned every partition.
+type File struct {
+	cfg  FileConfig
+	hash partitionHash
+}
+
+type fileRecord struct {
+	Offset    int64        `json:"offset"`
+	Timestamp time.Time    `json:"timestamp"`
+	Key       []byte       `json:"key,omitempty"`
+	Headers   []fileHeader `json:"headers,omitempty"`
+	Value     []byte       `json:"value"`
+}
+
+type fileHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// NewFile creates a broker rooted at cfg.Dir, creating the directory if it doesn't exist.
+func NewFile(cfg FileConfig) (*File, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("file broker directory is required")
+	}
+	if cfg.Partitions < 1 {
+		cfg.Partitions = 1
+	}
+	if cfg.SegmentBytes <= 0 {
+		cfg.SegmentBytes = defaultSegmentBytes
+	}
+	hash, err := lookupPartitioner(cfg.Partitioner)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create broker directory: %w", err)
+	}
+	return &File{cfg: cfg, hash: hash}, nil
+}
+
+// Producer returns a producer that appends to the broker's topics.
+func (f *File) Producer() *FileProducer {
+	return &FileProducer{
+		f:      f,
+		topics: map[string]*fileTopicWriter{},
+	}
+}
+
+// Consumer returns a consumer for the given topics that starts at the group's committed offsets,
+// or at the beginning of each partition when the group hasn't committed.
+func (f *File) Consumer(group string, topics ...string) (*FileConsumer, error) {
+	c := &FileConsumer{
+		f:       f,
+		group:   group,
+		readers: map[TopicPartition]*filePartitionReader{},
+		paused:  map[TopicPartition]bool{},
+	}
+	for _, topic := range topics {
+		partitions, err := f.partitionCount(topic)
+		if err != nil {
+			return nil, err
+		}
+		for p := 0; p < partitions; p++ {
+			tp := TopicPartition{Topic: topic, Partition: int32(p)}
+			position, err := f.committed(group, tp)
+			if err != nil {
+				return nil, err
+			}
+			c.order = append(c.order, tp)
+			c.readers[tp] = &filePartitionReader{
+				dir:      f.partitionDir(tp),
+				position: position,
+			}
+		}
+	}
+	return c, nil
+}
+
+func (f *File) topicDir(topic string) string {
+	return filepath.Join(f.cfg.Dir, "topics", topic)
+}
+
+func (f *File) partitionDir(tp TopicPartition) string {
+	return filepath.Join(f.topicDir(tp.Topic), strconv.Itoa(int(tp.Partition)))
+}
+
+func (f *File) offsetPath(group string, tp TopicPartition) string {
+	return filepath.Join(f.cfg.Dir, "groups", group, tp.Topic, fmt.Sprintf("%d.offset", tp.Partition))
+}
+
+// partitionCount returns the number of partitions topic has, creating the topic if it doesn't
+// exist. The partition count file is linked into place so that concurrent creators agree on a
+// single value.
+func (f *File) partitionCount(topic string) (int, error) {
+	dir := f.topicDir(topic)
+	countPath := filepath.Join(dir, "partitions")
+
+	if data, err := os.ReadFile(countPath); err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("read partition count for %q: %w", topic, err)
+	}
+
+	for p := 0; p < f.cfg.Partitions; p++ {
+		if err := os.MkdirAll(filepath.Join(dir, strconv.Itoa(p)), 0o755); err != nil {
+			return 0, fmt.Errorf("create topic %q: %w", topic, err)
+		}
+	}
+	tmp, err := os.CreateTemp(dir, "partitions-*")
+	if err != nil {
+		return 0, fmt.Errorf("create topic %q: %w", topic, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strconv.Itoa(f.cfg.Partitions))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("create topic %q: %w", topic, err)
+	}
+	if err := os.Link(tmp.Name(), countPath); err != nil && !errors.Is(err, os.ErrExist) {
+		return 0, fmt.Errorf("create topic %q: %w", topic, err)
+	}
+
+	data, err := os.ReadFile(countPath)
+	if err != nil {
+		return 0, fmt.Errorf("read partition count for %q: %w", topic, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (f *File) committed(group string, tp TopicPartition) (int64, error) {
+	data, err := os.ReadFile(f.offsetPath(group, tp))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read committed offset for %v: %w", tp, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (f *File) commit(group string, tp TopicPartition, offset int64) error {
+	path := f.offsetPath(group, tp)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// enforceRetention deletes a partition's oldest inactive segments while they exceed the retention
+// size or are older than the retention age. The newest segment is never deleted.
+func (f *File) enforceRetention(dir string) error {
+	if f.cfg.RetentionBytes <= 0 && f.cfg.RetentionAge <= 0 {
+		return nil
+	}
+	bases, err := segments(dir)
+	if err != nil || len(bases) < 2 {
+		return err
+	}
+	inactive := bases[:len(bases)-1]
+
+	infos := make([]os.FileInfo, 0, len(inactive))
+	total := int64(0)
+	for _, base := range inactive {
+		info, err := os.Stat(segmentPath(dir, base))
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+
+	cutoff := time.Now().Add(-f.cfg.RetentionAge)
+	for i, base := range inactive {
+		tooBig := f.cfg.RetentionBytes > 0 && total > f.cfg.RetentionBytes
+		tooOld := f.cfg.RetentionAge > 0 && infos[i].ModTime().Before(cutoff)
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(segmentPath(dir, base)); err != nil {
+			return err
+		}
+		total -= infos[i].Size()
+	}
+	return nil
+}
+
+// segments returns the base offsets of a partition's segment files in ascending order.
+func segments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bases := []int64{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		base, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	slices.Sort(bases)
+	return bases, nil
+}
+
+func segmentPath(dir string, base int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d.log", base))
+}
+
+// FileProducer is a [Producer] for a [File] broker. Records are written to the segment file as
+// they're produced so consumers in other processes see them immediately; Flush syncs them to disk.
+type FileProducer struct {
+	f      *File
+	mu     sync.Mutex
+	topics map[string]*fileTopicWriter
+}
+
+type fileTopicWriter struct {
+	partitions []*filePartitionWriter
+	next       int
+}
+
+type filePartitionWriter struct {
+	dir     string
+	lock    *os.File
+	segment *os.File
+	size    int64
+	next    int64
+}
+
+func (p *FileProducer) Produce(_ context.Context, env messages.Envelope) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tw, err := p.topic(env.Topic)
+	if err != nil {
+		return err
+	}
+	partition := partitionFor(p.f.hash, env.Key, len(tw.partitions), &tw.next)
+	pw := tw.partitions[partition]
+
+	if env.Timestamp.IsZero() {
+		env.Timestamp = time.Now()
+	}
+	rec := fileRecord{
+		Offset:    pw.next,
+		Timestamp: env.Timestamp,
+		Key:       env.Key,
+		Value:     env.Raw,
+	}
+	for _, h := range env.Headers {
+		rec.Headers = append(rec.Headers, fileHeader{Key: h.Key, Value: h.Value})
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+	line = append(line, '\n')
+
+	if pw.size > 0 && pw.size+int64(len(line)) > p.f.cfg.SegmentBytes {
+		if err := p.roll(pw); err != nil {
+			return fmt.Errorf("roll segment: %w", err)
+		}
+	}
+
+	// Write the record with a single call so readers never see a record interleaved with another.
+	n, err := pw.segment.Write(line)
+	pw.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	pw.next++
+	return nil
+}
+
+func (p *FileProducer) Flush(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, tw := range p.topics {
+		for _, pw := range tw.partitions {
+			if err := pw.segment.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *FileProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	errs := []error{}
+	for _, tw := range p.topics {
+		for _, pw := range tw.partitions {
+			errs = append(errs, pw.segment.Sync(), pw.segment.Close(), pw.lock.Close())
+		}
+	}
+	p.topics = map[string]*fileTopicWriter{}
+	return errors.Join(errs...)
+}
+
+// Open opens the topics' partitions for writing now rather than when the first record is produced
+// to them, so a partition that another producer is writing to is reported with [ErrLocked] up
+// front.
+func (p *FileProducer) Open(topics ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, topic := range topics {
+		if _, err := p.topic(topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FileProducer) topic(name string) (*fileTopicWriter, error) {
+	if tw, ok := p.topics[name]; ok {
+		return tw, nil
+	}
+	partitions, err := p.f.partitionCount(name)
+	if err != nil {
+		return nil, err
+	}
+	tw := &fileTopicWriter{}
+	for i := 0; i < partitions; i++ {
+		pw, err := p.openPartition(p.f.partitionDir(TopicPartition{Topic: name, Partition: int32(i)}))
+		if err != nil {
+			// Release the partitions that were opened so another producer can write to them.
+			for _, pw := range tw.partitions {
+				pw.segment.Close()
+				pw.lock.Close()
+			}
+			return nil, fmt.Errorf("open partition %d of %q: %w", i, name, err)
+		}
+		tw.partitions = append(tw.partitions, pw)
+	}
+	p.topics[name] = tw
+	return tw, nil
+}
+
+// openPartition locks a partition so no other producer writes to it and opens its newest segment
+// for appending.
+func (p *FileProducer) openPartition(dir string) (*filePartitionWriter, error) {
+	lock, err := lockFile(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+	pw, err := p.openSegment(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	pw.lock = lock
+	return pw, nil
+}
+
+// openSegment opens a partition's newest segment for appending. A trailing partial record left by
+// a crash is truncated so the next record starts on its own line.
+func (p *FileProducer) openSegment(dir string) (*filePartitionWriter, error) {
+	bases, err := segments(dir)
+	if err != nil {
+		return nil, err
+	}
+	base := int64(0)
+	if len(bases) > 0 {
+		base = bases[len(bases)-1]
+	}
+
+	segment, err := os.OpenFile(segmentPath(dir, base), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(segment)
+	if err != nil {
+		segment.Close()
+		return nil, err
+	}
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	if complete < len(data) {
+		if err := segment.Truncate(int64(complete)); err != nil {
+			segment.Close()
+			return nil, err
+		}
+	}
+
+	pw := &filePartitionWriter{
+		dir:     dir,
+		segment: segment,
+		size:    int64(complete),
+		next:    base,
+	}
+	if complete > 0 {
+		lines := bytes.Split(data[:complete-1], []byte{'\n'})
+		rec := fileRecord{}
+		if err := json.Unmarshal(lines[len(lines)-1], &rec); err != nil {
+			segment.Close()
+			return nil, fmt.Errorf("read last record: %w", err)
+		}
+		pw.next = rec.Offset + 1
+	}
+
+	if err := p.f.enforceRetention(dir); err != nil {
+		fmt.Printf("error: enforce retention in %s: %v\n", dir, err)
+	}
+	return pw, nil
+}
+
+func (p *FileProducer) roll(pw *filePartitionWriter) error {
+	if err := pw.segment.Sync(); err != nil {
+		return err
+	}
+	if err := pw.segment.Close(); err != nil {
+		return err
+	}
+	segment, err := os.OpenFile(segmentPath(pw.dir, pw.next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	pw.segment = segment
+	pw.size = 0
+	if err := p.f.enforceRetention(pw.dir); err != nil {
+		fmt.Printf("error: enforce retention in %s: %v\n", pw.dir, err)
+	}
+	return nil
+}
+
+// FileConsumer is a [Consumer] for a [File] broker.
+type FileConsumer struct {
+	f       *File
+	group   string
+	mu      sync.Mutex
+	order   []TopicPartition
+	readers map[TopicPartition]*filePartitionReader
+	paused  map[TopicPartition]bool
+	// next rotates the partition we check first so one busy partition can't starve the others.
+	next   int
+	closed bool
+}
+
+type filePartitionReader struct {
+	dir      string
+	position int64
+	base     int64
+	segment  *os.File
+	reader   *bufio.Reader
+	// offset is where in the segment the next record starts.
+	offset int64
+}
+
+// filePollInterval is how long Consume waits before checking segment files for new records again.
+const filePollInterval = 50 * time.Millisecond
+
+func (c *FileConsumer) Consume(ctx context.Context) (messages.Envelope, error) {
+	for {
+		env, ok, err := c.tryConsume()
+		if err != nil || ok {
+			return env, err
+		}
+		select {
+		case <-time.After(filePollInterval):
+		case <-ctx.Done():
+			return messages.Envelope{}, ctx.Err()
+		}
+	}
+}
+
+func (c *FileConsumer) tryConsume() (messages.Envelope, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return messages.Envelope{}, false, ErrClosed
+	}
+
+	for i := range c.order {
+		tp := c.order[(c.next+i)%len(c.order)]
+		if c.paused[tp] {
+			continue
+		}
+		rec, ok, err := c.readers[tp].read()
+		if err != nil {
+			return messages.Envelope{}, false, fmt.Errorf("read %v: %w", tp, err)
+		}
+		if !ok {
+			continue
+		}
+		c.next = (c.next + i + 1) % len(c.order)
+
+		env := messages.Envelope{
+			Key:       rec.Key,
+			Topic:     tp.Topic,
+			Partition: tp.Partition,
+			Offset:    rec.Offset,
+			Timestamp: rec.Timestamp,
+			Raw:       rec.Value,
+		}
+		for _, h := range rec.Headers {
+			env.Headers = append(env.Headers, messages.Header{Key: h.Key, Value: h.Value})
+		}
+		return env, true, nil
+	}
+	return messages.Envelope{}, false, nil
+}
+
+// read returns the record at the reader's position if it has been written.
+func (r *filePartitionReader) read() (fileRecord, bool, error) {
+	retried := false
+	for {
+		if r.segment == nil {
+			ok, err := r.open()
+			if err != nil || !ok {
+				return fileRecord{}, false, err
+			}
+		}
+
+		line, err := r.reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Rewind to the start of a record that's still being written so it's read whole once
+			// it's complete. Keeping the bytes already read could join them to a different record,
+			// since a producer that restarts truncates a record it didn't finish and writes another.
+			if err := r.rewind(); err != nil {
+				return fileRecord{}, false, err
+			}
+			// A newer segment means this one will never be appended to again, so move on to it.
+			bases, err := segments(r.dir)
+			if err != nil {
+				return fileRecord{}, false, err
+			}
+			if len(bases) == 0 || bases[len(bases)-1] <= r.base {
+				return fileRecord{}, false, nil
+			}
+			if len(line) > 0 {
+				// Producers finish a record before starting a newer segment, so the rest of it is
+				// there to read now unless the segment was cut short.
+				if !retried {
+					retried = true
+					continue
+				}
+				fmt.Printf("warn: skipping incomplete record at the end of %s\n", segmentPath(r.dir, r.base))
+				r.position = max(r.position, bases[slices.Index(bases, r.base)+1])
+			}
+			r.close()
+			continue
+		}
+		if err != nil {
+			return fileRecord{}, false, err
+		}
+		r.offset += int64(len(line))
+
+		rec := fileRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fileRecord{}, false, fmt.Errorf("unmarshal record: %w", err)
+		}
+		if rec.Offset < r.position {
+			continue
+		}
+		r.position = rec.Offset + 1
+		return rec, true, nil
+	}
+}
+
+// open opens the segment containing the reader's position. If retention has already deleted it
+// the reader skips ahead to the oldest remaining segment.
+func (r *filePartitionReader) open() (bool, error) {
+	bases, err := segments(r.dir)
+	if err != nil || len(bases) == 0 {
+		return false, err
+	}
+	base := bases[0]
+	for _, b := range bases {
+		if b <= r.position {
+			base = b
+		}
+	}
+	segment, err := os.Open(segmentPath(r.dir, base))
+	if errors.Is(err, os.ErrNotExist) {
+		// Retention deleted the segment between listing and opening it; try again next time.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.base = base
+	r.segment = segment
+	r.reader = bufio.NewReader(segment)
+	r.offset = 0
+	return true, nil
+}
+
+// rewind moves the reader back to the start of the first record it hasn't read all of.
+func (r *filePartitionReader) rewind() error {
+	if _, err := r.segment.Seek(r.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek segment: %w", err)
+	}
+	r.reader.Reset(r.segment)
+	return nil
+}
+
+func (r *filePartitionReader) close() {
+	if r.segment != nil {
+		r.segment.Close()
+	}
+	r.segment = nil
+	r.reader = nil
+	r.offset = 0
+}
+
+func (c *FileConsumer) Commit(_ context.Context, env messages.Envelope) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	tp := TopicPartition{Topic: env.Topic, Partition: env.Partition}
+	if err := c.f.commit(c.group, tp, env.Offset+1); err != nil {
+		return fmt.Errorf("commit %v: %w", tp, err)
+	}
+	return nil
+}
+
+func (c *FileConsumer) Pause(partitions ...TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tp := range partitions {
+		c.paused[tp] = true
+	}
+	return nil
+}
+
+func (c *FileConsumer) Resume(partitions ...TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tp := range partitions {
+		delete(c.paused, tp)
+	}
+	return nil
+}
+
+func (c *FileConsumer) Partitions(_ context.Context, topic string) ([]int32, error) {
+	n, err := c.f.partitionCount(topic)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]int32, 0, n)
+	for p := 0; p < n; p++ {
+		partitions = append(partitions, int32(p))
+	}
+	return partitions, nil
+}
+
+func (c *FileConsumer) OffsetForTime(_ context.Context, tp TopicPartition, t time.Time) (int64, error) {
+	offset := int64(-1)
+	high, err := scanPartition(c.f.partitionDir(tp), func(rec fileRecord) bool {
+		if !rec.Timestamp.Before(t) {
+			offset = rec.Offset
+			return false
+		}
+		return true
+	})
+	if err != nil || offset >= 0 {
+		return offset, err
+	}
+	return high, nil
+}
+
+func (c *FileConsumer) Watermarks(_ context.Context, tp TopicPartition) (int64, int64, error) {
+	low := int64(-1)
+	high, err := scanPartition(c.f.partitionDir(tp), func(rec fileRecord) bool {
+		if low < 0 {
+			low = rec.Offset
+		}
+		return true
+	})
+	if low < 0 {
+		low = high
+	}
+	return low, high, err
+}
+
+func (c *FileConsumer) Seek(tp TopicPartition, offset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.readers[tp]
+	if !ok {
+		return fmt.Errorf("%v is not assigned to this consumer", tp)
+	}
+	r.close()
+	r.position = offset
+	return nil
+}
+
+func (c *FileConsumer) Position(tp TopicPartition) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.readers[tp]
+	if !ok {
+		return 0, fmt.Errorf("%v is not assigned to this consumer", tp)
+	}
+	return r.position, nil
+}
+
+// scanPartition calls fn with each complete record in the partition, in order, until fn returns
+// false. It returns the offset after the last record it read, which is the partition's high
+// watermark when fn never returns false.
+func scanPartition(dir string, fn func(fileRecord) bool) (int64, error) {
+	bases, err := segments(dir)
+	if err != nil {
+		return 0, err
+	}
+	next := int64(0)
+	for _, base := range bases {
+		next = max(next, base)
+		data, err := os.ReadFile(segmentPath(dir, base))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, line := range bytes.SplitAfter(data, []byte{'\n'}) {
+			if len(line) == 0 || line[len(line)-1] != '\n' {
+				break
+			}
+			rec := fileRecord{}
+			if err := json.Unmarshal(line, &rec); err != nil {
+				return 0, fmt.Errorf("unmarshal record: %w", err)
+			}
+			next = rec.Offset + 1
+			if !fn(rec) {
+				return next, nil
+			}
+		}
+	}
+	return next, nil
+}
+
+func (c *FileConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, r := range c.readers {
+		r.close()
+	}
+	return nil
+}
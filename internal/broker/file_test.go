@@ -0,0 +1,267 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestFile(t *testing.T) {
+
+	newFile := func(t *testing.T, cfg FileConfig) *File {
+		f, err := NewFile(cfg)
+		require.NoError(t, err)
+		return f
+	}
+
+	produce := func(t *testing.T, p Producer, topic string, values ...string) {
+		for _, value := range values {
+			require.NoError(t, p.Produce(context.Background(), messages.Envelope{
+				Topic:   topic,
+				Key:     []byte("key"),
+				Headers: []messages.Header{{Key: "h", Value: []byte(value)}},
+				Raw:     []byte(value),
+			}))
+		}
+	}
+
+	consume := func(t *testing.T, c Consumer, n int) []messages.Envelope {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		envs := []messages.Envelope{}
+		for i := 0; i < n; i++ {
+			env, err := c.Consume(ctx)
+			require.NoError(t, err)
+			envs = append(envs, env)
+		}
+		return envs
+	}
+
+	values := func(envs []messages.Envelope) []string {
+		vs := make([]string, 0, len(envs))
+		for _, env := range envs {
+			vs = append(vs, string(env.Raw))
+		}
+		return vs
+	}
+
+	t.Run("consumer in another process reads records as they're produced", func(t *testing.T) {
+		dir := t.TempDir()
+		p := newFile(t, FileConfig{Dir: dir, Partitions: 2}).Producer()
+		defer p.Close()
+		c, err := newFile(t, FileConfig{Dir: dir, Partitions: 2}).Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+
+		produce(t, p, "t", "a", "b")
+		envs := consume(t, c, 2)
+		assert.Equal(t, []string{"a", "b"}, values(envs))
+		assert.Equal(t, int64(1), envs[1].Offset)
+		header, _ := envs[1].Header("h")
+		assert.Equal(t, []byte("b"), header)
+
+		produce(t, p, "t", "c")
+		assert.Equal(t, []string{"c"}, values(consume(t, c, 1)))
+	})
+
+	t.Run("committed offsets survive restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir})
+		p := f.Producer()
+		produce(t, p, "t", "a", "b", "c")
+		require.NoError(t, p.Close())
+
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		envs := consume(t, c, 2)
+		require.NoError(t, c.Commit(context.Background(), envs[0]))
+		require.NoError(t, c.Close())
+
+		c, err = newFile(t, FileConfig{Dir: dir}).Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, []string{"b", "c"}, values(consume(t, c, 2)))
+	})
+
+	t.Run("reopened producer continues offsets after a partial write", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir})
+		p := f.Producer()
+		produce(t, p, "t", "a")
+		require.NoError(t, p.Close())
+
+		segment := segmentPath(f.partitionDir(TopicPartition{Topic: "t"}), 0)
+		file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = file.WriteString(`{"offset":1,"val`)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		p = f.Producer()
+		produce(t, p, "t", "b")
+		require.NoError(t, p.Close())
+
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		envs := consume(t, c, 2)
+		assert.Equal(t, []string{"a", "b"}, values(envs))
+		assert.Equal(t, int64(1), envs[1].Offset)
+	})
+
+	t.Run("consumer that read a partial write reads the record that replaces it", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir})
+		p := f.Producer()
+		produce(t, p, "t", "a")
+		require.NoError(t, p.Close())
+
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, []string{"a"}, values(consume(t, c, 1)))
+
+		segment := segmentPath(f.partitionDir(TopicPartition{Topic: "t"}), 0)
+		file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = file.WriteString(`{"offset":1,"value":"`)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*filePollInterval)
+		defer cancel()
+		_, err = c.Consume(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		p = f.Producer()
+		produce(t, p, "t", "b")
+		require.NoError(t, p.Close())
+		assert.Equal(t, []string{"b"}, values(consume(t, c, 1)))
+	})
+
+	t.Run("skips an incomplete record at the end of an older segment", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir, SegmentBytes: 1})
+		p := f.Producer()
+		produce(t, p, "t", "a", "b", "c")
+		require.NoError(t, p.Close())
+
+		pdir := f.partitionDir(TopicPartition{Topic: "t"})
+		require.NoError(t, os.WriteFile(segmentPath(pdir, 1), []byte(`{"offset":1,"val`), 0o644))
+
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		assert.Equal(t, []string{"a", "c"}, values(consume(t, c, 2)))
+	})
+
+	t.Run("rolls segments and enforces size retention", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir, SegmentBytes: 1, RetentionBytes: 1})
+		p := f.Producer()
+		defer p.Close()
+		for i := 0; i < 5; i++ {
+			produce(t, p, "t", fmt.Sprint(i))
+		}
+
+		pdir := f.partitionDir(TopicPartition{Topic: "t"})
+		bases, err := segments(pdir)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{4}, bases)
+
+		// A consumer whose position was deleted skips ahead to the oldest remaining record.
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		envs := consume(t, c, 1)
+		assert.Equal(t, []string{"4"}, values(envs))
+	})
+
+	t.Run("enforces age retention", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir, SegmentBytes: 1, RetentionAge: time.Hour})
+		p := f.Producer()
+		defer p.Close()
+		produce(t, p, "t", "a", "b")
+
+		pdir := f.partitionDir(TopicPartition{Topic: "t"})
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(segmentPath(pdir, 0), old, old))
+		produce(t, p, "t", "c")
+
+		bases, err := segments(pdir)
+		require.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, bases)
+	})
+
+	t.Run("existing topics keep their partition count", func(t *testing.T) {
+		dir := t.TempDir()
+		p := newFile(t, FileConfig{Dir: dir, Partitions: 3}).Producer()
+		produce(t, p, "t", "a")
+		require.NoError(t, p.Close())
+
+		n, err := newFile(t, FileConfig{Dir: dir, Partitions: 1}).partitionCount("t")
+		require.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.DirExists(t, filepath.Join(dir, "topics", "t", "2"))
+	})
+
+	t.Run("only one producer writes to a partition at a time", func(t *testing.T) {
+		dir := t.TempDir()
+		first := newFile(t, FileConfig{Dir: dir, Partitions: 2}).Producer()
+		require.NoError(t, first.Open("t"))
+
+		second := newFile(t, FileConfig{Dir: dir, Partitions: 2}).Producer()
+		require.ErrorIs(t, second.Open("t"), ErrLocked)
+		err := second.Produce(context.Background(), messages.Envelope{Topic: "t", Raw: []byte("a")})
+		require.ErrorIs(t, err, ErrLocked)
+
+		require.NoError(t, first.Close())
+		require.NoError(t, second.Open("t"))
+		produce(t, second, "t", "a")
+		require.NoError(t, second.Close())
+	})
+	t.Run("seeks by offset and time", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newFile(t, FileConfig{Dir: dir, SegmentBytes: 1})
+		p := f.Producer()
+		defer p.Close()
+		start := time.Unix(1000, 0)
+		for i, value := range []string{"a", "b", "c"} {
+			require.NoError(t, p.Produce(context.Background(), messages.Envelope{
+				Topic:     "t",
+				Timestamp: start.Add(time.Duration(i) * time.Second),
+				Raw:       []byte(value),
+			}))
+		}
+
+		c, err := f.Consumer("g", "t")
+		require.NoError(t, err)
+		defer c.Close()
+		tp := TopicPartition{Topic: "t"}
+
+		low, high, err := c.Watermarks(context.Background(), tp)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), low)
+		assert.Equal(t, int64(3), high)
+
+		offset, err := c.OffsetForTime(context.Background(), tp, start.Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), offset)
+		offset, err = c.OffsetForTime(context.Background(), tp, start.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), offset)
+
+		assert.Equal(t, []string{"a"}, values(consume(t, c, 1)))
+		require.NoError(t, c.Seek(tp, 2))
+		assert.Equal(t, []string{"c"}, values(consume(t, c, 1)))
+	})
+}
@@ -0,0 +1,359 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// KafkaConsumer is a [Consumer] backed by a Kafka consumer group.
+type KafkaConsumer struct {
+	kc *kafka.Consumer
+}
+
+// NewKafkaConsumer creates a Kafka consumer in the given group and subscribes it to topics.
+// Offsets are only committed explicitly via [KafkaConsumer.Commit].
+func NewKafkaConsumer(bootstrapServers string, groupID string, topics ...string) (*KafkaConsumer, error) {
+
+	kc, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  bootstrapServers,
+		"group.id":           groupID,
+		"auto.offset.reset":  "latest",
+		"enable.auto.commit": "false",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create Kafka consumer: %w", err)
+	}
+
+	err = kc.SubscribeTopics(topics, func(c *kafka.Consumer, e kafka.Event) error {
+		fmt.Printf("rebalance: %v\n", e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("subscribe: %w", err)
+	}
+
+	return &KafkaConsumer{
+		kc: kc,
+	}, nil
+}
+
+// NewKafkaSeeker creates a Kafka consumer in the given group that isn't subscribed to anything;
+// partitions are assigned as they're passed to [KafkaConsumer.Seek].
+func NewKafkaSeeker(bootstrapServers string, groupID string) (*KafkaConsumer, error) {
+	kc, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  bootstrapServers,
+		"group.id":           groupID,
+		"enable.auto.commit": "false",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create Kafka consumer: %w", err)
+	}
+	return &KafkaConsumer{
+		kc: kc,
+	}, nil
+}
+
+func (kc *KafkaConsumer) Close() error {
+	return kc.kc.Close()
+}
+
+func (kc *KafkaConsumer) Consume(ctx context.Context) (messages.Envelope, error) {
+	for !isCancelled(ctx) {
+		event := kc.kc.Poll(50)
+		switch event := event.(type) {
+		case *kafka.Message:
+			return newEnvelope(event), nil
+		case kafka.PartitionEOF:
+			<-time.After(time.Second)
+		case kafka.Error:
+			fmt.Printf("error: consume: %v\n", event.Error())
+		}
+	}
+
+	return messages.Envelope{}, ctx.Err()
+}
+
+func (kc *KafkaConsumer) Commit(_ context.Context, env messages.Envelope) error {
+	_, err := kc.kc.CommitOffsets([]kafka.TopicPartition{{
+		Topic:     &env.Topic,
+		Partition: env.Partition,
+		Offset:    kafka.Offset(env.Offset + 1),
+	}})
+	return err
+}
+
+func (kc *KafkaConsumer) Pause(partitions ...TopicPartition) error {
+	return kc.kc.Pause(kafkaPartitions(partitions))
+}
+
+func (kc *KafkaConsumer) Resume(partitions ...TopicPartition) error {
+	return kc.kc.Resume(kafkaPartitions(partitions))
+}
+
+// Assignment returns the partitions the group currently assigns this consumer.
+func (kc *KafkaConsumer) Assignment() ([]TopicPartition, error) {
+	assigned, err := kc.kc.Assignment()
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]TopicPartition, 0, len(assigned))
+	for _, tp := range assigned {
+		if tp.Topic != nil {
+			partitions = append(partitions, TopicPartition{Topic: *tp.Topic, Partition: tp.Partition})
+		}
+	}
+	return partitions, nil
+}
+
+// kafkaTimeoutMs bounds metadata and offset queries when the context has no deadline.
+const kafkaTimeoutMs = 10000
+
+func (kc *KafkaConsumer) Partitions(ctx context.Context, topic string) ([]int32, error) {
+	md, err := kc.kc.GetMetadata(&topic, false, timeoutMs(ctx))
+	if err != nil {
+		return nil, err
+	}
+	tm, ok := md.Topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %q not found", topic)
+	}
+	if tm.Error.Code() != kafka.ErrNoError {
+		return nil, tm.Error
+	}
+	partitions := make([]int32, 0, len(tm.Partitions))
+	for _, p := range tm.Partitions {
+		partitions = append(partitions, p.ID)
+	}
+	return partitions, nil
+}
+
+func (kc *KafkaConsumer) OffsetForTime(ctx context.Context, tp TopicPartition, t time.Time) (int64, error) {
+	offsets, err := kc.kc.OffsetsForTimes([]kafka.TopicPartition{{
+		Topic:     &tp.Topic,
+		Partition: tp.Partition,
+		Offset:    kafka.Offset(t.UnixMilli()),
+	}}, timeoutMs(ctx))
+	if err != nil {
+		return 0, err
+	}
+	if len(offsets) != 1 {
+		return 0, fmt.Errorf("no offset returned for %v", tp)
+	}
+	if offsets[0].Error != nil {
+		return 0, offsets[0].Error
+	}
+	// Kafka returns the logical end offset when every message is older than t.
+	if offsets[0].Offset == kafka.OffsetEnd {
+		_, high, err := kc.Watermarks(ctx, tp)
+		return high, err
+	}
+	return int64(offsets[0].Offset), nil
+}
+
+func (kc *KafkaConsumer) Watermarks(ctx context.Context, tp TopicPartition) (int64, int64, error) {
+	return kc.kc.QueryWatermarkOffsets(tp.Topic, tp.Partition, timeoutMs(ctx))
+}
+
+func (kc *KafkaConsumer) Seek(tp TopicPartition, offset int64) error {
+	return kc.kc.IncrementalAssign([]kafka.TopicPartition{{
+		Topic:     &tp.Topic,
+		Partition: tp.Partition,
+		Offset:    kafka.Offset(offset),
+	}})
+}
+
+func (kc *KafkaConsumer) Position(tp TopicPartition) (int64, error) {
+	positions, err := kc.kc.Position([]kafka.TopicPartition{{Topic: &tp.Topic, Partition: tp.Partition}})
+	if err != nil {
+		return 0, err
+	}
+	if len(positions) != 1 {
+		return 0, fmt.Errorf("no position returned for %v", tp)
+	}
+	// librdkafka reports an invalid offset, which is negative, until it has fetched from tp.
+	return int64(positions[0].Offset), nil
+}
+
+func timeoutMs(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return kafkaTimeoutMs
+	}
+	return max(int(time.Until(deadline).Milliseconds()), 1)
+}
+
+// KafkaProducer is a [Producer] backed by a Kafka producer.
+type KafkaProducer struct {
+	kp         *kafka.Producer
+	onDelivery func(DeliveryReport)
+	done       chan struct{}
+}
+
+// KafkaProducerConfig configures a [KafkaProducer].
+type KafkaProducerConfig struct {
+	BootstrapServers string
+
+	// Partitioner selects the librdkafka partitioner that hashes keys the same way when it's set.
+	// See [PartitionerFNV1a] and [PartitionerMurmur2].
+	Partitioner string
+
+	// LingerMs and BatchSize are passed through to librdkafka's linger.ms and batch.size settings
+	// when they're set.
+	LingerMs  int
+	BatchSize int
+
+	// OnDelivery, when it's set, is called with the outcome of every produced message, including
+	// messages Produce failed to enqueue. It's called from the producer's event goroutine so it
+	// mustn't block.
+	OnDelivery func(DeliveryReport)
+}
+
+// NewKafkaProducer creates a Kafka producer. Delivery failures are reported asynchronously so
+// they're logged, and passed to cfg.OnDelivery, rather than returned from Produce.
+func NewKafkaProducer(cfg KafkaProducerConfig) (*KafkaProducer, error) {
+	cm := kafka.ConfigMap{
+		"bootstrap.servers": cfg.BootstrapServers,
+	}
+	partitioner, err := kafkaPartitioner(cfg.Partitioner)
+	if err != nil {
+		return nil, err
+	}
+	if partitioner != "" {
+		cm["partitioner"] = partitioner
+	}
+	if cfg.LingerMs > 0 {
+		cm["linger.ms"] = cfg.LingerMs
+	}
+	if cfg.BatchSize > 0 {
+		cm["batch.size"] = cfg.BatchSize
+	}
+	kp, err := kafka.NewProducer(&cm)
+	if err != nil {
+		return nil, fmt.Errorf("create Kafka producer: %w", err)
+	}
+
+	p := &KafkaProducer{
+		kp:         kp,
+		onDelivery: cfg.OnDelivery,
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		for e := range kp.Events() {
+			switch ev := e.(type) {
+			case *kafka.Message:
+				if ev.TopicPartition.Error != nil {
+					fmt.Printf("error: produce message: %v\n", ev.TopicPartition.Error)
+				}
+				if p.onDelivery != nil {
+					report := DeliveryReport{
+						Envelope: newEnvelope(ev),
+						Err:      ev.TopicPartition.Error,
+					}
+					if produced, ok := ev.Opaque.(kafkaProduced); ok {
+						report.Envelope.Message = produced.message
+						report.Latency = time.Since(produced.at)
+					}
+					p.onDelivery(report)
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// kafkaProduced is what a [KafkaProducer] remembers about a message until it's delivered.
+type kafkaProduced struct {
+	at      time.Time
+	message messages.Message
+}
+
+func (p *KafkaProducer) Produce(_ context.Context, env messages.Envelope) error {
+	km := newKafkaMessage(env)
+	km.Opaque = kafkaProduced{at: time.Now(), message: env.Message}
+	err := p.kp.Produce(km, nil)
+	if err != nil && p.onDelivery != nil {
+		p.onDelivery(DeliveryReport{Envelope: env, Err: err})
+	}
+	return err
+}
+
+func (p *KafkaProducer) Flush(ctx context.Context) error {
+	for p.kp.Flush(100) > 0 {
+		if isCancelled(ctx) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close closes the producer after waiting for outstanding delivery reports to be processed.
+func (p *KafkaProducer) Close() error {
+	p.kp.Close()
+	<-p.done
+	return nil
+}
+
+func newEnvelope(km *kafka.Message) messages.Envelope {
+	env := messages.Envelope{
+		Key:       km.Key,
+		Timestamp: km.Timestamp,
+		Raw:       km.Value,
+	}
+	if km.TopicPartition.Topic != nil {
+		env.Topic = *km.TopicPartition.Topic
+	}
+	env.Partition = km.TopicPartition.Partition
+	env.Offset = int64(km.TopicPartition.Offset)
+	if len(km.Headers) > 0 {
+		env.Headers = make([]messages.Header, 0, len(km.Headers))
+		for _, h := range km.Headers {
+			env.Headers = append(env.Headers, messages.Header{Key: h.Key, Value: h.Value})
+		}
+	}
+	return env
+}
+
+func newKafkaMessage(env messages.Envelope) *kafka.Message {
+	km := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &env.Topic,
+			Partition: kafka.PartitionAny,
+		},
+		Key:       env.Key,
+		Value:     env.Raw,
+		Timestamp: env.Timestamp,
+	}
+	if len(env.Headers) > 0 {
+		km.Headers = make([]kafka.Header, 0, len(env.Headers))
+		for _, h := range env.Headers {
+			km.Headers = append(km.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+	}
+	return km
+}
+
+func kafkaPartitions(partitions []TopicPartition) []kafka.TopicPartition {
+	kps := make([]kafka.TopicPartition, 0, len(partitions))
+	for _, tp := range partitions {
+		topic := tp.Topic
+		kps = append(kps, kafka.TopicPartition{Topic: &topic, Partition: tp.Partition})
+	}
+	return kps
+}
+
+func isCancelled(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package broker
+
+import "os"
+
+// lockFile opens path. Platforms without file locking can't stop two producers writing to a
+// partition, so it never returns [ErrLocked].
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+}
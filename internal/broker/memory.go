@@ -0,0 +1,307 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+var ErrClosed = errors.New("closed")
+
+// Memory is an in-memory partitioned log with consumer groups and committed offsets. It behaves
+// enough like Kafka to run the producer and consumer logic in tests and demos: keyed messages are
+// hashed to a partition, unkeyed messages are spread across partitions round-robin, and ordering
+// is only guaranteed within a partition.
+//
+// Consumer groups are simplified in that every consumer in a group is assigned every partition of
+// the topics it consumes, so a group is expected to have a single member.
+type Memory struct {
+	partitions int
+	mu         sync.Mutex
+	topics     map[string]*memoryTopic
+	committed  map[string]map[TopicPartition]int64
+	// appended is closed and replaced whenever a message is appended so waiting consumers can
+	// re-check for messages without polling.
+	appended chan struct{}
+}
+
+type memoryTopic struct {
+	partitions [][]messages.Envelope
+	next       int
+}
+
+// NewMemory creates an empty broker that creates topics with the given number of partitions on
+// first use.
+func NewMemory(partitions int) *Memory {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &Memory{
+		partitions: partitions,
+		topics:     map[string]*memoryTopic{},
+		committed:  map[string]map[TopicPartition]int64{},
+		appended:   make(chan struct{}),
+	}
+}
+
+// Producer returns a producer that appends to the broker's topics.
+func (m *Memory) Producer() *MemoryProducer {
+	return &MemoryProducer{m: m}
+}
+
+// Consumer returns a consumer for the given topics that starts at the group's committed offsets,
+// or at the beginning of each partition when the group hasn't committed.
+func (m *Memory) Consumer(group string, topics ...string) *MemoryConsumer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &MemoryConsumer{
+		m:         m,
+		group:     group,
+		topics:    topics,
+		positions: map[TopicPartition]int64{},
+		paused:    map[TopicPartition]bool{},
+	}
+	for tp, offset := range m.committed[group] {
+		c.positions[tp] = offset
+	}
+	return c
+}
+
+// Committed returns the group's committed offset for tp, i.e. the offset of the next message the
+// group will consume.
+func (m *Memory) Committed(group string, tp TopicPartition) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.committed[group][tp]
+}
+
+// Len returns the number of messages that have been appended to tp.
+func (m *Memory) Len(tp TopicPartition) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[tp.Topic]
+	if !ok || int(tp.Partition) >= len(t.partitions) {
+		return 0
+	}
+	return int64(len(t.partitions[tp.Partition]))
+}
+
+// Partitions returns the number of partitions each topic has.
+func (m *Memory) Partitions() int {
+	return m.partitions
+}
+
+func (m *Memory) topic(name string) *memoryTopic {
+	t, ok := m.topics[name]
+	if !ok {
+		t = &memoryTopic{partitions: make([][]messages.Envelope, m.partitions)}
+		m.topics[name] = t
+	}
+	return t
+}
+
+// log returns the messages appended to tp, or an error if tp's topic doesn't have that partition.
+// m.mu must be held.
+func (m *Memory) log(tp TopicPartition) ([]messages.Envelope, error) {
+	t := m.topic(tp.Topic)
+	if tp.Partition < 0 || int(tp.Partition) >= len(t.partitions) {
+		return nil, fmt.Errorf("unknown partition %v", tp)
+	}
+	return t.partitions[tp.Partition], nil
+}
+
+func (m *Memory) append(env messages.Envelope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.topic(env.Topic)
+	env.Partition = partitionFor(fnv1a, env.Key, m.partitions, &t.next)
+	env.Offset = int64(len(t.partitions[env.Partition]))
+	if env.Timestamp.IsZero() {
+		env.Timestamp = time.Now()
+	}
+	env.Message = messages.Message{}
+	t.partitions[env.Partition] = append(t.partitions[env.Partition], env)
+
+	close(m.appended)
+	m.appended = make(chan struct{})
+}
+
+// MemoryProducer is a [Producer] for a [Memory] broker. Messages are appended synchronously so
+// Flush never has anything to wait for.
+type MemoryProducer struct {
+	m *Memory
+}
+
+func (p *MemoryProducer) Produce(_ context.Context, env messages.Envelope) error {
+	p.m.append(env)
+	return nil
+}
+
+func (p *MemoryProducer) Flush(_ context.Context) error {
+	return nil
+}
+
+func (p *MemoryProducer) Close() error {
+	return nil
+}
+
+// MemoryConsumer is a [Consumer] for a [Memory] broker.
+type MemoryConsumer struct {
+	m         *Memory
+	group     string
+	topics    []string
+	positions map[TopicPartition]int64
+	paused    map[TopicPartition]bool
+	// next rotates the partition we check first so one busy partition can't starve the others.
+	next   int
+	closed bool
+}
+
+func (c *MemoryConsumer) Consume(ctx context.Context) (messages.Envelope, error) {
+	for {
+		env, ok, appended, err := c.tryConsume()
+		if err != nil {
+			return messages.Envelope{}, err
+		}
+		if ok {
+			return env, nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return messages.Envelope{}, ctx.Err()
+		}
+	}
+}
+
+// tryConsume returns the next available message, if any, along with a channel that's closed when
+// more messages are appended.
+func (c *MemoryConsumer) tryConsume() (messages.Envelope, bool, <-chan struct{}, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+
+	if c.closed {
+		return messages.Envelope{}, false, nil, ErrClosed
+	}
+
+	candidates := []TopicPartition{}
+	for _, name := range c.topics {
+		t := c.m.topic(name)
+		for p := range t.partitions {
+			candidates = append(candidates, TopicPartition{Topic: name, Partition: int32(p)})
+		}
+	}
+
+	for i := range candidates {
+		tp := candidates[(c.next+i)%len(candidates)]
+		if c.paused[tp] {
+			continue
+		}
+		log := c.m.topics[tp.Topic].partitions[tp.Partition]
+		position := c.positions[tp]
+		if position >= int64(len(log)) {
+			continue
+		}
+		c.positions[tp] = position + 1
+		c.next = (c.next + i + 1) % len(candidates)
+		return log[position], true, nil, nil
+	}
+
+	return messages.Envelope{}, false, c.m.appended, nil
+}
+
+func (c *MemoryConsumer) Commit(_ context.Context, env messages.Envelope) error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	offsets, ok := c.m.committed[c.group]
+	if !ok {
+		offsets = map[TopicPartition]int64{}
+		c.m.committed[c.group] = offsets
+	}
+	offsets[TopicPartition{Topic: env.Topic, Partition: env.Partition}] = env.Offset + 1
+	return nil
+}
+
+func (c *MemoryConsumer) Pause(partitions ...TopicPartition) error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	for _, tp := range partitions {
+		c.paused[tp] = true
+	}
+	return nil
+}
+
+func (c *MemoryConsumer) Resume(partitions ...TopicPartition) error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	for _, tp := range partitions {
+		delete(c.paused, tp)
+	}
+	// Wake any waiting Consume call since resumed partitions may already have messages.
+	close(c.m.appended)
+	c.m.appended = make(chan struct{})
+	return nil
+}
+
+func (c *MemoryConsumer) Partitions(_ context.Context, topic string) ([]int32, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	partitions := make([]int32, 0, c.m.partitions)
+	for p := range c.m.topic(topic).partitions {
+		partitions = append(partitions, int32(p))
+	}
+	return partitions, nil
+}
+
+func (c *MemoryConsumer) OffsetForTime(_ context.Context, tp TopicPartition, t time.Time) (int64, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	log, err := c.m.log(tp)
+	if err != nil {
+		return 0, err
+	}
+	for _, env := range log {
+		if !env.Timestamp.Before(t) {
+			return env.Offset, nil
+		}
+	}
+	return int64(len(log)), nil
+}
+
+func (c *MemoryConsumer) Watermarks(_ context.Context, tp TopicPartition) (int64, int64, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	log, err := c.m.log(tp)
+	if err != nil {
+		return 0, 0, err
+	}
+	return 0, int64(len(log)), nil
+}
+
+func (c *MemoryConsumer) Seek(tp TopicPartition, offset int64) error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.positions[tp] = offset
+	return nil
+}
+
+func (c *MemoryConsumer) Position(tp TopicPartition) (int64, error) {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	return c.positions[tp], nil
+}
+
+func (c *MemoryConsumer) Close() error {
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.closed = true
+	return nil
+}
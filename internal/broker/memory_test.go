@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestMemory(t *testing.T) {
+
+	produce := func(t *testing.T, m *Memory, topic string, key string, values ...string) {
+		for _, value := range values {
+			env := messages.Envelope{Topic: topic, Raw: []byte(value)}
+			if key != "" {
+				env.Key = []byte(key)
+			}
+			assert.NoError(t, m.Producer().Produce(context.Background(), env))
+		}
+	}
+
+	consume := func(t *testing.T, c Consumer, n int) []messages.Envelope {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		envs := []messages.Envelope{}
+		for i := 0; i < n; i++ {
+			env, err := c.Consume(ctx)
+			if !assert.NoError(t, err) {
+				break
+			}
+			envs = append(envs, env)
+		}
+		return envs
+	}
+
+	values := func(envs []messages.Envelope) []string {
+		vs := make([]string, 0, len(envs))
+		for _, env := range envs {
+			vs = append(vs, string(env.Raw))
+		}
+		return vs
+	}
+
+	t.Run("keyed messages go to one partition in order", func(t *testing.T) {
+		m := NewMemory(4)
+		produce(t, m, "t", "customer", "a", "b", "c")
+
+		envs := consume(t, m.Consumer("g", "t"), 3)
+		assert.Equal(t, []string{"a", "b", "c"}, values(envs))
+		for i, env := range envs {
+			assert.Equal(t, envs[0].Partition, env.Partition)
+			assert.Equal(t, int64(i), env.Offset)
+		}
+	})
+
+	t.Run("unkeyed messages are spread across partitions", func(t *testing.T) {
+		m := NewMemory(3)
+		produce(t, m, "t", "", "a", "b", "c")
+		for p := 0; p < 3; p++ {
+			assert.Equal(t, int64(1), m.Len(TopicPartition{Topic: "t", Partition: int32(p)}))
+		}
+	})
+
+	t.Run("new consumer resumes from committed offset", func(t *testing.T) {
+		m := NewMemory(1)
+		produce(t, m, "t", "", "a", "b", "c")
+
+		first := m.Consumer("g", "t")
+		envs := consume(t, first, 2)
+		assert.NoError(t, first.Commit(context.Background(), envs[0]))
+		assert.NoError(t, first.Close())
+
+		envs = consume(t, m.Consumer("g", "t"), 2)
+		assert.Equal(t, []string{"b", "c"}, values(envs))
+	})
+
+	t.Run("groups have independent offsets", func(t *testing.T) {
+		m := NewMemory(1)
+		produce(t, m, "t", "", "a")
+
+		g1 := m.Consumer("g1", "t")
+		env := consume(t, g1, 1)[0]
+		assert.NoError(t, g1.Commit(context.Background(), env))
+
+		assert.Equal(t, []string{"a"}, values(consume(t, m.Consumer("g2", "t"), 1)))
+	})
+
+	t.Run("paused partitions are skipped until resumed", func(t *testing.T) {
+		m := NewMemory(2)
+		produce(t, m, "t", "", "a", "b")
+
+		c := m.Consumer("g", "t")
+		p0 := TopicPartition{Topic: "t", Partition: 0}
+		assert.NoError(t, c.Pause(p0))
+		assert.Equal(t, []string{"b"}, values(consume(t, c, 1)))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := c.Consume(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		assert.NoError(t, c.Resume(p0))
+		assert.Equal(t, []string{"a"}, values(consume(t, c, 1)))
+	})
+
+	t.Run("Consume waits for produced messages", func(t *testing.T) {
+		m := NewMemory(1)
+		c := m.Consumer("g", "t")
+		go func() {
+			<-time.After(10 * time.Millisecond)
+			produce(t, m, "t", "", "late")
+		}()
+		assert.Equal(t, []string{"late"}, values(consume(t, c, 1)))
+	})
+
+	t.Run("consumes from multiple topics", func(t *testing.T) {
+		m := NewMemory(1)
+		for i := 0; i < 3; i++ {
+			produce(t, m, fmt.Sprintf("t%d", i), "", fmt.Sprint(i))
+		}
+		envs := consume(t, m.Consumer("g", "t0", "t1", "t2"), 3)
+		assert.ElementsMatch(t, []string{"0", "1", "2"}, values(envs))
+	})
+
+	t.Run("unknown partitions are errors", func(t *testing.T) {
+		m := NewMemory(2)
+		c := m.Consumer("g", "t")
+		for _, partition := range []int32{-1, 2} {
+			tp := TopicPartition{Topic: "t", Partition: partition}
+			_, err := c.OffsetForTime(context.Background(), tp, time.Now())
+			assert.Error(t, err, partition)
+			_, _, err = c.Watermarks(context.Background(), tp)
+			assert.Error(t, err, partition)
+		}
+	})
+}
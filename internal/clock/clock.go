@@ -0,0 +1,49 @@
+// Package clock lets time-dependent code run against real or simulated time.
+package clock
+
+import "time"
+
+// A Clock tells the current time and signals when time has passed.
+type Clock interface {
+	Now() time.Time
+
+	// After returns a channel that receives the current time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTicker returns a ticker that ticks every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker delivers ticks at intervals. As with [time.Ticker], ticks are dropped if the receiver
+// falls behind.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is a [Clock] that reads the system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{t: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
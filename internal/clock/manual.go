@@ -0,0 +1,133 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Manual is a [Clock] whose time only moves when it's advanced, so tests and simulations can
+// control time exactly. Timers and tickers fire during Advance when their deadline is reached.
+type Manual struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*manualWaiter
+}
+
+type manualWaiter struct {
+	deadline time.Time
+	// period is zero for one-shot waiters created by After.
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewManual creates a manual clock that starts at start.
+func NewManual(start time.Time) *Manual {
+	return &Manual{now: start}
+}
+
+func (m *Manual) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &manualWaiter{
+		deadline: m.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		w.c <- m.now
+		return w.c
+	}
+	m.waiters = append(m.waiters, w)
+	return w.c
+}
+
+func (m *Manual) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &manualWaiter{
+		deadline: m.now.Add(d),
+		period:   d,
+		c:        make(chan time.Time, 1),
+	}
+	m.waiters = append(m.waiters, w)
+	return &manualTicker{m: m, w: w}
+}
+
+// Advance moves the clock forward by d, firing every timer and ticker whose deadline is reached
+// along the way in deadline order.
+func (m *Manual) Advance(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set moves the clock to t. Moving the clock backwards doesn't fire anything.
+func (m *Manual) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		next := -1
+		for i, w := range m.waiters {
+			if w.deadline.After(t) {
+				continue
+			}
+			if next < 0 || w.deadline.Before(m.waiters[next].deadline) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		w := m.waiters[next]
+		if w.deadline.After(m.now) {
+			m.now = w.deadline
+		}
+		select {
+		case w.c <- m.now:
+		default:
+		}
+		if w.period > 0 {
+			w.deadline = w.deadline.Add(w.period)
+		} else {
+			m.waiters = append(m.waiters[:next], m.waiters[next+1:]...)
+		}
+	}
+
+	m.now = t
+}
+
+// Waiters returns the number of timers and tickers that haven't fired or been stopped. Tests use
+// it to wait for a goroutine to start waiting before advancing the clock.
+func (m *Manual) Waiters() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.waiters)
+}
+
+type manualTicker struct {
+	m *Manual
+	w *manualWaiter
+}
+
+func (t *manualTicker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *manualTicker) Stop() {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	for i, w := range t.m.waiters {
+		if w == t.w {
+			t.m.waiters = append(t.m.waiters[:i], t.m.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManual(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	received := func(c <-chan time.Time) (time.Time, bool) {
+		select {
+		case t := <-c:
+			return t, true
+		default:
+			return time.Time{}, false
+		}
+	}
+
+	t.Run("After fires once the deadline is reached", func(t *testing.T) {
+		m := NewManual(start)
+		c := m.After(time.Second)
+
+		m.Advance(999 * time.Millisecond)
+		_, ok := received(c)
+		assert.False(t, ok)
+
+		m.Advance(time.Millisecond)
+		fired, ok := received(c)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(time.Second), fired)
+		assert.Equal(t, 0, m.Waiters())
+	})
+
+	t.Run("After with non-positive duration fires immediately", func(t *testing.T) {
+		m := NewManual(start)
+		_, ok := received(m.After(0))
+		assert.True(t, ok)
+	})
+
+	t.Run("ticker ticks every period and drops missed ticks", func(t *testing.T) {
+		m := NewManual(start)
+		ticker := m.NewTicker(time.Second)
+
+		m.Advance(time.Second)
+		tick, ok := received(ticker.C())
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(time.Second), tick)
+
+		m.Advance(3 * time.Second)
+		tick, ok = received(ticker.C())
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(2*time.Second), tick)
+		_, ok = received(ticker.C())
+		assert.False(t, ok)
+
+		ticker.Stop()
+		m.Advance(time.Second)
+		_, ok = received(ticker.C())
+		assert.False(t, ok)
+		assert.Equal(t, 0, m.Waiters())
+	})
+
+	t.Run("Now reflects the time a waiter fired at while advancing", func(t *testing.T) {
+		m := NewManual(start)
+		c := m.After(time.Second)
+		m.Advance(5 * time.Second)
+		fired, _ := received(c)
+		assert.Equal(t, start.Add(time.Second), fired)
+		assert.Equal(t, start.Add(5*time.Second), m.Now())
+	})
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"time"
 )
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
 // Parse reads the config
 func Parse[T any](configMap Map) (T, error) {
 	var target T
@@ -61,6 +64,16 @@ func ParseInto(configMap Map, target any) error {
 		}
 		field := targetValue.Field(i)
 
+		// Durations are int64s so they have to be handled before the kind switch.
+		if field.Type() == durationType {
+			v, err := time.ParseDuration(configVal)
+			if err != nil {
+				return fmt.Errorf("parse %q=%q: %v", configKey, configVal, err)
+			}
+			field.SetInt(int64(v))
+			continue
+		}
+
 		switch field.Kind() {
 		case reflect.String:
 			field.SetString(configVal)
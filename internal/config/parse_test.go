@@ -3,6 +3,7 @@ package config
 import (
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -93,4 +94,20 @@ func TestParse(t *testing.T) {
 			assert.Equal(t, expected, *actual)
 		})
 	})
+	t.Run("parses durations", func(t *testing.T) {
+		type target struct {
+			Duration time.Duration `config_key:"duration"`
+		}
+		actual, err := Parse[target](StdMap(map[string]string{"duration": "1m30s"}))
+		assert.NoError(t, err)
+		assert.Equal(t, 90*time.Second, actual.Duration)
+	})
+
+	t.Run("returns error for invalid duration", func(t *testing.T) {
+		type target struct {
+			Duration time.Duration `config_key:"duration"`
+		}
+		_, err := Parse[target](StdMap(map[string]string{"duration": "90"}))
+		assert.Error(t, err)
+	})
 }
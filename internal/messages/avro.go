@@ -0,0 +1,79 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Avro is a [Codec] that encodes messages using the Avro binary encoding. Avro data can't be read
+// without the schema it was written with, so the schema version selects the writer schema when
+// decoding. See [AvroSchema] for the schema of each version.
+type Avro struct{}
+
+var errAvroTruncated = errors.New("truncated avro record")
+
+var avroSchemas = map[int]string{
+	SchemaVersion1: `{"type":"record","name":"Message","fields":[` +
+		`{"name":"customer_id","type":"string"},` +
+		`{"name":"type","type":"string"},` +
+		`{"name":"body","type":"string"}]}`,
+	SchemaVersion2: `{"type":"record","name":"Message","fields":[` +
+		`{"name":"customer_id","type":"string"},` +
+		`{"name":"type","type":"string"},` +
+		`{"name":"body","type":"string"},` +
+		`{"name":"id","type":"string","default":""}]}`,
+}
+
+// AvroSchema returns the Avro schema, in JSON, for the given schema version.
+func AvroSchema(version int) (string, bool) {
+	schema, ok := avroSchemas[version]
+	return schema, ok
+}
+
+func (Avro) ContentType() string {
+	return "avro/binary"
+}
+
+func (Avro) Encode(msg Message, version int) ([]byte, error) {
+	fields, err := avroFields(&msg, version)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	for _, field := range fields {
+		data = binary.AppendVarint(data, int64(len(*field)))
+		data = append(data, *field...)
+	}
+	return data, nil
+}
+
+func (Avro) Decode(data []byte, version int) (Message, error) {
+	msg := Message{}
+	fields, err := avroFields(&msg, version)
+	if err != nil {
+		return Message{}, err
+	}
+	for _, field := range fields {
+		length, n := binary.Varint(data)
+		if n <= 0 || length < 0 || int64(len(data)-n) < length {
+			return Message{}, errAvroTruncated
+		}
+		*field = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+	return msg, nil
+}
+
+// avroFields returns pointers to the fields of msg in the order the given schema version writes
+// them.
+func avroFields(msg *Message, version int) ([]*string, error) {
+	switch version {
+	case SchemaVersion1:
+		return []*string{&msg.CustomerID, &msg.Type, &msg.Body}, nil
+	case SchemaVersion2:
+		return []*string{&msg.CustomerID, &msg.Type, &msg.Body, &msg.ID}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, version)
+	}
+}
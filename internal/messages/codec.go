@@ -0,0 +1,122 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ContentTypeHeader is the header that identifies the [Codec] a message was encoded with.
+	ContentTypeHeader = "content-type"
+
+	// SchemaVersionHeader is the header that identifies the schema version a message was written
+	// with.
+	SchemaVersionHeader = "schema-version"
+)
+
+const (
+	// SchemaVersion1 has the CustomerID, Type, and Body fields.
+	SchemaVersion1 = 1
+
+	// SchemaVersion2 adds the ID field.
+	SchemaVersion2 = 2
+
+	// CurrentSchemaVersion is the latest schema version; producers write it by default.
+	CurrentSchemaVersion = SchemaVersion2
+)
+
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// A Codec converts messages to and from a wire format. Encode writes the fields defined by the
+// given schema version and Decode reads data that was written with the given schema version.
+// Codecs that can read data written with versions newer than [CurrentSchemaVersion] do so, and
+// those that can't return [ErrUnsupportedSchemaVersion].
+type Codec interface {
+	ContentType() string
+	Encode(msg Message, version int) ([]byte, error)
+	Decode(data []byte, version int) (Message, error)
+}
+
+var codecs = []Codec{
+	JSON{},
+	Protobuf{},
+	Avro{},
+}
+
+// LookupCodec finds a codec by its content type or short name ("json", "protobuf", or "avro").
+func LookupCodec(name string) (Codec, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, codec := range codecs {
+		if codec.ContentType() == name || shortName(codec) == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+func shortName(codec Codec) string {
+	switch codec.(type) {
+	case JSON:
+		return "json"
+	case Protobuf:
+		return "protobuf"
+	case Avro:
+		return "avro"
+	default:
+		return ""
+	}
+}
+
+// Encode encodes msg with codec and returns the encoded bytes along with the headers a consumer
+// needs to decode them.
+func Encode(codec Codec, version int, msg Message) ([]byte, []Header, error) {
+	if version < SchemaVersion1 || version > CurrentSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, version)
+	}
+	data, err := codec.Encode(msg, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := []Header{
+		{Key: ContentTypeHeader, Value: []byte(codec.ContentType())},
+		{Key: SchemaVersionHeader, Value: []byte(strconv.Itoa(version))},
+	}
+	return data, headers, nil
+}
+
+// Decode decodes env.Raw into env.Message using the codec and schema version named by the
+// envelope's headers. Messages without a content type are assumed to be JSON and messages without
+// a schema version are assumed to be version 1, since that's what was produced before either
+// header existed. Whether a version newer than [CurrentSchemaVersion] can be read is left to the
+// codec.
+func Decode(env *Envelope) error {
+	codec := Codec(JSON{})
+	if contentType, ok := env.Header(ContentTypeHeader); ok {
+		found, ok := LookupCodec(string(contentType))
+		if !ok {
+			return fmt.Errorf("unsupported content type %q", contentType)
+		}
+		codec = found
+	}
+
+	version := SchemaVersion1
+	if v, ok := env.Header(SchemaVersionHeader); ok {
+		parsed, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("parse schema version %q: %v", v, err)
+		}
+		version = parsed
+	}
+	if version < SchemaVersion1 {
+		return fmt.Errorf("%w: %d", ErrUnsupportedSchemaVersion, version)
+	}
+
+	msg, err := codec.Decode(env.Raw, version)
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", codec.ContentType(), err)
+	}
+	env.Message = msg
+	return nil
+}
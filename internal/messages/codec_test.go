@@ -0,0 +1,109 @@
+package messages
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+
+	msg := Message{
+		CustomerID: "faa108f9-0815-4035-89c4-403b4f2f7948",
+		Type:       "foo",
+		Body:       "hello",
+		ID:         "42",
+	}
+
+	for _, codec := range codecs {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+
+			for _, version := range []int{SchemaVersion1, SchemaVersion2} {
+				t.Run(fmt.Sprintf("round trips version %d", version), func(t *testing.T) {
+					expected := msg
+					if version < SchemaVersion2 {
+						expected.ID = ""
+					}
+					data, headers, err := Encode(codec, version, msg)
+					assert.NoError(t, err)
+
+					env := Envelope{Raw: data, Headers: headers}
+					assert.NoError(t, Decode(&env))
+					assert.Equal(t, expected, env.Message)
+				})
+			}
+
+			t.Run("is found by content type", func(t *testing.T) {
+				found, ok := LookupCodec(codec.ContentType())
+				assert.True(t, ok)
+				assert.Equal(t, codec, found)
+			})
+		})
+	}
+
+	t.Run("Decode", func(t *testing.T) {
+
+		t.Run("assumes JSON without headers", func(t *testing.T) {
+			env := Envelope{Raw: []byte(`{"customer_id":"c","type":"t","body":"b"}`)}
+			assert.NoError(t, Decode(&env))
+			assert.Equal(t, Message{CustomerID: "c", Type: "t", Body: "b"}, env.Message)
+		})
+
+		t.Run("reads version 1 Avro without a version header", func(t *testing.T) {
+			data, _ := Avro{}.Encode(msg, SchemaVersion1)
+			env := Envelope{
+				Raw:     data,
+				Headers: []Header{{Key: ContentTypeHeader, Value: []byte("avro/binary")}},
+			}
+			assert.NoError(t, Decode(&env))
+			assert.Equal(t, "hello", env.Message.Body)
+		})
+
+		t.Run("returns error for unknown content type", func(t *testing.T) {
+			env := Envelope{Headers: []Header{{Key: ContentTypeHeader, Value: []byte("text/xml")}}}
+			assert.Error(t, Decode(&env))
+		})
+
+		t.Run("returns error for invalid schema version", func(t *testing.T) {
+			env := Envelope{Headers: []Header{{Key: SchemaVersionHeader, Value: []byte("0")}}}
+			assert.ErrorIs(t, Decode(&env), ErrUnsupportedSchemaVersion)
+		})
+
+		t.Run("reads newer schema versions with codecs that skip unknown fields", func(t *testing.T) {
+			for _, codec := range []Codec{JSON{}, Protobuf{}} {
+				data, _ := codec.Encode(msg, CurrentSchemaVersion)
+				env := Envelope{
+					Raw: data,
+					Headers: []Header{
+						{Key: ContentTypeHeader, Value: []byte(codec.ContentType())},
+						{Key: SchemaVersionHeader, Value: []byte(strconv.Itoa(CurrentSchemaVersion + 1))},
+					},
+				}
+				assert.NoError(t, Decode(&env), codec.ContentType())
+				assert.Equal(t, msg, env.Message, codec.ContentType())
+			}
+		})
+
+		t.Run("returns error for newer Avro schema versions", func(t *testing.T) {
+			data, _ := Avro{}.Encode(msg, CurrentSchemaVersion)
+			env := Envelope{
+				Raw: data,
+				Headers: []Header{
+					{Key: ContentTypeHeader, Value: []byte(Avro{}.ContentType())},
+					{Key: SchemaVersionHeader, Value: []byte(strconv.Itoa(CurrentSchemaVersion + 1))},
+				},
+			}
+			assert.ErrorIs(t, Decode(&env), ErrUnsupportedSchemaVersion)
+		})
+
+		t.Run("returns error for truncated data", func(t *testing.T) {
+			for _, codec := range codecs {
+				data, headers, _ := Encode(codec, CurrentSchemaVersion, msg)
+				env := Envelope{Raw: data[:len(data)-1], Headers: headers}
+				assert.Error(t, Decode(&env), codec.ContentType())
+			}
+		})
+	})
+}
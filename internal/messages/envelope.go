@@ -0,0 +1,55 @@
+package messages
+
+import "time"
+
+// A Header is a single key/value pair attached to a message by the broker.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// An Envelope is a decoded [Message] along with the broker metadata it was delivered with. The
+// original bytes are kept in Raw so the message can be forwarded (e.g. deferred or dead-lettered)
+// without re-encoding it.
+type Envelope struct {
+	Message   Message
+	Key       []byte
+	Headers   []Header
+	Topic     string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+	Raw       []byte
+}
+
+// Header returns the value of the first header with the given key.
+func (e Envelope) Header(key string) ([]byte, bool) {
+	for _, h := range e.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetHeader sets the value of the first header with the given key and drops any later headers with
+// that key, or adds a header if there are none. The header slice is copied so envelopes that share
+// a backing array aren't modified.
+func (e *Envelope) SetHeader(key string, value []byte) {
+	headers := make([]Header, 0, len(e.Headers)+1)
+	found := false
+	for _, h := range e.Headers {
+		if h.Key == key {
+			if found {
+				continue
+			}
+			h.Value = value
+			found = true
+		}
+		headers = append(headers, h)
+	}
+	if !found {
+		headers = append(headers, Header{Key: key, Value: value})
+	}
+	e.Headers = headers
+}
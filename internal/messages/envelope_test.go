@@ -0,0 +1,42 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvelope(t *testing.T) {
+
+	t.Run("SetHeader", func(t *testing.T) {
+
+		t.Run("adds missing header", func(t *testing.T) {
+			env := Envelope{}
+			env.SetHeader("foo", []byte("bar"))
+			actual, ok := env.Header("foo")
+			assert.True(t, ok)
+			assert.Equal(t, []byte("bar"), actual)
+		})
+
+		t.Run("replaces existing header and drops duplicates", func(t *testing.T) {
+			env := Envelope{Headers: []Header{
+				{Key: "foo", Value: []byte("1")},
+				{Key: "baz", Value: []byte("2")},
+				{Key: "foo", Value: []byte("3")},
+			}}
+			env.SetHeader("foo", []byte("4"))
+			assert.Equal(t, []Header{
+				{Key: "foo", Value: []byte("4")},
+				{Key: "baz", Value: []byte("2")},
+			}, env.Headers)
+		})
+
+		t.Run("does not modify shared headers", func(t *testing.T) {
+			original := Envelope{Headers: []Header{{Key: "foo", Value: []byte("1")}}}
+			copied := original
+			copied.SetHeader("foo", []byte("2"))
+			actual, _ := original.Header("foo")
+			assert.Equal(t, []byte("1"), actual)
+		})
+	})
+}
@@ -0,0 +1,24 @@
+package messages
+
+import "encoding/json"
+
+// JSON is a [Codec] that encodes messages as JSON objects. JSON decoding ignores the schema
+// version since missing fields are simply left empty.
+type JSON struct{}
+
+func (JSON) ContentType() string {
+	return "application/json"
+}
+
+func (JSON) Encode(msg Message, version int) ([]byte, error) {
+	if version < SchemaVersion2 {
+		msg.ID = ""
+	}
+	return json.Marshal(msg)
+}
+
+func (JSON) Decode(data []byte, _ int) (Message, error) {
+	msg := Message{}
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
@@ -5,4 +5,8 @@ type Message struct {
 	CustomerID string `json:"customer_id"`
 	Type       string `json:"type"`
 	Body       string `json:"body"`
+
+	// ID uniquely identifies a message. It was added in schema version 2 so it's empty for messages
+	// written with earlier versions.
+	ID string `json:"id,omitempty"`
 }
@@ -0,0 +1,107 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protobuf is a [Codec] that encodes messages in the Protocol Buffers wire format using the
+// following definition:
+//
+//	message Message {
+//	  string customer_id = 1;
+//	  string type = 2;
+//	  string body = 3;
+//	  string id = 4; // Added in schema version 2.
+//	}
+//
+// The message is simple enough that we write the wire format directly rather than pulling in
+// generated code. Unknown fields are skipped when decoding, so the schema version is only used
+// when encoding.
+type Protobuf struct{}
+
+const (
+	protobufWireVarint  = 0
+	protobufWireFixed64 = 1
+	protobufWireBytes   = 2
+	protobufWireFixed32 = 5
+)
+
+var errProtobufTruncated = errors.New("truncated protobuf message")
+
+func (Protobuf) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (Protobuf) Encode(msg Message, version int) ([]byte, error) {
+	data := make([]byte, 0, len(msg.CustomerID)+len(msg.Type)+len(msg.Body)+len(msg.ID)+16)
+	data = appendProtobufString(data, 1, msg.CustomerID)
+	data = appendProtobufString(data, 2, msg.Type)
+	data = appendProtobufString(data, 3, msg.Body)
+	if version >= SchemaVersion2 {
+		data = appendProtobufString(data, 4, msg.ID)
+	}
+	return data, nil
+}
+
+func (Protobuf) Decode(data []byte, _ int) (Message, error) {
+	msg := Message{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Message{}, errProtobufTruncated
+		}
+		data = data[n:]
+
+		field, wireType := tag>>3, tag&0x7
+		switch wireType {
+		case protobufWireVarint:
+			_, n := binary.Uvarint(data)
+			if n <= 0 {
+				return Message{}, errProtobufTruncated
+			}
+			data = data[n:]
+		case protobufWireFixed64:
+			if len(data) < 8 {
+				return Message{}, errProtobufTruncated
+			}
+			data = data[8:]
+		case protobufWireFixed32:
+			if len(data) < 4 {
+				return Message{}, errProtobufTruncated
+			}
+			data = data[4:]
+		case protobufWireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return Message{}, errProtobufTruncated
+			}
+			value := string(data[n : n+int(length)])
+			data = data[n+int(length):]
+			switch field {
+			case 1:
+				msg.CustomerID = value
+			case 2:
+				msg.Type = value
+			case 3:
+				msg.Body = value
+			case 4:
+				msg.ID = value
+			}
+		default:
+			return Message{}, fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+	}
+	return msg, nil
+}
+
+func appendProtobufString(data []byte, field uint64, value string) []byte {
+	// Proto3 doesn't encode fields with default values.
+	if value == "" {
+		return data
+	}
+	data = binary.AppendUvarint(data, field<<3|protobufWireBytes)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/maps"
+)
+
+// Content types of the exposition formats [Set.Handler] serves.
+const (
+	// PrometheusContentType is Prometheus' text exposition format.
+	PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// OpenMetricsContentType is the OpenMetrics text format.
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Handler serves every series in s for Prometheus to scrape, with names prefixed by namespace. It
+// responds with OpenMetrics when the request accepts it and Prometheus' text format otherwise.
+func (s *Set) Handler(namespace string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+		contentType := PrometheusContentType
+		if openMetrics {
+			contentType = OpenMetricsContentType
+		}
+		buf := bytes.Buffer{}
+		if err := s.WriteExposition(&buf, namespace, openMetrics); err != nil {
+			fmt.Printf("error: write metrics: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// WriteExposition writes every series in s in Prometheus' text format, or OpenMetrics if
+// openMetrics is set, with names prefixed by namespace. Counts are counters of everything recorded
+// since s was created rather than per second, gauges are their latest value, and histograms are
+// cumulative buckets of every observation. Names and label names are sanitized, so
+// `delivery-latency-ms` is exposed as `<namespace>_delivery_latency_ms`. Each family's help is
+// what [Set.Describe] set. It returns an error without writing anything if two metrics would be
+// exposed under the same name, like a count and a gauge with the same name or `a-b` and `a_b`.
+func (s *Set) WriteExposition(w io.Writer, namespace string, openMetrics bool) error {
+	families := map[string]*family{}
+	// exposed maps every name written, families' and their samples', to the metric it belongs to.
+	exposed := map[string]string{}
+	collisions := []error{}
+	add := func(name string, type_ string) *family {
+		metric := fmt.Sprintf("%s %q", type_, name)
+		f, ok := families[metric]
+		if ok {
+			return f
+		}
+		f = &family{name: metricName(namespace, name), type_: type_, help: s.Help(name)}
+		families[metric] = f
+		for _, suffix := range append([]string{""}, sampleSuffixes[type_]...) {
+			if other, ok := exposed[f.name+suffix]; ok {
+				collisions = append(collisions, fmt.Errorf("%s and %s are both exposed as %s", other, metric, f.name+suffix))
+				continue
+			}
+			exposed[f.name+suffix] = metric
+		}
+		return f
+	}
+
+	totals := s.Totals()
+	for _, t := range totals.Counts {
+		f := add(t.Name, "counter")
+		f.samples = append(f.samples, sample{suffix: "_total", labels: t.Labels, value: strconv.Itoa(t.Value)})
+	}
+	for _, t := range totals.Gauges {
+		f := add(t.Name, "gauge")
+		f.samples = append(f.samples, sample{labels: t.Labels, value: formatFloat(t.Value)})
+	}
+	bounds := totals.Bounds
+	for _, t := range totals.Histograms {
+		f := add(t.Name, "histogram")
+		cumulative := 0
+		for i, count := range t.Value.Counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(bounds) {
+				le = bounds[i]
+			}
+			f.samples = append(f.samples, sample{
+				suffix: "_bucket",
+				labels: t.Labels,
+				le:     formatFloat(le),
+				value:  strconv.Itoa(cumulative),
+			})
+		}
+		f.samples = append(f.samples,
+			sample{suffix: "_sum", labels: t.Labels, value: formatFloat(t.Value.Sum)},
+			sample{suffix: "_count", labels: t.Labels, value: strconv.Itoa(cumulative)})
+	}
+
+	if len(collisions) > 0 {
+		return errors.Join(collisions...)
+	}
+
+	bw := bufio.NewWriter(w)
+	sorted := maps.Values(families)
+	slices.SortFunc(sorted, func(a *family, b *family) int {
+		return strings.Compare(a.name, b.name)
+	})
+	for _, f := range sorted {
+		f.write(bw, openMetrics)
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// sampleSuffixes are the suffixes each type of family's samples are named with.
+var sampleSuffixes = map[string][]string{
+	"counter":   {"_total"},
+	"histogram": {"_bucket", "_sum", "_count"},
+}
+
+// A family is the samples exposed under one metric name.
+type family struct {
+	name    string
+	type_   string
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	suffix string
+	labels Labels
+	// le is the bucket bound of a histogram's _bucket samples.
+	le    string
+	value string
+}
+
+func (f *family) write(w *bufio.Writer, openMetrics bool) {
+	// Prometheus' text format names counters after their samples while OpenMetrics names the
+	// family and suffixes the samples.
+	typeName := f.name
+	if f.type_ == "counter" && !openMetrics {
+		typeName += "_total"
+	}
+	help := helpEscaper.Replace(f.help)
+	if openMetrics {
+		help = openMetricsHelpEscaper.Replace(f.help)
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", typeName, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", typeName, f.type_)
+
+	// Keep a series' samples together, in the order they were added, with the series sorted.
+	slices.SortStableFunc(f.samples, func(a sample, b sample) int {
+		return strings.Compare(SeriesKey("", a.labels), SeriesKey("", b.labels))
+	})
+	for _, s := range f.samples {
+		w.WriteString(f.name)
+		w.WriteString(s.suffix)
+		writeLabels(w, s.labels, s.le)
+		w.WriteString(" ")
+		w.WriteString(s.value)
+		w.WriteString("\n")
+	}
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	// Prometheus' text format doesn't escape quotes in help text but OpenMetrics does.
+	helpEscaper            = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	openMetricsHelpEscaper = labelValueEscaper
+)
+
+// writeLabels writes labels sorted by name, followed by le if it's set.
+func writeLabels(w *bufio.Writer, labels Labels, le string) {
+	if len(labels) == 0 && le == "" {
+		return
+	}
+	names := maps.Keys(labels)
+	slices.Sort(names)
+	w.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString(sanitizeName(name, false))
+		w.WriteString(`="`)
+		labelValueEscaper.WriteString(w, labels[name])
+		w.WriteString(`"`)
+	}
+	if le != "" {
+		if len(names) > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString(`le="`)
+		w.WriteString(le)
+		w.WriteString(`"`)
+	}
+	w.WriteString("}")
+}
+
+// metricName returns name prefixed by namespace and sanitized.
+func metricName(namespace string, name string) string {
+	if namespace != "" {
+		name = namespace + "_" + name
+	}
+	return sanitizeName(name, true)
+}
+
+// sanitizeName replaces the characters Prometheus doesn't allow in metric names, or in label
+// names if colons aren't allowed, with underscores.
+func sanitizeName(name string, allowColons bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		case c == ':' && allowColons:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestExposition(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	// record records the same measurements in a new set over two seconds and waits for them to be
+	// indexed.
+	record := func(t *testing.T) *Set {
+		clk := clock.NewManual(start)
+		s := NewSet(clk, Seconds(1), []float64{1, 10})
+		t.Cleanup(s.Close)
+		s.Describe("deferred", "Messages deferred because their key was over its limit.")
+
+		s.Counts.Record("deferred", Labels{"customer": "a", "type": "foo"}, 2)
+		s.Counts.Record("deferred", Labels{"customer": `say "hi"`, "type": "foo"}, 1)
+		s.Gauges.Set("paused-partitions", nil, 3)
+		s.Histograms.Observe("delivery-latency-ms", nil, 0.5)
+		s.Histograms.Observe("delivery-latency-ms", nil, 5)
+		s.Counts.flush()
+		s.Gauges.flush()
+		s.Histograms.flush()
+		clk.Advance(time.Second)
+
+		require.Eventually(t, func() bool {
+			return len(s.Counts.totalSeries()) == 2 && len(s.Histograms.totalSeries()) == 1
+		}, time.Second, time.Millisecond)
+
+		// Counters keep counting after the measurements fall out of the retention period.
+		s.Counts.Record("deferred", Labels{"customer": "a", "type": "foo"}, 1)
+		s.Gauges.Set("paused-partitions", nil, 1)
+		s.Histograms.Observe("delivery-latency-ms", nil, 50)
+		s.Counts.flush()
+		s.Gauges.flush()
+		s.Histograms.flush()
+		clk.Advance(5 * time.Second)
+		require.Eventually(t, func() bool {
+			totals := s.Histograms.totalSeries()
+			return len(totals) == 1 && totals[0].total.Total() == 3
+		}, time.Second, time.Millisecond)
+		return s
+	}
+
+	t.Run("writes Prometheus text", func(t *testing.T) {
+		s := record(t)
+		sb := strings.Builder{}
+		require.NoError(t, s.WriteExposition(&sb, "consumer", false))
+		assert.Equal(t, `# HELP consumer_deferred_total Messages deferred because their key was over its limit.
+# TYPE consumer_deferred_total counter
+consumer_deferred_total{customer="a",type="foo"} 3
+consumer_deferred_total{customer="say \"hi\"",type="foo"} 1
+# HELP consumer_delivery_latency_ms delivery-latency-ms
+# TYPE consumer_delivery_latency_ms histogram
+consumer_delivery_latency_ms_bucket{le="1"} 1
+consumer_delivery_latency_ms_bucket{le="10"} 2
+consumer_delivery_latency_ms_bucket{le="+Inf"} 3
+consumer_delivery_latency_ms_sum 55.5
+consumer_delivery_latency_ms_count 3
+# HELP consumer_paused_partitions paused-partitions
+# TYPE consumer_paused_partitions gauge
+consumer_paused_partitions 1
+`, sb.String())
+	})
+
+	t.Run("writes OpenMetrics text", func(t *testing.T) {
+		s := record(t)
+		sb := strings.Builder{}
+		require.NoError(t, s.WriteExposition(&sb, "", true))
+		assert.Contains(t, sb.String(), "# HELP deferred Messages deferred because their key was over its limit.\n# TYPE deferred counter\ndeferred_total{customer=\"a\",type=\"foo\"} 3\n")
+		assert.True(t, strings.HasSuffix(sb.String(), "paused_partitions 1\n# EOF\n"), sb.String())
+	})
+
+	t.Run("rejects metrics exposed under the same name", func(t *testing.T) {
+		for name, record := range map[string]func(s *Set){
+			"a count and a gauge": func(s *Set) {
+				s.Counts.Record("a", nil, 1)
+				s.Gauges.Set("a", nil, 1)
+			},
+			"names that sanitize the same": func(s *Set) {
+				s.Gauges.Set("a-b", nil, 1)
+				s.Gauges.Set("a_b", nil, 1)
+			},
+			"a gauge named like a histogram's samples": func(s *Set) {
+				s.Histograms.Observe("a", nil, 1)
+				s.Gauges.Set("a_count", nil, 1)
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				clk := clock.NewManual(start)
+				s := NewSet(clk, Seconds(60), []float64{1})
+				defer s.Close()
+				record(s)
+				s.Counts.flush()
+				s.Gauges.flush()
+				s.Histograms.flush()
+				clk.Advance(time.Second)
+				require.Eventually(t, func() bool {
+					return len(s.Counts.totalSeries())+len(s.Gauges.totalSeries())+len(s.Histograms.totalSeries()) == 2
+				}, time.Second, time.Millisecond)
+
+				sb := strings.Builder{}
+				assert.Error(t, s.WriteExposition(&sb, "", false))
+				assert.Empty(t, sb.String())
+
+				rec := httptest.NewRecorder()
+				s.Handler("").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				assert.Equal(t, http.StatusInternalServerError, rec.Code)
+			})
+		}
+	})
+
+	t.Run("negotiates the format", func(t *testing.T) {
+		s := NewSet(clock.NewManual(start), Seconds(60), []float64{1})
+		defer s.Close()
+
+		rec := httptest.NewRecorder()
+		s.Handler("consumer").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, PrometheusContentType, rec.Header().Get("Content-Type"))
+		assert.Empty(t, rec.Body.String())
+
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+		rec = httptest.NewRecorder()
+		s.Handler("consumer").ServeHTTP(rec, req)
+		assert.Equal(t, OpenMetricsContentType, rec.Header().Get("Content-Type"))
+		assert.Equal(t, "# EOF\n", rec.Body.String())
+	})
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// GaugeValue summarizes the values a gauge was set to in a second.
+type GaugeValue struct {
+	Last float64 `json:"last"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+type GaugeBuckets map[time.Time]GaugeValue
+
+// Gauge tracks levels that go up and down, like a limiter's tokens, consumer lag, or messages in
+// flight. A second without any values keeps the last value of the second before it.
+type Gauge struct {
+	*store[float64, GaugeValue]
+}
+
+func NewGauge(clk clock.Clock, retention Retention) *Gauge {
+	return &Gauge{newStore[float64, GaugeValue]("Gauge", gaugeAggregator{}, clk, retention, nil)}
+}
+
+// Set sets the series recorded under name and labels to value.
+func (g *Gauge) Set(name string, labels Labels, value float64) {
+	g.record(name, labels, value)
+}
+
+// Data returns every series' values at the finest resolution keyed by [SeriesKey].
+func (g *Gauge) Data() map[string]GaugeBuckets {
+	return gaugeData(g.selectSeries("", nil, 0))
+}
+
+func gaugeData(series []storedSeries[GaugeValue]) map[string]GaugeBuckets {
+	data := make(map[string]GaugeBuckets, len(series))
+	for _, s := range series {
+		data[SeriesKey(s.name, s.labels)] = s.buckets
+	}
+	return data
+}
+
+type gaugeAggregator struct{}
+
+func (gaugeAggregator) add(b GaugeValue, ok bool, s float64) GaugeValue {
+	if !ok {
+		return GaugeValue{Last: s, Min: s, Max: s}
+	}
+	return GaugeValue{Last: s, Min: min(b.Min, s), Max: max(b.Max, s)}
+}
+
+func (gaugeAggregator) merge(earlier GaugeValue, later GaugeValue) GaugeValue {
+	return GaugeValue{Last: later.Last, Min: min(earlier.Min, later.Min), Max: max(earlier.Max, later.Max)}
+}
+
+func (gaugeAggregator) fill(prev GaugeValue, ok bool) (GaugeValue, bool) {
+	if !ok {
+		return GaugeValue{}, false
+	}
+	return GaugeValue{Last: prev.Last, Min: prev.Last, Max: prev.Last}, true
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestGauge(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("keeps the last, lowest, and highest values each second", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		g := NewGauge(clk, Seconds(60))
+		defer g.Close()
+
+		g.Set("tokens", nil, 5)
+		g.Set("tokens", nil, 2)
+		g.Set("tokens", nil, 8)
+		g.Set("tokens", nil, 4)
+		g.flush()
+		clk.Advance(time.Second)
+
+		assert.Eventually(t, func() bool {
+			return g.Data()["tokens"][start] == GaugeValue{Last: 4, Min: 2, Max: 8}
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("carries the last value through seconds without any", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		g := NewGauge(clk, Seconds(60))
+		defer g.Close()
+
+		clk.Advance(time.Second)
+		g.Set("lag", Labels{"partition": "0"}, 3)
+		g.flush()
+		clk.Advance(3 * time.Second)
+
+		key := `lag{partition="0"}`
+		assert.Eventually(t, func() bool {
+			return len(g.Data()[key]) == 3
+		}, time.Second, time.Millisecond)
+		data := g.Data()[key]
+		_, ok := data[start]
+		assert.False(t, ok, "there's nothing to carry before the first value")
+		assert.Equal(t, GaugeValue{Last: 3, Min: 3, Max: 3}, data[start.Add(3*time.Second)])
+	})
+
+	t.Run("drops values set after it's closed", func(t *testing.T) {
+		g := NewGauge(clock.NewManual(start), Seconds(60))
+		g.Close()
+		assert.NotPanics(t, func() {
+			g.Set("lag", nil, 1)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// HistogramValue counts the observations made in a second by bucket. Counts[i] is the number of
+// observations no greater than the histogram's i-th bound and greater than the bound before it.
+// The last count is the observations greater than every bound.
+type HistogramValue struct {
+	Counts []int   `json:"counts"`
+	Sum    float64 `json:"sum"`
+}
+
+// Total returns the number of observations.
+func (v HistogramValue) Total() int {
+	total := 0
+	for _, count := range v.Counts {
+		total += count
+	}
+	return total
+}
+
+// Quantile estimates the value q of the observations are no greater than, for q between 0 and 1,
+// by interpolating within the bucket it falls in. The first bucket is assumed to start at zero,
+// and observations greater than every bound are estimated as the last bound.
+func (v HistogramValue) Quantile(bounds []float64, q float64) float64 {
+	total := v.Total()
+	if total == 0 || len(bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	seen := 0.0
+	for i, count := range v.Counts {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		if i == len(bounds) {
+			break
+		}
+		lower := min(0, bounds[0])
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		return lower + (bounds[i]-lower)*(rank-seen)/float64(count)
+	}
+	return bounds[len(bounds)-1]
+}
+
+type HistogramBuckets map[time.Time]HistogramValue
+
+// Histogram counts observations, like latencies or costs, in buckets bounded by the bounds it's
+// created with.
+type Histogram struct {
+	*store[float64, HistogramValue]
+	bounds []float64
+}
+
+// NewHistogram creates a histogram with a bucket for each of bounds, which must not be empty, and
+// one for observations greater than all of them.
+func NewHistogram(clk clock.Clock, retention Retention, bounds []float64) *Histogram {
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	return &Histogram{
+		store:  newStore[float64, HistogramValue]("Histogram", histogramAggregator{bounds: bounds}, clk, retention, nil),
+		bounds: bounds,
+	}
+}
+
+// Observe counts value in the series recorded under name and labels.
+func (h *Histogram) Observe(name string, labels Labels, value float64) {
+	h.record(name, labels, value)
+}
+
+// Bounds returns the upper bounds of the histogram's buckets, in increasing order.
+func (h *Histogram) Bounds() []float64 {
+	return slices.Clone(h.bounds)
+}
+
+// Data returns every series' buckets at the finest resolution keyed by [SeriesKey].
+func (h *Histogram) Data() map[string]HistogramBuckets {
+	return histogramData(h.selectSeries("", nil, 0))
+}
+
+func histogramData(series []storedSeries[HistogramValue]) map[string]HistogramBuckets {
+	data := make(map[string]HistogramBuckets, len(series))
+	for _, s := range series {
+		data[SeriesKey(s.name, s.labels)] = s.buckets
+	}
+	return data
+}
+
+type histogramAggregator struct {
+	bounds []float64
+}
+
+func (a histogramAggregator) add(b HistogramValue, ok bool, s float64) HistogramValue {
+	if !ok {
+		b.Counts = make([]int, len(a.bounds)+1)
+	}
+	// The bucket is the first whose bound is at least s, or the last if there isn't one.
+	b.Counts[sort.SearchFloat64s(a.bounds, s)]++
+	b.Sum += s
+	return b
+}
+
+func (a histogramAggregator) merge(earlier HistogramValue, later HistogramValue) HistogramValue {
+	merged := HistogramValue{Counts: slices.Clone(earlier.Counts), Sum: earlier.Sum + later.Sum}
+	for i, count := range later.Counts {
+		merged.Counts[i] += count
+	}
+	return merged
+}
+
+func (a histogramAggregator) fill(HistogramValue, bool) (HistogramValue, bool) {
+	return HistogramValue{Counts: make([]int, len(a.bounds)+1)}, true
+}
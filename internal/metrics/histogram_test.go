@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestHistogram(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+	bounds := []float64{1, 10, 100}
+
+	t.Run("counts observations in buckets each second", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		h := NewHistogram(clk, Seconds(60), []float64{100, 1, 10})
+		defer h.Close()
+		assert.Equal(t, bounds, h.Bounds())
+
+		for _, v := range []float64{0.5, 1, 5, 50, 500} {
+			h.Observe("latency-ms", nil, v)
+		}
+		h.flush()
+		clk.Advance(time.Second)
+		h.Observe("latency-ms", nil, 7)
+		h.flush()
+		clk.Advance(time.Second)
+
+		assert.Eventually(t, func() bool {
+			data := h.Data()["latency-ms"]
+			return data[start].Total() == 5 && data[start.Add(time.Second)].Total() == 1
+		}, time.Second, time.Millisecond)
+		data := h.Data()["latency-ms"]
+		assert.Equal(t, HistogramValue{Counts: []int{2, 1, 1, 1}, Sum: 556.5}, data[start])
+		assert.Equal(t, HistogramValue{Counts: []int{0, 1, 0, 0}, Sum: 7}, data[start.Add(time.Second)])
+	})
+
+	t.Run("estimates quantiles within buckets", func(t *testing.T) {
+		v := HistogramValue{Counts: []int{2, 2, 0, 0}}
+		assert.Equal(t, 0.5, v.Quantile(bounds, 0.25))
+		assert.Equal(t, 5.5, v.Quantile(bounds, 0.75))
+		assert.Equal(t, 10.0, v.Quantile(bounds, 1))
+
+		v = HistogramValue{Counts: []int{0, 0, 0, 4}}
+		assert.Equal(t, 100.0, v.Quantile(bounds, 0.5), "observations above every bound are estimated as the last bound")
+		assert.Zero(t, HistogramValue{Counts: []int{0, 0, 0, 0}}.Quantile(bounds, 0.5))
+	})
+}
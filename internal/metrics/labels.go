@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// Labels tell apart the series recorded under the same name, e.g. by customer and message type.
+type Labels map[string]string
+
+// SeriesKey returns the key a series is exported under: its name followed by its labels sorted by
+// label name, like `handled{customer="a",type="foo"}`. A series without labels is just its name.
+func SeriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := maps.Keys(labels)
+	slices.Sort(names)
+
+	sb := strings.Builder{}
+	sb.WriteString(name)
+	sb.WriteString("{")
+	for i, label := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(label)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(labels[label]))
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// A Series is the counts recorded under a name and set of labels.
+type Series struct {
+	Name    string
+	Labels  Labels
+	Buckets TimeBuckets
+}
+
+// matches reports whether a series recorded under name and labels is named want, or want is
+// empty, and has every label in match with the same value.
+func matches(name string, labels Labels, want string, match Labels) bool {
+	if want != "" && name != want {
+		return false
+	}
+	for label, value := range match {
+		if labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// An Aggregation combines the counts of several series in the same second.
+type Aggregation string
+
+const (
+	// Sum adds the series' counts together.
+	Sum Aggregation = "sum"
+
+	// Avg averages the series' counts, rounded to the nearest whole count.
+	Avg Aggregation = "avg"
+)
+
+// ParseAggregation returns the aggregation named s, defaulting to [Sum] when s is empty.
+func ParseAggregation(s string) (Aggregation, error) {
+	switch agg := Aggregation(s); agg {
+	case "":
+		return Sum, nil
+	case Sum, Avg:
+		return agg, nil
+	default:
+		return "", fmt.Errorf("unsupported aggregation %q", s)
+	}
+}
+
+// Aggregate groups series by name and the values of the by labels, and combines each group's
+// counts with agg. The groups are keyed by [SeriesKey] of the name and the by labels the group's
+// series have, so Aggregate(series, Sum, "customer") totals each customer's counts across message
+// types and Aggregate(series, Sum) totals each name across all of its labels.
+func Aggregate(series []Series, agg Aggregation, by ...string) map[string]TimeBuckets {
+	groups := map[string][]Series{}
+	for _, s := range series {
+		labels := Labels{}
+		for _, label := range by {
+			if value, ok := s.Labels[label]; ok {
+				labels[label] = value
+			}
+		}
+		key := SeriesKey(s.Name, labels)
+		groups[key] = append(groups[key], s)
+	}
+
+	data := make(map[string]TimeBuckets, len(groups))
+	for key, group := range groups {
+		sums := map[time.Time]int{}
+		members := map[time.Time]int{}
+		for _, s := range group {
+			for second, count := range s.Buckets {
+				sums[second] += count
+				members[second]++
+			}
+		}
+		buckets := make(TimeBuckets, len(sums))
+		for second, sum := range sums {
+			if agg == Avg {
+				buckets[second] = int(math.Round(float64(sum) / float64(members[second])))
+				continue
+			}
+			buckets[second] = sum
+		}
+		data[key] = buckets
+	}
+	return data
+}
+
+// LabelNames returns the names of the labels any of series have, sorted.
+func LabelNames(series []Series) []string {
+	names := map[string]struct{}{}
+	for _, s := range series {
+		for label := range s.Labels {
+			names[label] = struct{}{}
+		}
+	}
+	sorted := maps.Keys(names)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// A View is what a stats page shows: the series recorded under Name, or every series when it's
+// empty, grouped by the By labels and combined with Agg, over the last Range. A View without By
+// labels shows each series on its own, and a View without a Range shows everything kept at the
+// finest resolution.
+type View struct {
+	Name  string
+	By    []string
+	Agg   Aggregation
+	Range time.Duration
+}
+
+// ParseView reads a view from the stats pages' query parameters: name, by as comma separated
+// label names, agg, and range as a duration like `6h` or `7d`.
+func ParseView(query url.Values) (View, error) {
+	agg, err := ParseAggregation(query.Get("agg"))
+	if err != nil {
+		return View{}, err
+	}
+	v := View{Name: query.Get("name"), Agg: agg}
+	if s := query.Get("range"); s != "" {
+		if v.Range, err = ParseDuration(s); err != nil {
+			return View{}, fmt.Errorf("invalid range: %w", err)
+		}
+		if v.Range < 0 {
+			return View{}, fmt.Errorf("invalid range %q", s)
+		}
+	}
+	for _, label := range strings.Split(query.Get("by"), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			v.By = append(v.By, label)
+		}
+	}
+	return v, nil
+}
+
+// Apply returns the data v shows from series.
+func (v View) Apply(series []Series) map[string]TimeBuckets {
+	selected := make([]Series, 0, len(series))
+	for _, s := range series {
+		if matches(s.Name, s.Labels, v.Name, nil) {
+			selected = append(selected, s)
+		}
+	}
+	if len(v.By) == 0 {
+		data := make(map[string]TimeBuckets, len(selected))
+		for _, s := range selected {
+			data[SeriesKey(s.Name, s.Labels)] = s.Buckets
+		}
+		return data
+	}
+	return Aggregate(selected, v.Agg, v.By...)
+}
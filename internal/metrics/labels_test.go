@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestLabels(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("keys series by name and sorted labels", func(t *testing.T) {
+		assert.Equal(t, "delivered", SeriesKey("delivered", nil))
+		assert.Equal(t, `handled{customer="a",type="foo"}`, SeriesKey("handled", Labels{"type": "foo", "customer": "a"}))
+		assert.Equal(t, `pause-ms{partition="orders[0]"}`, SeriesKey("pause-ms", Labels{"partition": "orders[0]"}))
+	})
+
+	t.Run("selects series by name and labels", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Seconds(60))
+		defer c.Close()
+
+		c.Record("handled", Labels{"customer": "a", "type": "foo"}, 1)
+		c.Record("handled", Labels{"customer": "a", "type": "bar"}, 2)
+		c.Record("handled", Labels{"customer": "b", "type": "foo"}, 4)
+		c.Record("deferred", Labels{"customer": "a", "type": "foo"}, 8)
+		c.flush()
+		clk.Advance(time.Second)
+
+		require.Eventually(t, func() bool {
+			return len(c.Select("", nil)) == 4
+		}, time.Second, time.Millisecond)
+
+		assert.Len(t, c.Select("handled", nil), 3)
+		selected := c.Select("handled", Labels{"customer": "a"})
+		assert.Len(t, selected, 2)
+		assert.Equal(t, map[string]TimeBuckets{"handled": {start: 3}}, Aggregate(selected, Sum))
+		assert.Equal(t, []string{"customer", "type"}, LabelNames(c.Select("", nil)))
+		assert.Equal(t, 8, c.Data()[`deferred{customer="a",type="foo"}`][start])
+	})
+
+	t.Run("aggregates series grouped by labels", func(t *testing.T) {
+		series := []Series{
+			{Name: "handled", Labels: Labels{"customer": "a", "type": "foo"}, Buckets: TimeBuckets{start: 1}},
+			{Name: "handled", Labels: Labels{"customer": "a", "type": "bar"}, Buckets: TimeBuckets{start: 2}},
+			{Name: "handled", Labels: Labels{"customer": "b", "type": "foo"}, Buckets: TimeBuckets{start: 4}},
+			{Name: "delivered", Buckets: TimeBuckets{start: 16}},
+		}
+
+		assert.Equal(t, map[string]TimeBuckets{
+			`handled{customer="a"}`: {start: 3},
+			`handled{customer="b"}`: {start: 4},
+			"delivered":             {start: 16},
+		}, Aggregate(series, Sum, "customer"))
+
+		assert.Equal(t, map[string]TimeBuckets{
+			`handled{type="foo"}`: {start: 3},
+			`handled{type="bar"}`: {start: 2},
+			"delivered":           {start: 16},
+		}, Aggregate(series, Avg, "type"))
+	})
+
+	t.Run("parses views from query parameters", func(t *testing.T) {
+		v, err := ParseView(url.Values{"name": {"handled"}, "by": {"customer, type"}, "agg": {"avg"}})
+		require.NoError(t, err)
+		assert.Equal(t, View{Name: "handled", By: []string{"customer", "type"}, Agg: Avg}, v)
+
+		v, err = ParseView(url.Values{})
+		require.NoError(t, err)
+		assert.Equal(t, View{Agg: Sum}, v)
+
+		_, err = ParseView(url.Values{"agg": {"median"}})
+		assert.Error(t, err)
+	})
+}
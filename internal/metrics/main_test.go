@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestCount(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	// tick waits for every recorded measurement to be ingested and then advances the clock by a
+	// second so the next tick indexes them.
+	tick := func(c *Count, clk *clock.Manual) {
+		c.flush()
+		clk.Advance(time.Second)
+	}
+
+	t.Run("buckets measurements by the nearest second", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Seconds(60))
+		defer c.Close()
+
+		c.Record("a", nil, 1)
+		c.Record("a", nil, 2)
+		clk.Advance(1400 * time.Millisecond)
+		c.Record("a", nil, 4)
+		c.Record("b", nil, 8)
+		tick(c, clk)
+
+		assert.Eventually(t, func() bool {
+			data := c.Data()
+			return data["a"][start] == 3 &&
+				data["a"][start.Add(time.Second)] == 4 &&
+				data["b"][start.Add(time.Second)] == 8
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("fills seconds without measurements with zero", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Seconds(60))
+		defer c.Close()
+
+		c.Record("a", nil, 1)
+		tick(c, clk)
+		clk.Advance(3 * time.Second)
+
+		assert.Eventually(t, func() bool {
+			data := c.Data()
+			return data["a"][start] == 1 && len(data["a"]) == 4
+		}, time.Second, time.Millisecond)
+		count, ok := c.Data()["a"][start.Add(2*time.Second)]
+		assert.True(t, ok)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("expires measurements older than the retention period", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Seconds(5))
+		defer c.Close()
+
+		c.Record("a", nil, 1)
+		tick(c, clk)
+		assert.Eventually(t, func() bool {
+			return c.Data()["a"][start] == 1
+		}, time.Second, time.Millisecond)
+
+		for i := 0; i < 5; i++ {
+			tick(c, clk)
+		}
+		assert.Eventually(t, func() bool {
+			_, ok := c.Data()["a"][start]
+			return !ok
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("counts every value recorded by concurrent writers", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Seconds(60))
+		defer c.Close()
+
+		wg := sync.WaitGroup{}
+		for i := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				labels := Labels{"customer": strconv.Itoa(i % 2)}
+				for range 1000 {
+					c.Record("handled", labels, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		tick(c, clk)
+
+		assert.Eventually(t, func() bool {
+			data := c.Data()
+			return data[`handled{customer="0"}`][start] == 4000 && data[`handled{customer="1"}`][start] == 4000
+		}, time.Second, time.Millisecond)
+	})
+	t.Run("looks series up by their name and labels", func(t *testing.T) {
+		shards := newCountShards(clock.NewManual(start))
+		s := shards.lookup("handled", Labels{"customer": "a", "type": "foo"})
+		assert.Same(t, s, shards.lookup("handled", Labels{"type": "foo", "customer": "a"}))
+		assert.Equal(t, `handled{customer="a",type="foo"}`, s.key)
+		assert.NotSame(t, s, shards.lookup("handled", Labels{"customer": "foo", "type": "a"}))
+		assert.NotSame(t, s, shards.lookup("deferred", Labels{"customer": "a", "type": "foo"}))
+		assert.NotSame(t, s, shards.lookup("handled", Labels{"customer": "a"}))
+	})
+}
+
+// BenchmarkRecord compares recording counts into shards with recording them through the store's
+// channel, which is how counts used to be recorded, as the number of concurrent writers grows.
+// Each write builds its labels like the consumer does for every message.
+func BenchmarkRecord(b *testing.B) {
+	customers := []string{}
+	for i := range 16 {
+		customers = append(customers, strconv.Itoa(i))
+	}
+
+	for _, writers := range []int{1, 4, 16} {
+		for name, record := range map[string]func() (func(string, Labels, int), func()){
+			"sharded": func() (func(string, Labels, int), func()) {
+				c := NewCount(clock.Real{}, Seconds(60))
+				return c.Record, c.Close
+			},
+			"channel": func() (func(string, Labels, int), func()) {
+				s := newStore[int, int]("Count", countAggregator{}, clock.Real{}, Seconds(60), nil)
+				return s.record, s.Close
+			},
+		} {
+			b.Run(fmt.Sprintf("%s/writers=%d", name, writers), func(b *testing.B) {
+				record, stop := record()
+				defer stop()
+				b.SetParallelism(writers)
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						record("handled", Labels{"customer": customers[i%len(customers)], "type": "foo"}, 1)
+						i++
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// A Panel is a series drawn as SVG polylines in a 300x100 figure, one point per bucket. A count
+// is a single line; gauges and histograms draw a few.
+type Panel struct {
+	Lines []Line
+}
+
+// A Line is one of a panel's polylines. Label names it in the panel's legend when the panel has
+// more than one line.
+type Line struct {
+	Label  string
+	Points string
+}
+
+// Panels draws each key's buckets for the stats pages.
+func Panels(data map[string]TimeBuckets) map[string]Panel {
+	panels := make(map[string]Panel, len(data))
+	for key, buckets := range data {
+		values := make(map[time.Time]float64, len(buckets))
+		for second, count := range buckets {
+			values[second] = float64(count)
+		}
+		panels[key] = panel([]string{""}, []map[time.Time]float64{values})
+	}
+	return panels
+}
+
+// GaugePanels draws each key's lowest, last, and highest values for the stats pages.
+func GaugePanels(data map[string]GaugeBuckets) map[string]Panel {
+	panels := make(map[string]Panel, len(data))
+	for key, buckets := range data {
+		lines := []map[time.Time]float64{{}, {}, {}}
+		for second, v := range buckets {
+			lines[0][second] = v.Min
+			lines[1][second] = v.Last
+			lines[2][second] = v.Max
+		}
+		panels[key] = panel([]string{"min", "last", "max"}, lines)
+	}
+	return panels
+}
+
+// histogramQuantiles are the quantiles histogram panels draw.
+var histogramQuantiles = []float64{0.5, 0.9, 0.99}
+
+// HistogramPanels draws estimates of each key's median, 90th, and 99th percentiles for the stats
+// pages.
+func HistogramPanels(data map[string]HistogramBuckets, bounds []float64) map[string]Panel {
+	panels := make(map[string]Panel, len(data))
+	labels := []string{"p50", "p90", "p99"}
+	for key, buckets := range data {
+		lines := make([]map[time.Time]float64, len(histogramQuantiles))
+		for i, q := range histogramQuantiles {
+			lines[i] = make(map[time.Time]float64, len(buckets))
+			for second, v := range buckets {
+				lines[i][second] = v.Quantile(bounds, q)
+			}
+		}
+		panels[key] = panel(labels, lines)
+	}
+	return panels
+}
+
+// panel draws lines with a shared vertical scale.
+func panel(labels []string, lines []map[time.Time]float64) Panel {
+	max := 0.0
+	for _, values := range lines {
+		if len(values) > 0 {
+			max = slices.Max(append(maps.Values(values), max))
+		}
+	}
+
+	// HACK: I don't know how to make each panel the same height when they have different max
+	// values without affecting the scaling of other components in the panel (like the legend)
+	// so normalize the Y coordinates instead.
+	// Lines that are all zero sit at the bottom of the figure rather than dividing by zero.
+	if max == 0 {
+		max = 1
+	}
+	verticalScalingFactor := float64(100) / max
+
+	p := Panel{}
+	for i, values := range lines {
+		orderedBucketTimes := maps.Keys(values)
+		slices.SortFunc(orderedBucketTimes, func(a time.Time, b time.Time) int {
+			return a.Compare(b)
+		})
+
+		sb := strings.Builder{}
+		for j, k := range orderedBucketTimes {
+			// HACK: This right aligns the polyline by figuring out how much empty space there is
+			// (the difference between the figure width and the number of data points) and shifting
+			// the existing data points to the right that distance. Lines with more points than the
+			// figure is wide are squeezed to fit instead.
+			x := (300 - len(values)) + j
+			if len(values) > 300 {
+				x = j * 300 / len(values)
+			}
+
+			// HACK: SVG Y coordinates put y=0 at the top of the figure. This inverts our values to
+			// compensate.
+			y := max - values[k]
+
+			// HACK: Scale Y coordinate.
+			y = y * verticalScalingFactor
+
+			if sb.Len() > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(strconv.Itoa(x))
+			sb.WriteString(",")
+			sb.WriteString(strconv.Itoa(int(y)))
+		}
+		p.Lines = append(p.Lines, Line{Label: labels[i], Points: sb.String()})
+	}
+	return p
+}
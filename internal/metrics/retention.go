@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Tier keeps buckets of Resolution for Retention.
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Retention is the tiers a metric keeps its data in, from the finest resolution to the coarsest.
+// Every measurement is rolled up into each tier, so coarser tiers can keep data for longer without
+// keeping as many buckets.
+type Retention []Tier
+
+// DefaultRetention keeps one second buckets for 10 minutes, 10 second buckets for 6 hours, and
+// one minute buckets for 7 days.
+var DefaultRetention = Retention{
+	{Resolution: time.Second, Retention: 10 * time.Minute},
+	{Resolution: 10 * time.Second, Retention: 6 * time.Hour},
+	{Resolution: time.Minute, Retention: 7 * 24 * time.Hour},
+}
+
+// Seconds returns a retention that keeps n seconds of one second buckets.
+func Seconds(n int) Retention {
+	return Retention{{Resolution: time.Second, Retention: time.Duration(n) * time.Second}}
+}
+
+// ParseRetention parses a comma separated list of resolution:retention tiers, like
+// `1s:10m,10s:6h,1m:7d`, returning [DefaultRetention] when s is empty.
+func ParseRetention(s string) (Retention, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultRetention, nil
+	}
+	r := Retention{}
+	for _, tier := range strings.Split(s, ",") {
+		tier = strings.TrimSpace(tier)
+		if tier == "" {
+			continue
+		}
+		resolution, retention, ok := strings.Cut(tier, ":")
+		if !ok {
+			return nil, fmt.Errorf("tier %q must be resolution:retention", tier)
+		}
+		t := Tier{}
+		var err error
+		if t.Resolution, err = ParseDuration(resolution); err != nil {
+			return nil, fmt.Errorf("tier %q resolution: %w", tier, err)
+		}
+		if t.Retention, err = ParseDuration(retention); err != nil {
+			return nil, fmt.Errorf("tier %q retention: %w", tier, err)
+		}
+		r = append(r, t)
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Validate checks that r has at least one tier, that resolutions are whole seconds, and that each
+// tier has a coarser resolution and a longer retention than the one before it.
+func (r Retention) Validate() error {
+	if len(r) == 0 {
+		return errors.New("retention must have at least one tier")
+	}
+	for i, t := range r {
+		if t.Resolution < time.Second || t.Resolution%time.Second != 0 {
+			return fmt.Errorf("tier %d: resolution %v must be a whole number of seconds", i, t.Resolution)
+		}
+		if t.Retention < t.Resolution {
+			return fmt.Errorf("tier %d: retention %v is shorter than its resolution", i, t.Retention)
+		}
+		if i > 0 && (t.Resolution <= r[i-1].Resolution || t.Retention <= r[i-1].Retention) {
+			return fmt.Errorf("tier %d must have a coarser resolution and longer retention than tier %d", i, i-1)
+		}
+	}
+	return nil
+}
+
+// For returns the index of the finest tier that keeps span, or the coarsest tier if none of them
+// do. A span of zero picks the finest tier.
+func (r Retention) For(span time.Duration) int {
+	for i, t := range r {
+		if span <= t.Retention {
+			return i
+		}
+	}
+	return len(r) - 1
+}
+
+// Ranges returns how long each tier keeps data for, which are the ranges worth offering a choice
+// of.
+func (r Retention) Ranges() []time.Duration {
+	ranges := make([]time.Duration, 0, len(r))
+	for _, t := range r {
+		ranges = append(ranges, t.Retention)
+	}
+	return ranges
+}
+
+// longest returns how long the coarsest tier keeps data for.
+func (r Retention) longest() time.Duration {
+	return r[len(r)-1].Retention
+}
+
+// ParseDuration parses a duration like [time.ParseDuration] but also accepts a whole number of
+// days, like `7d`.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// FormatDuration formats d in the largest whole unit of days, hours, minutes, or seconds, like
+// `7d` or `10m`, which [ParseDuration] reads back. Zero is formatted as an empty string, which
+// [ParseView] reads as no range.
+func FormatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	for _, unit := range []struct {
+		size   time.Duration
+		suffix string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	} {
+		if d%unit.size == 0 {
+			return strconv.FormatInt(int64(d/unit.size), 10) + unit.suffix
+		}
+	}
+	return d.String()
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestRetention(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("parses tiers", func(t *testing.T) {
+		r, err := ParseRetention("1s:10m, 10s:6h, 1m:7d")
+		require.NoError(t, err)
+		assert.Equal(t, DefaultRetention, r)
+
+		r, err = ParseRetention("")
+		require.NoError(t, err)
+		assert.Equal(t, DefaultRetention, r)
+
+		for _, s := range []string{"1s", "1s:10m,1s:1h", "10s:10m,5s:1h", "1s:10m,10s:5m", "500ms:1m", "1s:1x"} {
+			_, err := ParseRetention(s)
+			assert.Error(t, err, s)
+		}
+	})
+
+	t.Run("picks the finest tier that keeps a range", func(t *testing.T) {
+		assert.Equal(t, 0, DefaultRetention.For(0))
+		assert.Equal(t, 0, DefaultRetention.For(10*time.Minute))
+		assert.Equal(t, 1, DefaultRetention.For(time.Hour))
+		assert.Equal(t, 2, DefaultRetention.For(24*time.Hour))
+		assert.Equal(t, 2, DefaultRetention.For(30*24*time.Hour))
+	})
+
+	t.Run("formats durations in whole units", func(t *testing.T) {
+		for s, d := range map[string]time.Duration{"7d": 7 * 24 * time.Hour, "6h": 6 * time.Hour, "90m": 90 * time.Minute, "10s": 10 * time.Second} {
+			assert.Equal(t, s, FormatDuration(d))
+			parsed, err := ParseDuration(s)
+			require.NoError(t, err)
+			assert.Equal(t, d, parsed)
+		}
+		assert.Equal(t, "", FormatDuration(0))
+	})
+
+	t.Run("rolls measurements up into coarser tiers", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		c := NewCount(clk, Retention{
+			{Resolution: time.Second, Retention: 10 * time.Second},
+			{Resolution: 10 * time.Second, Retention: time.Minute},
+		})
+		defer c.Close()
+
+		for range 25 {
+			c.Record("a", nil, 1)
+			c.flush()
+			clk.Advance(time.Second)
+		}
+
+		assert.Eventually(t, func() bool {
+			coarse := c.SelectRange("a", nil, time.Minute)
+			return len(coarse) == 1 && coarse[0].Buckets[start.Add(20*time.Second)] == 5
+		}, time.Second, time.Millisecond)
+
+		coarse := c.SelectRange("a", nil, time.Minute)[0].Buckets
+		assert.Equal(t, TimeBuckets{start: 10, start.Add(10 * time.Second): 10, start.Add(20 * time.Second): 5}, coarse)
+
+		fine := c.Select("a", nil)[0].Buckets
+		assert.Len(t, fine, 10, "the finest tier only keeps 10 seconds")
+		assert.NotContains(t, fine, start)
+
+		recent := c.SelectRange("a", nil, 5*time.Second)[0].Buckets
+		assert.Len(t, recent, 5)
+	})
+
+	t.Run("views read their range from the query", func(t *testing.T) {
+		v, err := ParseView(url.Values{"range": {"6h"}})
+		require.NoError(t, err)
+		assert.Equal(t, 6*time.Hour, v.Range)
+
+		_, err = ParseView(url.Values{"range": {"soon"}})
+		assert.Error(t, err)
+	})
+}
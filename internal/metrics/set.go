@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// A Set is the counts, gauges, and histograms a process records, which its stats page shows
+// together.
+type Set struct {
+	Counts     *Count
+	Gauges     *Gauge
+	Histograms *Histogram
+
+	// mu guards help, which describes metrics by name for exports.
+	mu   sync.Mutex
+	help map[string]string
+}
+
+// NewSet creates a set whose metrics keep their data for retention. Its histograms' buckets are
+// bounded by bounds.
+func NewSet(clk clock.Clock, retention Retention, bounds []float64) *Set {
+	return &Set{
+		Counts:     NewCount(clk, retention),
+		Gauges:     NewGauge(clk, retention),
+		Histograms: NewHistogram(clk, retention, bounds),
+		help:       map[string]string{},
+	}
+}
+
+// Describe sets the help text exported with the metric called name.
+func (s *Set) Describe(name string, help string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.help[name] = help
+}
+
+// Help returns the help text [Set.Describe] set for the metric called name, or name if it hasn't
+// been described.
+func (s *Set) Help(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if help, ok := s.help[name]; ok {
+		return help
+	}
+	return name
+}
+
+func (s *Set) Close() {
+	s.Counts.Close()
+	s.Gauges.Close()
+	s.Histograms.Close()
+}
+
+// Data returns what v shows keyed by [SeriesKey]: counts as v groups them, and the gauges and
+// histograms named v.Name, or all of them when it's empty, as they were recorded. The data covers
+// v.Range at the finest resolution that's kept for that long.
+func (s *Set) Data(v View) map[string]any {
+	data := map[string]any{}
+	for key, buckets := range v.Apply(s.Counts.SelectRange(v.Name, nil, v.Range)) {
+		data[key] = buckets
+	}
+	for key, buckets := range gaugeData(s.Gauges.selectSeries(v.Name, nil, v.Range)) {
+		data[key] = buckets
+	}
+	for key, buckets := range histogramData(s.Histograms.selectSeries(v.Name, nil, v.Range)) {
+		data[key] = buckets
+	}
+	return data
+}
+
+// Panels draws what v shows for the stats pages, as [Set.Data] selects it.
+func (s *Set) Panels(v View) map[string]Panel {
+	panels := Panels(v.Apply(s.Counts.SelectRange(v.Name, nil, v.Range)))
+	maps.Copy(panels, GaugePanels(gaugeData(s.Gauges.selectSeries(v.Name, nil, v.Range))))
+	maps.Copy(panels, HistogramPanels(histogramData(s.Histograms.selectSeries(v.Name, nil, v.Range)), s.Histograms.bounds))
+	return panels
+}
+
+// LabelNames returns the labels the counts v shows can be grouped by.
+func (s *Set) LabelNames(v View) []string {
+	return LabelNames(s.Counts.SelectRange(v.Name, nil, v.Range))
+}
+
+// Ranges returns the ranges the stats pages offer, formatted for their links: how long each of
+// s's resolutions is kept.
+func (s *Set) Ranges() []string {
+	ranges := []string{}
+	for _, d := range s.Counts.retention.Ranges() {
+		ranges = append(ranges, FormatDuration(d))
+	}
+	return ranges
+}
+
+// A Total is a series' cumulative value since its set was created.
+type Total[V any] struct {
+	Name   string
+	Labels Labels
+	Value  V
+}
+
+// Totals is everything recorded in a set, for exporting cumulative values: the sum of each count,
+// the latest value of each gauge, and every observation in each histogram.
+type Totals struct {
+	// Start is when the set was created, which the totals accumulate from.
+	Start      time.Time
+	Counts     []Total[int]
+	Gauges     []Total[float64]
+	Histograms []Total[HistogramValue]
+
+	// Bounds are the upper bounds of the histograms' buckets.
+	Bounds []float64
+}
+
+// Totals returns everything recorded in s since it was created, sorted by [SeriesKey].
+func (s *Set) Totals() Totals {
+	totals := Totals{Start: s.Counts.startTime, Bounds: s.Histograms.Bounds()}
+	for _, t := range s.Counts.totalSeries() {
+		totals.Counts = append(totals.Counts, Total[int]{Name: t.name, Labels: t.labels, Value: t.total})
+	}
+	for _, t := range s.Gauges.totalSeries() {
+		totals.Gauges = append(totals.Gauges, Total[float64]{Name: t.name, Labels: t.labels, Value: t.total.Last})
+	}
+	for _, t := range s.Histograms.totalSeries() {
+		totals.Histograms = append(totals.Histograms, Total[HistogramValue]{Name: t.name, Labels: t.labels, Value: t.total})
+	}
+	sortTotals(totals.Counts)
+	sortTotals(totals.Gauges)
+	sortTotals(totals.Histograms)
+	return totals
+}
+
+// sortTotals sorts totals by [SeriesKey] so they're exported in a stable order.
+func sortTotals[V any](totals []Total[V]) {
+	slices.SortFunc(totals, func(a Total[V], b Total[V]) int {
+		return strings.Compare(SeriesKey(a.Name, a.Labels), SeriesKey(b.Name, b.Labels))
+	})
+}
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// countShards sums the values recorded for each series in each second with atomic counters
+// spread over as many shards as there are CPUs, so concurrent writers don't queue behind a
+// channel or a lock. The store's run loop collects the sums on every tick.
+type countShards struct {
+	clock  clock.Clock
+	shards []countShard
+	mask   uint32
+
+	// series finds a series' key from its name and labels by their hash, so recording to a series
+	// that's been recorded to before doesn't sort its labels or copy them. Series are only added
+	// under seriesMu, and like the store's series they're never removed.
+	seed     maphash.Seed
+	series   sync.Map
+	seriesMu sync.Mutex
+
+	// retired are cells removed from their shard on the last collection. A writer that looked a
+	// cell up just before it was removed can still add to it, so retired cells are collected once
+	// more before they're dropped.
+	retired []*countCell
+}
+
+// A countShard holds a cell per series and second in a sync.Map, which finds cells that already
+// exist without locking once they've been read a few times.
+type countShard struct {
+	cells sync.Map
+	// Pad shards onto separate cache lines so writers on different CPUs don't contend.
+	_ [64]byte
+}
+
+type cellKey struct {
+	series *countSeries
+	second int64
+}
+
+type countCell struct {
+	n atomic.Int64
+	// Pad the counter onto its own cache line so writers to neighbouring cells don't contend.
+	_      [56]byte
+	series *countSeries
+	second time.Time
+}
+
+// A countSeries is a series that's been recorded to, and the next series whose name and labels
+// have the same hash.
+type countSeries struct {
+	key    string
+	name   string
+	labels Labels
+	next   *countSeries
+}
+
+func (s *countSeries) is(name string, labels Labels) bool {
+	if s.name != name || len(s.labels) != len(labels) {
+		return false
+	}
+	for label, value := range labels {
+		if v, ok := s.labels[label]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func newCountShards(clk clock.Clock) *countShards {
+	// A power of two number of shards picks a shard with a mask instead of a division.
+	n := 1 << bits.Len(uint(runtime.GOMAXPROCS(0)-1))
+	return &countShards{
+		clock:  clk,
+		shards: make([]countShard, n),
+		mask:   uint32(n - 1),
+		seed:   maphash.MakeSeed(),
+	}
+}
+
+// lookup returns the series recorded under name and labels, adding it if it hasn't been recorded
+// to before.
+func (c *countShards) lookup(name string, labels Labels) *countSeries {
+	// Labels are hashed in whatever order they're ranged over, so they're combined with a sum
+	// that doesn't depend on the order.
+	h := maphash.String(c.seed, name)
+	for label, value := range labels {
+		h += maphash.String(c.seed, label) * (maphash.String(c.seed, value) | 1)
+	}
+
+	if v, ok := c.series.Load(h); ok {
+		for s := v.(*countSeries); s != nil; s = s.next {
+			if s.is(name, labels) {
+				return s
+			}
+		}
+	}
+
+	c.seriesMu.Lock()
+	defer c.seriesMu.Unlock()
+	var head *countSeries
+	if v, ok := c.series.Load(h); ok {
+		head = v.(*countSeries)
+	}
+	for s := head; s != nil; s = s.next {
+		if s.is(name, labels) {
+			return s
+		}
+	}
+	s := &countSeries{key: SeriesKey(name, labels), name: name, labels: maps.Clone(labels), next: head}
+	c.series.Store(h, s)
+	return s
+}
+
+// add adds value to the series recorded under name and labels in the current second. Writers pick
+// a shard at random, so even a single busy series is spread across the shards.
+func (c *countShards) add(name string, labels Labels, value int) {
+	// NOTE: Like the other metrics, measurements are clustered around the second to whose start
+	// they're closest.
+	second := c.clock.Now().Round(time.Second)
+	k := cellKey{series: c.lookup(name, labels), second: second.Unix()}
+	shard := &c.shards[rand.Uint32()&c.mask]
+
+	v, ok := shard.cells.Load(k)
+	if !ok {
+		v, _ = shard.cells.LoadOrStore(k, &countCell{series: k.series, second: second})
+	}
+	v.(*countCell).n.Add(int64(value))
+}
+
+// collect returns the sums added since the last collection as measurements, and removes cells for
+// seconds that are unlikely to be added to again. It must only be called from one goroutine.
+func (c *countShards) collect() []measurement[int] {
+	ms := []measurement[int]{}
+	take := func(cell *countCell) {
+		if n := cell.n.Swap(0); n != 0 {
+			ms = append(ms, measurement[int]{
+				key:    cell.series.key,
+				name:   cell.series.name,
+				labels: cell.series.labels,
+				value:  int(n),
+				second: cell.second,
+			})
+		}
+	}
+
+	for _, cell := range c.retired {
+		take(cell)
+	}
+	c.retired = c.retired[:0]
+
+	// Rounding puts measurements up to half a second in the future, so cells for the last couple of
+	// seconds are kept for the writers that are still adding to them.
+	cutoff := c.clock.Now().Add(-2 * time.Second)
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.cells.Range(func(k any, v any) bool {
+			cell := v.(*countCell)
+			take(cell)
+			if cell.second.Before(cutoff) {
+				shard.cells.Delete(k)
+				c.retired = append(c.retired, cell)
+			}
+			return true
+		})
+	}
+	return ms
+}
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// snapshotVersion is the version of the snapshot format WriteSnapshot writes. ReadSnapshot
+// rejects other versions rather than guessing at them.
+const snapshotVersion = 1
+
+// A snapshot is the buckets a set keeps, in the JSON written to snapshot files. The totals aren't
+// included since they accumulate from when the process started.
+type snapshot struct {
+	Version    int                              `json:"version"`
+	Taken      time.Time                        `json:"taken"`
+	Counts     []seriesSnapshot[int]            `json:"counts"`
+	Gauges     []seriesSnapshot[GaugeValue]     `json:"gauges"`
+	Histograms []seriesSnapshot[HistogramValue] `json:"histograms"`
+	Bounds     []float64                        `json:"bounds"`
+}
+
+type seriesSnapshot[B any] struct {
+	Name   string            `json:"name"`
+	Labels Labels            `json:"labels,omitempty"`
+	Tiers  []tierSnapshot[B] `json:"tiers"`
+}
+
+// A tierSnapshot is a series' buckets at Resolution, formatted by [FormatDuration].
+type tierSnapshot[B any] struct {
+	Resolution string          `json:"resolution"`
+	Buckets    map[time.Time]B `json:"buckets"`
+}
+
+// WriteSnapshot writes the buckets every series in s keeps as JSON.
+func (s *Set) WriteSnapshot(w io.Writer) error {
+	snap := snapshot{
+		Version:    snapshotVersion,
+		Taken:      s.Counts.clock.Now(),
+		Counts:     s.Counts.snapshot(),
+		Gauges:     s.Gauges.snapshot(),
+		Histograms: s.Histograms.snapshot(),
+		Bounds:     s.Histograms.Bounds(),
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// ReadSnapshot restores the buckets in a snapshot written by [Set.WriteSnapshot] into s, merging
+// them with anything s has already recorded. Buckets older than s's retention are discarded, as
+// are tiers whose resolution s doesn't keep and histograms recorded with different bounds.
+func (s *Set) ReadSnapshot(r io.Reader) error {
+	snap := snapshot{}
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	s.Counts.restore(snap.Counts)
+	s.Gauges.restore(snap.Gauges)
+	if slices.Equal(snap.Bounds, s.Histograms.bounds) {
+		s.Histograms.restore(snap.Histograms)
+	} else if len(snap.Histograms) > 0 {
+		fmt.Printf("warn: discarding snapshot histograms recorded with bounds %v instead of %v\n", snap.Bounds, s.Histograms.bounds)
+	}
+	return nil
+}
+
+// SaveSnapshot writes a snapshot of s to path. The snapshot is written to a temporary file that
+// replaces path when it's complete, so a crash while saving leaves the previous snapshot intact.
+func (s *Set) SaveSnapshot(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err := s.WriteSnapshot(f); err != nil {
+		f.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot restores the snapshot at path into s. A missing snapshot restores nothing and
+// isn't an error, so the first run with a new path starts empty.
+func (s *Set) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot: %w", err)
+	}
+	defer f.Close()
+	return s.ReadSnapshot(f)
+}
+
+// SnapshotEvery saves a snapshot of s to path every interval until ctx is cancelled.
+func (s *Set) SnapshotEvery(ctx context.Context, clk clock.Clock, path string, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+		if err := s.SaveSnapshot(path); err != nil {
+			fmt.Printf("error: save metrics snapshot: %v\n", err)
+		}
+	}
+}
+
+// snapshot returns copies of the buckets each series has in each tier.
+func (s *store[S, B]) snapshot() []seriesSnapshot[B] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	series := make([]seriesSnapshot[B], 0, len(s.series))
+	for key, id := range s.series {
+		snap := seriesSnapshot[B]{Name: id.name, Labels: id.labels}
+		for _, tier := range s.tiers {
+			buckets := make(map[time.Time]B, len(tier.data[key]))
+			for start, bucket := range tier.data[key] {
+				buckets[start] = bucket
+			}
+			snap.Tiers = append(snap.Tiers, tierSnapshot[B]{Resolution: FormatDuration(tier.Resolution), Buckets: buckets})
+		}
+		series = append(series, snap)
+	}
+	return series
+}
+
+// restore merges series into the store's tiers as if their buckets were recorded before anything
+// the store already has.
+func (s *store[S, B]) restore(series []seriesSnapshot[B]) {
+	// Decoded times are in UTC or a fixed zone, so they're converted to the clock's location to
+	// key the same buckets as recorded times.
+	loc := s.clock.Now().Location()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateRetentionThreshold()
+	for _, snap := range series {
+		key := SeriesKey(snap.Name, snap.Labels)
+		for _, ts := range snap.Tiers {
+			resolution, err := ParseDuration(ts.Resolution)
+			if err != nil {
+				continue
+			}
+			i := slices.IndexFunc(s.tiers, func(t *tier[B]) bool { return t.Resolution == resolution })
+			if i < 0 {
+				continue
+			}
+			tier := s.tiers[i]
+			for start, bucket := range ts.Buckets {
+				start = start.In(loc)
+				if !start.Add(tier.Resolution).After(tier.threshold) {
+					continue
+				}
+				if _, ok := s.series[key]; !ok {
+					s.series[key] = seriesID{name: snap.Name, labels: snap.Labels}
+				}
+				element, ok := tier.data[key]
+				if !ok {
+					element = map[time.Time]B{}
+					tier.data[key] = element
+				}
+				if later, ok := element[start]; ok {
+					bucket = s.agg.merge(bucket, later)
+				}
+				element[start] = bucket
+				if start.Before(s.dataStart) {
+					s.dataStart = start
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestSnapshot(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+	retention := Retention{
+		{Resolution: time.Second, Retention: time.Minute},
+		{Resolution: 10 * time.Second, Retention: time.Hour},
+	}
+
+	// record records a measurement of each kind in a new set and waits for them to be indexed.
+	record := func(t *testing.T, bounds []float64) (*Set, *clock.Manual) {
+		clk := clock.NewManual(start)
+		s := NewSet(clk, retention, bounds)
+		t.Cleanup(s.Close)
+
+		s.Counts.Record("handled", Labels{"customer": "a"}, 3)
+		s.Gauges.Set("lag", nil, 7)
+		s.Histograms.Observe("deferrals", nil, 2)
+		s.Counts.flush()
+		s.Gauges.flush()
+		s.Histograms.flush()
+		clk.Advance(time.Second)
+		require.Eventually(t, func() bool {
+			return len(s.Counts.Data()) == 1 && len(s.Gauges.Data()) == 1 && len(s.Histograms.Data()) == 1
+		}, time.Second, time.Millisecond)
+		return s, clk
+	}
+
+	t.Run("restores series after a restart", func(t *testing.T) {
+		s, _ := record(t, []float64{1, 5})
+		path := filepath.Join(t.TempDir(), "metrics.json")
+		require.NoError(t, s.SaveSnapshot(path))
+
+		restarted := NewSet(clock.NewManual(start.Add(30*time.Second)), retention, []float64{1, 5})
+		defer restarted.Close()
+		require.NoError(t, restarted.LoadSnapshot(path))
+
+		counts := restarted.Counts.Data()[`handled{customer="a"}`]
+		assert.Equal(t, 3, counts[start])
+		assert.Equal(t, 0, counts[start.Add(10*time.Second)], "the restart's downtime is charted as empty")
+		assert.Equal(t, 7.0, restarted.Gauges.Data()["lag"][start].Last)
+		assert.Equal(t, 1, restarted.Histograms.Data()["deferrals"][start].Counts[1])
+		assert.Equal(t, 3, restarted.Counts.SelectRange("handled", nil, time.Hour)[0].Buckets[start])
+		assert.Empty(t, restarted.Totals().Counts, "totals start from the restart")
+	})
+
+	t.Run("discards data older than the retention period", func(t *testing.T) {
+		s, _ := record(t, []float64{1, 5})
+		path := filepath.Join(t.TempDir(), "metrics.json")
+		require.NoError(t, s.SaveSnapshot(path))
+
+		restarted := NewSet(clock.NewManual(start.Add(10*time.Minute)), retention, []float64{1, 5})
+		defer restarted.Close()
+		require.NoError(t, restarted.LoadSnapshot(path))
+
+		assert.NotContains(t, restarted.Counts.Data()[`handled{customer="a"}`], start)
+		assert.Equal(t, 3, restarted.Counts.SelectRange("handled", nil, time.Hour)[0].Buckets[start])
+	})
+
+	t.Run("discards histograms with different bounds", func(t *testing.T) {
+		s, _ := record(t, []float64{1, 5})
+		path := filepath.Join(t.TempDir(), "metrics.json")
+		require.NoError(t, s.SaveSnapshot(path))
+
+		restarted := NewSet(clock.NewManual(start.Add(time.Second)), retention, []float64{1, 10})
+		defer restarted.Close()
+		require.NoError(t, restarted.LoadSnapshot(path))
+		assert.Empty(t, restarted.Histograms.Data())
+		assert.Len(t, restarted.Counts.Data(), 1)
+	})
+
+	t.Run("restores while measurements are being recorded", func(t *testing.T) {
+		s, _ := record(t, []float64{1, 5})
+		path := filepath.Join(t.TempDir(), "metrics.json")
+		require.NoError(t, s.SaveSnapshot(path))
+
+		restarted := NewSet(clock.NewManual(start.Add(time.Second)), retention, []float64{1, 5})
+		defer restarted.Close()
+		recording, restored, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(done)
+			restarted.Gauges.Set("lag", nil, 1)
+			close(recording)
+			for {
+				select {
+				case <-restored:
+					return
+				default:
+					restarted.Gauges.Set("lag", nil, 1)
+				}
+			}
+		}()
+		<-recording
+		require.NoError(t, restarted.LoadSnapshot(path))
+		close(restored)
+		<-done
+		assert.Equal(t, 3, restarted.Counts.Data()[`handled{customer="a"}`][start])
+	})
+
+	t.Run("a missing snapshot restores nothing", func(t *testing.T) {
+		s := NewSet(clock.NewManual(start), retention, []float64{1})
+		defer s.Close()
+		require.NoError(t, s.LoadSnapshot(filepath.Join(t.TempDir(), "missing.json")))
+		assert.Empty(t, s.Counts.Data())
+	})
+}
@@ -0,0 +1,422 @@
+package metrics
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// An aggregator summarizes the samples of type S recorded in a second as a bucket of type B.
+type aggregator[S any, B any] interface {
+	// add folds s into a second's bucket b. ok is false when s is the second's first sample and b
+	// is the zero value.
+	add(b B, ok bool, s S) B
+
+	// merge combines a second's earlier bucket with a later one. It mustn't modify either of them
+	// since earlier may have been exported.
+	merge(earlier B, later B) B
+
+	// fill returns the bucket for a second that doesn't have one, given the previous second's
+	// bucket if ok, or false to leave the second empty.
+	fill(prev B, ok bool) (B, bool)
+}
+
+// store buckets the samples recorded for each series by second, rolls the seconds up into each of
+// its retention's tiers, and keeps each tier's buckets for the tier's retention period. It's the
+// part of [Count], [Gauge], and [Histogram] that doesn't depend on what they record.
+type store[S any, B any] struct {
+	name      string
+	agg       aggregator[S, B]
+	clock     clock.Clock
+	startTime time.Time
+	// dataStart is the earliest time the store has data for. It's startTime unless a snapshot was
+	// restored, which doesn't change when the totals accumulate from.
+	dataStart    time.Time
+	retention    Retention
+	measurements chan measurement[S]
+	// collect returns measurements recorded without going through measurements. It's nil for
+	// stores that only use the channel.
+	collect func() []measurement[S]
+	// retentionThreshold is the coarsest tier's threshold; measurements older than it aren't kept
+	// by any tier. It's guarded by mu since restoring a snapshot updates it.
+	retentionThreshold time.Time
+	ingestionMap       map[time.Time]map[string]B
+	tiers              []*tier[B]
+	totals             map[string]B
+	series             map[string]seriesID
+	// flushes asks the run loop to ingest everything recorded so far, and is closed once it has.
+	flushes chan chan struct{}
+	closed  chan struct{}
+	mu      sync.Mutex
+}
+
+// A tier is the buckets a store keeps at one of its retention's resolutions.
+type tier[B any] struct {
+	Tier
+	threshold time.Time
+	data      map[string]map[time.Time]B
+}
+
+// newStore starts a store whose run loop ingests samples until it's closed. name is the type
+// using the store, for logging. retention must be valid. If collect isn't nil the run loop ingests
+// what it returns on every tick, for types that record without the store's channel.
+func newStore[S any, B any](
+	name string,
+	agg aggregator[S, B],
+	clk clock.Clock,
+	retention Retention,
+	collect func() []measurement[S],
+) *store[S, B] {
+	if err := retention.Validate(); err != nil {
+		panic(fmt.Errorf("invalid %s retention: %w", name, err))
+	}
+	tiers := make([]*tier[B], 0, len(retention))
+	for _, t := range retention {
+		tiers = append(tiers, &tier[B]{Tier: t, data: map[string]map[time.Time]B{}})
+	}
+	// Large buffer to absorb writes while reading. This could still block if we record metrics
+	// faster than we can ingest them.
+	buffer := 100000
+	if collect != nil {
+		buffer = 0
+	}
+	s := &store[S, B]{
+		name:         name,
+		agg:          agg,
+		clock:        clk,
+		startTime:    clk.Now().Round(time.Second),
+		dataStart:    clk.Now().Round(time.Second),
+		retention:    retention,
+		measurements: make(chan measurement[S], buffer),
+		collect:      collect,
+		ingestionMap: map[time.Time]map[string]B{},
+		tiers:        tiers,
+		totals:       map[string]B{},
+		series:       map[string]seriesID{},
+		flushes:      make(chan chan struct{}),
+		closed:       make(chan struct{}),
+		mu:           sync.Mutex{},
+	}
+
+	// The ticker is created before the run loop starts so measurements recorded as soon as the
+	// store is created are collected on the first tick.
+	go s.run(clk.NewTicker(time.Second))
+
+	return s
+}
+
+// record sends a measurement to the run loop. Measurements recorded after the store is closed are
+// dropped.
+func (s *store[S, B]) record(name string, labels Labels, value S) {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+
+	m := measurement[S]{
+		key:    SeriesKey(name, labels),
+		name:   name,
+		labels: maps.Clone(labels),
+		value:  value,
+		// NOTE: The Round() function rounds to the nearest increment so the actual value of second
+		// may be in the future. This shouldn't matter, it just means we're clustering measurements
+		// around the second to whose start they're the closest instead of in the second within
+		// which they occurred.
+		second: s.clock.Now().Round(time.Second),
+	}
+
+	start := time.Now()
+
+	select {
+	case s.measurements <- m:
+		return
+	default:
+	}
+
+	select {
+	case s.measurements <- m:
+	case <-s.closed:
+		return
+	}
+	blockedFor := time.Since(start)
+	fmt.Printf("warn: %s#Record blocked for %v\n", s.name, blockedFor)
+}
+
+// storedSeries is a copy of the buckets recorded for a series.
+type storedSeries[B any] struct {
+	name    string
+	labels  Labels
+	buckets map[time.Time]B
+}
+
+// selectSeries returns copies of the series recorded under name whose labels include every label
+// in match, or the series recorded under any name if name is empty, covering the last span. The
+// buckets come from the finest tier that keeps span, and are keyed by the time they start. A span
+// of zero returns everything the finest tier keeps.
+func (s *store[S, B]) selectSeries(name string, match Labels, span time.Duration) []storedSeries[B] {
+	tier := s.tiers[s.retention.For(span)]
+	series, threshold, dataStart := func() ([]storedSeries[B], time.Time, time.Time) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		series := make([]storedSeries[B], 0, len(tier.data))
+		for key, element := range tier.data {
+			id := s.series[key]
+			if !matches(id.name, id.labels, name, match) {
+				continue
+			}
+			buckets := make(map[time.Time]B, len(element))
+			for start, bucket := range element {
+				buckets[start] = bucket
+			}
+			series = append(series, storedSeries[B]{name: id.name, labels: id.labels, buckets: buckets})
+		}
+		return series, tier.threshold, s.dataStart
+	}()
+
+	// Populate the exported data for any time within the retention period where we have no data.
+	now := s.clock.Now()
+	earliest := threshold
+	if dataStart.After(earliest) {
+		earliest = dataStart
+	}
+	if from := now.Add(-span); span > 0 && from.After(earliest) {
+		earliest = from
+	}
+	for _, series := range series {
+		for start := range series.buckets {
+			if !start.Add(tier.Resolution).After(earliest) {
+				delete(series.buckets, start)
+			}
+		}
+		var prev B
+		hasPrev := false
+		for t := earliest.Truncate(tier.Resolution); t.Before(now); t = t.Add(tier.Resolution) {
+			if bucket, ok := series.buckets[t]; ok {
+				prev, hasPrev = bucket, true
+				continue
+			}
+			if bucket, ok := s.agg.fill(prev, hasPrev); ok {
+				series.buckets[t] = bucket
+				prev, hasPrev = bucket, true
+			}
+		}
+	}
+
+	return series
+}
+
+// storedTotal is a series' buckets merged since the store was created.
+type storedTotal[B any] struct {
+	name   string
+	labels Labels
+	total  B
+}
+
+// totalSeries returns every series' buckets merged since the store was created, regardless of
+// the retention period, for exporting cumulative values.
+func (s *store[S, B]) totalSeries() []storedTotal[B] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make([]storedTotal[B], 0, len(s.totals))
+	for key, total := range s.totals {
+		id := s.series[key]
+		totals = append(totals, storedTotal[B]{name: id.name, labels: id.labels, total: total})
+	}
+	return totals
+}
+
+// Close stops the run loop. The measurements channel is left open so goroutines that record
+// while the store is closing don't send on a closed channel.
+func (s *store[S, B]) Close() {
+	defer close(s.closed)
+	s.closed <- struct{}{}
+}
+
+// updateRetentionThreshold must be called with s.mu held since selectSeries reads the thresholds.
+func (s *store[S, B]) updateRetentionThreshold() {
+	now := s.clock.Now()
+	for _, tier := range s.tiers {
+		tier.threshold = now.Add(-tier.Retention)
+	}
+	s.retentionThreshold = now.Add(-s.retention.longest())
+}
+
+func (s *store[S, B]) run(ticker clock.Ticker) {
+
+	func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.updateRetentionThreshold()
+	}()
+
+	collect := func() {
+		if s.collect != nil {
+			for _, m := range s.collect() {
+				s.ingestMeasurement(m)
+			}
+		}
+	}
+
+	onTick := func() {
+		collect()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.updateRetentionThreshold()
+		s.indexMeasurements()
+		s.expireOldData()
+	}
+
+	defer ticker.Stop()
+
+	for {
+		// Concurrent map writes cause panics so we need to syncronize ingestion, indexing, and
+		// expiration. The first select handles either: ingestion, indexing and expiration, or
+		// closure, depending on the available signals and blocks until one is available. The
+		// select does a non-blocking read for an indexing and expiration or a closure signal. When
+		// multiple signals in a select are both available without blocking the control flow is
+		// chosen arbitrarily, meaning that a series of buffered measurements could cause a delay
+		// processing the index/expire or close signals. It's unlikely that a significant delay
+		// would occur since the select would be re-evaluated after each ingested message and the
+		// probabilty of selecting ingest `n` times in a row decreass as `n` increases; but this
+		// approach ensures we never delay an index/expire or close for more than a single ingest.
+
+		select {
+		case m := <-s.measurements:
+			s.ingestMeasurement(m)
+		case <-ticker.C():
+			onTick()
+		case done := <-s.flushes:
+			for len(s.measurements) > 0 {
+				s.ingestMeasurement(<-s.measurements)
+			}
+			collect()
+			close(done)
+		case <-s.closed:
+			return
+		}
+
+		select {
+		case <-ticker.C():
+			onTick()
+		case <-s.closed:
+			return
+		default:
+		}
+	}
+}
+
+// flush returns once everything recorded before it was called has been ingested, so it's indexed
+// on the next tick.
+func (s *store[S, B]) flush() {
+	done := make(chan struct{})
+	select {
+	case s.flushes <- done:
+		<-done
+	case <-s.closed:
+	}
+}
+
+func (s *store[S, B]) ingestMeasurement(m measurement[S]) {
+	// Restoring a snapshot updates the retention threshold and adds series too, so they're checked
+	// while holding s.mu.
+	s.mu.Lock()
+	// Don't bother ingesting a measurement that's already older than our retention period.
+	if m.second.Before(s.retentionThreshold) {
+		s.mu.Unlock()
+		return
+	}
+	if _, ok := s.series[m.key]; !ok {
+		s.series[m.key] = seriesID{name: m.name, labels: m.labels}
+	}
+	s.mu.Unlock()
+
+	bucketsByKey, ok := s.ingestionMap[m.second]
+	if !ok {
+		bucketsByKey = map[string]B{}
+		s.ingestionMap[m.second] = bucketsByKey
+	}
+	bucket, ok := bucketsByKey[m.key]
+	bucketsByKey[m.key] = s.agg.add(bucket, ok, m.value)
+}
+
+func (s *store[S, B]) indexMeasurements() {
+	// Index the seconds in order so the totals merge earlier buckets before later ones.
+	seconds := maps.Keys(s.ingestionMap)
+	slices.SortFunc(seconds, func(a time.Time, b time.Time) int {
+		return a.Compare(b)
+	})
+	for _, second := range seconds {
+		bucketsByKey := s.ingestionMap[second]
+		for key, bucket := range bucketsByKey {
+			if total, ok := s.totals[key]; ok {
+				s.totals[key] = s.agg.merge(total, bucket)
+			} else {
+				s.totals[key] = bucket
+			}
+
+			for _, tier := range s.tiers {
+				tier.rollUp(s.agg.merge, key, second, bucket)
+			}
+		}
+		// Drop the ingested buckets so we don't re-index the same measurements again. Anything
+		// recorded for the second later starts a new bucket that's merged in on the next tick.
+		delete(s.ingestionMap, second)
+	}
+}
+
+func (s *store[S, B]) expireOldData() {
+	for _, tier := range s.tiers {
+		tier.expire()
+	}
+}
+
+// rollUp merges a second's bucket for key into the tier's bucket for the interval containing it,
+// unless the interval has already expired. Seconds must be rolled up in order for merge to see the
+// earlier bucket first.
+func (t *tier[B]) rollUp(merge func(earlier B, later B) B, key string, second time.Time, bucket B) {
+	start := second.Truncate(t.Resolution)
+	if !start.Add(t.Resolution).After(t.threshold) {
+		return
+	}
+	element, ok := t.data[key]
+	if !ok {
+		element = map[time.Time]B{}
+		t.data[key] = element
+	}
+	if earlier, ok := element[start]; ok {
+		bucket = merge(earlier, bucket)
+	}
+	element[start] = bucket
+}
+
+// expire drops the buckets whose whole interval is older than the tier's retention period.
+func (t *tier[B]) expire() {
+	for _, timeBuckets := range t.data {
+		for _, start := range maps.Keys(timeBuckets) {
+			if start.Add(t.Resolution).After(t.threshold) {
+				continue
+			}
+			delete(timeBuckets, start)
+		}
+	}
+}
+
+// A seriesID is the name and labels a series' key was made from.
+type seriesID struct {
+	name   string
+	labels Labels
+}
+
+type measurement[S any] struct {
+	key    string
+	name   string
+	labels Labels
+	value  S
+	second time.Time
+}
@@ -0,0 +1,261 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
+)
+
+// The types below are the parts of OTLP's protobuf messages the exporter uses, in their JSON
+// encoding: fields are lowerCamelCase, 64-bit integers are strings, and trace and span IDs are
+// hex rather than base64.
+
+type tracesRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+// statusCodeError is OTLP's STATUS_CODE_ERROR.
+const statusCodeError = 2
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type metricsRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type metric struct {
+	Name      string     `json:"name"`
+	Sum       *sum       `json:"sum,omitempty"`
+	Gauge     *gauge     `json:"gauge,omitempty"`
+	Histogram *histogram `json:"histogram,omitempty"`
+}
+
+// aggregationTemporalityCumulative is OTLP's AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+type sum struct {
+	DataPoints             []numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type gauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type histogram struct {
+	DataPoints             []histogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsInt             *string    `json:"asInt,omitempty"`
+	AsDouble          *float64   `json:"asDouble,omitempty"`
+}
+
+type histogramDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	Count             string     `json:"count"`
+	Sum               float64    `json:"sum"`
+	BucketCounts      []string   `json:"bucketCounts"`
+	ExplicitBounds    []float64  `json:"explicitBounds"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// attributes converts attrs sorted by key. Values of unsupported types are exported as strings.
+func attributes(attrs tracing.Attributes) []keyValue {
+	keys := maps.Keys(attrs)
+	slices.Sort(keys)
+	kvs := make([]keyValue, 0, len(keys))
+	for _, key := range keys {
+		kv := keyValue{Key: key}
+		switch v := attrs[key].(type) {
+		case string:
+			kv.Value.StringValue = &v
+		case bool:
+			kv.Value.BoolValue = &v
+		case int:
+			kv.Value.IntValue = formatInt(int64(v))
+		case int32:
+			kv.Value.IntValue = formatInt(int64(v))
+		case int64:
+			kv.Value.IntValue = formatInt(v)
+		case float64:
+			kv.Value.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			kv.Value.StringValue = &s
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func labelAttributes(labels metrics.Labels) []keyValue {
+	attrs := make(tracing.Attributes, len(labels))
+	for name, value := range labels {
+		attrs[name] = value
+	}
+	return attributes(attrs)
+}
+
+func convertSpan(s tracing.SpanData) span {
+	converted := span{
+		TraceID:           hex.EncodeToString(s.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.SpanID[:]),
+		Name:              s.Name,
+		Kind:              int(s.Kind),
+		StartTimeUnixNano: unixNano(s.Start),
+		EndTimeUnixNano:   unixNano(s.End),
+		Attributes:        attributes(s.Attributes),
+	}
+	if s.ParentSpanID != [8]byte{} {
+		converted.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+	}
+	if s.Err != "" {
+		converted.Status = &status{Code: statusCodeError, Message: s.Err}
+	}
+	return converted
+}
+
+// convertMetrics converts totals to one metric per name, with a data point per series, sorted by
+// name.
+func convertMetrics(totals metrics.Totals, now time.Time) []metric {
+	byName := map[string]*metric{}
+	get := func(name string) *metric {
+		m, ok := byName[name]
+		if !ok {
+			m = &metric{Name: name}
+			byName[name] = m
+		}
+		return m
+	}
+
+	start, at := unixNano(totals.Start), unixNano(now)
+	for _, t := range totals.Counts {
+		m := get(t.Name)
+		if m.Sum == nil {
+			m.Sum = &sum{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+		}
+		m.Sum.DataPoints = append(m.Sum.DataPoints, numberDataPoint{
+			Attributes:        labelAttributes(t.Labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      at,
+			AsInt:             formatInt(int64(t.Value)),
+		})
+	}
+	for _, t := range totals.Gauges {
+		m := get(t.Name)
+		if m.Gauge == nil {
+			m.Gauge = &gauge{}
+		}
+		value := t.Value
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, numberDataPoint{
+			Attributes:   labelAttributes(t.Labels),
+			TimeUnixNano: at,
+			AsDouble:     &value,
+		})
+	}
+	for _, t := range totals.Histograms {
+		m := get(t.Name)
+		if m.Histogram == nil {
+			m.Histogram = &histogram{AggregationTemporality: aggregationTemporalityCumulative}
+		}
+		counts := make([]string, 0, len(t.Value.Counts))
+		for _, count := range t.Value.Counts {
+			counts = append(counts, strconv.Itoa(count))
+		}
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, histogramDataPoint{
+			Attributes:        labelAttributes(t.Labels),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      at,
+			Count:             strconv.Itoa(t.Value.Total()),
+			Sum:               t.Value.Sum,
+			BucketCounts:      counts,
+			ExplicitBounds:    totals.Bounds,
+		})
+	}
+
+	names := maps.Keys(byName)
+	slices.Sort(names)
+	converted := make([]metric, 0, len(names))
+	for _, name := range names {
+		converted = append(converted, *byName[name])
+	}
+	return converted
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func formatInt(v int64) *string {
+	s := strconv.FormatInt(v, 10)
+	return &s
+}
@@ -0,0 +1,96 @@
+// Package otlp pushes metrics and spans to an OpenTelemetry collector using OTLP over HTTP with
+// its JSON encoding, as an alternative to Prometheus scraping the stats server.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
+)
+
+// scopeName is the instrumentation scope exported telemetry is attributed to.
+const scopeName = "github.com/ttd2089/rate-limited-consumer-poc"
+
+// An Exporter sends telemetry to the collector at an OTLP/HTTP endpoint, like
+// http://localhost:4318, posting metrics to /v1/metrics and spans to /v1/traces.
+type Exporter struct {
+	endpoint string
+	resource resource
+	client   *http.Client
+}
+
+// NewExporter creates an exporter whose telemetry is attributed to service.
+func NewExporter(endpoint string, service string) *Exporter {
+	return &Exporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		resource: resource{Attributes: attributes(tracing.Attributes{"service.name": service})},
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ExportSpans sends spans to the collector.
+func (e *Exporter) ExportSpans(ctx context.Context, spans []tracing.SpanData) error {
+	converted := make([]span, 0, len(spans))
+	for _, s := range spans {
+		converted = append(converted, convertSpan(s))
+	}
+	return e.post(ctx, "/v1/traces", tracesRequest{ResourceSpans: []resourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: scopeName}, Spans: converted}},
+	}}})
+}
+
+// ExportMetrics sends totals to the collector as they were at now. Counts are exported as
+// cumulative monotonic sums, gauges as gauges, and histograms as cumulative histograms.
+func (e *Exporter) ExportMetrics(ctx context.Context, totals metrics.Totals, now time.Time) error {
+	return e.post(ctx, "/v1/metrics", metricsRequest{ResourceMetrics: []resourceMetrics{{
+		Resource:     e.resource,
+		ScopeMetrics: []scopeMetrics{{Scope: scope{Name: scopeName}, Metrics: convertMetrics(totals, now)}},
+	}}})
+}
+
+// PushMetrics exports set's totals every interval until ctx is cancelled.
+func (e *Exporter) PushMetrics(ctx context.Context, clk clock.Clock, set *metrics.Set, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(interval):
+		}
+		if err := e.ExportMetrics(ctx, set.Totals(), clk.Now()); err != nil && ctx.Err() == nil {
+			fmt.Printf("error: export metrics: %v\n", err)
+		}
+	}
+}
+
+func (e *Exporter) post(ctx context.Context, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("post %s: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,159 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
+)
+
+// receiver is a stub collector that keeps the body of each request by path.
+type receiver struct {
+	bodies map[string][]map[string]any
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{bodies: map[string][]map[string]any{}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		data, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(data, &body))
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], body)
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+// get follows path through nested objects and arrays, where ints index arrays.
+func get(t *testing.T, v any, path ...any) any {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			require.True(t, ok, "%v is not an object", v)
+			v = m[p]
+		case int:
+			a, ok := v.([]any)
+			require.True(t, ok, "%v is not an array", v)
+			require.Greater(t, len(a), p)
+			v = a[p]
+		}
+	}
+	return v
+}
+
+func TestExporter(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("exports spans with hex IDs and parent links", func(t *testing.T) {
+		r, srv := newReceiver(t)
+		exporter := NewExporter(srv.URL+"/", "consumer")
+		clk := clock.NewManual(start)
+		tracer := tracing.NewTracer(clk, exporter, 0)
+
+		ctx, parent := tracer.Start(context.Background(), "consume", tracing.KindConsumer, tracing.Attributes{
+			"customer":  "a",
+			"partition": int32(2),
+			"offset":    int64(7),
+		})
+		_, child := tracer.Start(ctx, "call dependency", tracing.KindClient, nil)
+		clk.Advance(time.Millisecond)
+		child.SetError(assert.AnError)
+		child.End()
+		parent.End()
+		require.NoError(t, tracer.Flush(context.Background()))
+
+		require.Len(t, r.bodies["/v1/traces"], 1)
+		body := r.bodies["/v1/traces"][0]
+		assert.Equal(t, map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "consumer"}},
+			get(t, body, "resourceSpans", 0, "resource", "attributes", 0))
+
+		spans := get(t, body, "resourceSpans", 0, "scopeSpans", 0, "spans").([]any)
+		require.Len(t, spans, 2)
+		c, p := spans[0].(map[string]any), spans[1].(map[string]any)
+		assert.Len(t, p["traceId"], 32)
+		assert.Len(t, p["spanId"], 16)
+		assert.Equal(t, p["traceId"], c["traceId"])
+		assert.Equal(t, p["spanId"], c["parentSpanId"])
+		assert.NotContains(t, p, "parentSpanId")
+		assert.Equal(t, 5.0, p["kind"])
+		assert.Equal(t, "1000000000000", p["startTimeUnixNano"])
+		assert.Equal(t, "1000001000000", c["endTimeUnixNano"])
+		assert.Equal(t, 2.0, get(t, c, "status", "code"))
+		assert.Equal(t, []any{
+			map[string]any{"key": "customer", "value": map[string]any{"stringValue": "a"}},
+			map[string]any{"key": "offset", "value": map[string]any{"intValue": "7"}},
+			map[string]any{"key": "partition", "value": map[string]any{"intValue": "2"}},
+		}, p["attributes"])
+	})
+
+	t.Run("exports counts, gauges, and histograms", func(t *testing.T) {
+		r, srv := newReceiver(t)
+		exporter := NewExporter(srv.URL, "producer")
+
+		require.NoError(t, exporter.ExportMetrics(context.Background(), metrics.Totals{
+			Start: start,
+			Counts: []metrics.Total[int]{
+				{Name: "produced", Labels: metrics.Labels{"customer": "a"}, Value: 3},
+				{Name: "produced", Labels: metrics.Labels{"customer": "b"}, Value: 4},
+			},
+			Gauges: []metrics.Total[float64]{{Name: "target-rps", Value: 12.5}},
+			Histograms: []metrics.Total[metrics.HistogramValue]{
+				{Name: "delivery-latency-ms", Value: metrics.HistogramValue{Counts: []int{1, 2, 0}, Sum: 9}},
+			},
+			Bounds: []float64{1, 5},
+		}, start.Add(time.Minute)))
+
+		require.Len(t, r.bodies["/v1/metrics"], 1)
+		ms := get(t, r.bodies["/v1/metrics"][0], "resourceMetrics", 0, "scopeMetrics", 0, "metrics").([]any)
+		require.Len(t, ms, 3)
+
+		histogram := ms[0].(map[string]any)
+		assert.Equal(t, "delivery-latency-ms", histogram["name"])
+		assert.Equal(t, 2.0, get(t, histogram, "histogram", "aggregationTemporality"))
+		point := get(t, histogram, "histogram", "dataPoints", 0)
+		assert.Equal(t, "3", get(t, point, "count"))
+		assert.Equal(t, 9.0, get(t, point, "sum"))
+		assert.Equal(t, []any{"1", "2", "0"}, get(t, point, "bucketCounts"))
+		assert.Equal(t, []any{1.0, 5.0}, get(t, point, "explicitBounds"))
+
+		produced := ms[1].(map[string]any)
+		assert.Equal(t, "produced", produced["name"])
+		assert.Equal(t, true, get(t, produced, "sum", "isMonotonic"))
+		assert.Equal(t, 2.0, get(t, produced, "sum", "aggregationTemporality"))
+		assert.Equal(t, "3", get(t, produced, "sum", "dataPoints", 0, "asInt"))
+		assert.Equal(t, "b", get(t, produced, "sum", "dataPoints", 1, "attributes", 0, "value", "stringValue"))
+		assert.Equal(t, "1000000000000", get(t, produced, "sum", "dataPoints", 0, "startTimeUnixNano"))
+		assert.Equal(t, "1060000000000", get(t, produced, "sum", "dataPoints", 0, "timeUnixNano"))
+
+		gauge := ms[2].(map[string]any)
+		assert.Equal(t, "target-rps", gauge["name"])
+		assert.Equal(t, 12.5, get(t, gauge, "gauge", "dataPoints", 0, "asDouble"))
+	})
+
+	t.Run("reports collector errors", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		err := NewExporter(srv.URL, "consumer").ExportMetrics(context.Background(), metrics.Totals{}, start)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "503")
+	})
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An Action is what the handler does with a message whose key is over its limit.
+type Action int
+
+const (
+	// Defer produces the message to the defer topic so the rest of its partition can be processed.
+	Defer Action = iota
+
+	// Pause leaves the message where it is and pauses its partition until the key has capacity
+	// again, for streams where deferring would reorder messages that mustn't be reordered.
+	Pause
+)
+
+func (a Action) String() string {
+	switch a {
+	case Defer:
+		return "defer"
+	case Pause:
+		return "pause"
+	default:
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+}
+
+// ParseActions parses a comma separated list of topic=action pairs like
+// "orders=pause,messages=defer". Topics that aren't listed use [Defer].
+func ParseActions(s string) (map[string]Action, error) {
+	actions := map[string]Action{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		topic, name, ok := strings.Cut(pair, "=")
+		topic, name = strings.TrimSpace(topic), strings.TrimSpace(name)
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("%q is not a topic=action pair", pair)
+		}
+		switch name {
+		case "defer":
+			actions[topic] = Defer
+		case "pause":
+			actions[topic] = Pause
+		default:
+			return nil, fmt.Errorf("unsupported action %q for topic %q", name, topic)
+		}
+	}
+	return actions, nil
+}
+
+// A PauseError is returned by [Handler.Handle] when a message on a topic whose action is [Pause]
+// is over its limit. The message hasn't been processed and shouldn't be committed; its partition
+// should be paused and the message retried no earlier than Until.
+type PauseError struct {
+	Key   string
+	Until time.Time
+}
+
+func (e *PauseError) Error() string {
+	return fmt.Sprintf("key %q is over its limit until %s", e.Key, e.Until.Format(time.RFC3339Nano))
+}
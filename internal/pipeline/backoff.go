@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// NotBeforeHeader holds the RFC 3339 time before which a deferred message shouldn't be retried.
+const NotBeforeHeader = "not-before"
+
+// A Backoff decides when a deferred message should next be attempted.
+type Backoff interface {
+	NotBefore(env messages.Envelope, key string) time.Time
+}
+
+// A RefillEstimator reports when a key will next be allowed; ratelimit.Keyed implements it.
+type RefillEstimator interface {
+	NextAllowed(key string) time.Time
+}
+
+// RefillBackoff retries a message once the limiter expects to have capacity for its key again.
+type RefillBackoff struct {
+	Limiter RefillEstimator
+}
+
+func (b RefillBackoff) NotBefore(_ messages.Envelope, key string) time.Time {
+	return b.Limiter.NextAllowed(key)
+}
+
+// maxExponentialDelay is the longest delay of an [ExponentialBackoff] without a Max, so a message
+// deferred many times doesn't double its delay until it overflows and is retried immediately.
+const maxExponentialDelay = 24 * time.Hour
+
+// ExponentialBackoff doubles the delay each time a message is deferred, starting at Base and
+// capped at Max.
+type ExponentialBackoff struct {
+	Clock clock.Clock
+	Base  time.Duration
+
+	// Max is the longest delay. Zero means a day.
+	Max time.Duration
+}
+
+func (b ExponentialBackoff) NotBefore(env messages.Envelope, _ string) time.Time {
+	limit := b.Max
+	if limit <= 0 {
+		limit = maxExponentialDelay
+	}
+	delay := min(b.Base, limit)
+	for i := DeferralCount(env); i > 0 && delay > 0 && delay < limit; i-- {
+		// Doubling past the limit could overflow when the limit is near the longest duration.
+		if delay > limit/2 {
+			delay = limit
+		} else {
+			delay *= 2
+		}
+	}
+	return b.Clock.Now().Add(delay)
+}
+
+// ParseBackoff returns the backoff named by name: "refill" uses limiter's refill estimate,
+// "exponential" starts at base and doubles up to maxDelay, and "none" retries immediately.
+func ParseBackoff(name string, limiter Limiter, clk clock.Clock, base, maxDelay time.Duration) (Backoff, error) {
+	switch name {
+	case "", "refill":
+		estimator, ok := limiter.(RefillEstimator)
+		if !ok {
+			return nil, nil
+		}
+		return RefillBackoff{Limiter: estimator}, nil
+	case "exponential":
+		if base <= 0 {
+			return nil, fmt.Errorf("exponential backoff needs a positive base delay")
+		}
+		return ExponentialBackoff{Clock: clk, Base: base, Max: maxDelay}, nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported backoff %q", name)
+	}
+}
+
+// NotBefore returns the time env's not-before header holds, or false if it has none.
+func NotBefore(env messages.Envelope) (time.Time, bool) {
+	v, ok := env.Header(NotBeforeHeader)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(v))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
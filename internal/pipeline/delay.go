@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+)
+
+// DelayQueue is a [broker.Consumer] that holds back messages until they're due: messages whose
+// not-before time hasn't passed, and messages put back with Hold. While a message is held its
+// partition is paused instead of polled, and the partition is resumed once the message is
+// delivered. Messages that arrive from a partition after it's paused are queued behind the held
+// message so order within the partition is preserved.
+type DelayQueue struct {
+	broker.Consumer
+	clock clock.Clock
+	stats Recorder
+	held  map[broker.TopicPartition][]heldMessage
+
+	// mu guards paused, which is read by the stats page while the queue is consumed.
+	mu     sync.Mutex
+	paused map[broker.TopicPartition]time.Time
+}
+
+type heldMessage struct {
+	env messages.Envelope
+	due time.Time
+}
+
+// NewDelayQueue wraps consumer so messages are delivered no earlier than they're due. When a
+// paused partition is resumed the number of milliseconds it was paused for is recorded in stats
+// as "pause-ms:<topic>[<partition>]".
+func NewDelayQueue(consumer broker.Consumer, clk clock.Clock, stats Recorder) *DelayQueue {
+	return &DelayQueue{
+		Consumer: consumer,
+		clock:    clk,
+		stats:    stats,
+		held:     map[broker.TopicPartition][]heldMessage{},
+		paused:   map[broker.TopicPartition]time.Time{},
+	}
+}
+
+// Consume returns the next due message, waiting for held messages to become due or for new
+// messages to arrive from the partitions that aren't paused.
+func (q *DelayQueue) Consume(ctx context.Context) (messages.Envelope, error) {
+	for {
+		env, ok, err := q.popDue()
+		if err != nil || ok {
+			return env, err
+		}
+
+		deadline, holding := q.nextDue()
+		env, err = q.consumeUntil(ctx, deadline, holding)
+		if err != nil {
+			// The wrapped consumer gave up because a held message became due.
+			if ctx.Err() == nil && holding && !deadline.After(q.clock.Now()) {
+				continue
+			}
+			return messages.Envelope{}, err
+		}
+
+		tp := broker.TopicPartition{Topic: env.Topic, Partition: env.Partition}
+		due, _ := NotBefore(env)
+		if queue, ok := q.held[tp]; ok {
+			q.held[tp] = append(queue, heldMessage{env: env, due: due})
+			continue
+		}
+		if due.After(q.clock.Now()) {
+			if err := q.hold(tp, heldMessage{env: env, due: due}); err != nil {
+				return messages.Envelope{}, err
+			}
+			continue
+		}
+		return env, nil
+	}
+}
+
+// Hold puts env back at the head of its partition's queue and pauses the partition until until.
+// It's used when a consumed message can't be processed yet and mustn't be overtaken by the rest of
+// its partition.
+func (q *DelayQueue) Hold(env messages.Envelope, until time.Time) error {
+	tp := broker.TopicPartition{Topic: env.Topic, Partition: env.Partition}
+	if queue, ok := q.held[tp]; ok {
+		q.held[tp] = append([]heldMessage{{env: env, due: until}}, queue...)
+		return nil
+	}
+	return q.hold(tp, heldMessage{env: env, due: until})
+}
+
+func (q *DelayQueue) hold(tp broker.TopicPartition, msg heldMessage) error {
+	if err := q.Consumer.Pause(tp); err != nil {
+		return fmt.Errorf("pause %v: %w", tp, err)
+	}
+	q.held[tp] = []heldMessage{msg}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused[tp] = q.clock.Now()
+	return nil
+}
+
+// Paused returns how long each partition the queue has paused has been paused for. It's safe to
+// call concurrently with Consume.
+func (q *DelayQueue) Paused() map[broker.TopicPartition]time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.clock.Now()
+	paused := make(map[broker.TopicPartition]time.Duration, len(q.paused))
+	for tp, since := range q.paused {
+		paused[tp] = now.Sub(since)
+	}
+	return paused
+}
+
+// popDue removes and returns the head of the first partition queue that's due, resuming the
+// partition if its queue is now empty. Messages queued behind a held message are only delivered
+// once they're due as well.
+func (q *DelayQueue) popDue() (messages.Envelope, bool, error) {
+	now := q.clock.Now()
+	for tp, queue := range q.held {
+		if queue[0].due.After(now) {
+			continue
+		}
+		env := queue[0].env
+		if len(queue) > 1 {
+			q.held[tp] = queue[1:]
+			return env, true, nil
+		}
+		delete(q.held, tp)
+		if err := q.resume(tp); err != nil {
+			return messages.Envelope{}, false, err
+		}
+		return env, true, nil
+	}
+	return messages.Envelope{}, false, nil
+}
+
+func (q *DelayQueue) resume(tp broker.TopicPartition) error {
+	if err := q.Consumer.Resume(tp); err != nil {
+		return fmt.Errorf("resume %v: %w", tp, err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if since, ok := q.paused[tp]; ok {
+		q.stats.Record("pause-ms", metrics.Labels{"partition": tp.String()}, int(q.clock.Now().Sub(since).Milliseconds()))
+		delete(q.paused, tp)
+	}
+	return nil
+}
+
+// nextDue returns when the earliest held message becomes due, or false if nothing is held.
+func (q *DelayQueue) nextDue() (time.Time, bool) {
+	var next time.Time
+	for _, queue := range q.held {
+		if next.IsZero() || queue[0].due.Before(next) {
+			next = queue[0].due
+		}
+	}
+	return next, len(q.held) > 0
+}
+
+// consumeUntil consumes from the wrapped consumer, giving up when deadline passes on q's clock if
+// hasDeadline is set.
+func (q *DelayQueue) consumeUntil(ctx context.Context, deadline time.Time, hasDeadline bool) (messages.Envelope, error) {
+	if !hasDeadline || ctx.Err() != nil {
+		return q.Consumer.Consume(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-q.clock.After(deadline.Sub(q.clock.Now())):
+			cancel()
+		case <-stop:
+		}
+	}()
+	return q.Consumer.Consume(ctx)
+}
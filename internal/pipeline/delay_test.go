@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestDelayQueue(t *testing.T) {
+
+	start := time.Unix(0, 0).UTC()
+
+	produce := func(t *testing.T, p broker.Producer, topic string, body string, notBefore time.Time) {
+		t.Helper()
+		env := messages.Envelope{Topic: topic, Raw: []byte(body)}
+		if !notBefore.IsZero() {
+			env.SetHeader(NotBeforeHeader, []byte(notBefore.Format(time.RFC3339Nano)))
+		}
+		require.NoError(t, p.Produce(context.Background(), env))
+	}
+
+	drained := func() context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+
+	t.Run("delivers messages without a not-before time immediately", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(start)
+		produce(t, m.Producer(), "deferred", "a", time.Time{})
+		produce(t, m.Producer(), "deferred", "b", start)
+
+		q := NewDelayQueue(m.Consumer("g", "deferred"), clk, recorder{})
+		env, err := q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(env.Raw))
+		env, err = q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(env.Raw))
+	})
+
+	t.Run("holds messages until due and keeps partition order", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(start)
+		produce(t, m.Producer(), "deferred", "a", start.Add(2*time.Second))
+		produce(t, m.Producer(), "deferred", "b", start.Add(time.Second))
+		produce(t, m.Producer(), "messages", "c", time.Time{})
+
+		q := NewDelayQueue(m.Consumer("g", "messages", "deferred"), clk, recorder{})
+
+		env, err := q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "c", string(env.Raw))
+		_, err = q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Contains(t, q.Paused(), broker.TopicPartition{Topic: "deferred"}, "the partition is paused behind a")
+
+		clk.Advance(time.Second)
+		_, err = q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled, "b is due but must not overtake a")
+
+		clk.Advance(time.Second)
+		env, err = q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(env.Raw))
+		env, err = q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(env.Raw))
+		_, err = q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, q.Paused())
+	})
+
+	t.Run("queues messages that arrive from a paused partition", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(start)
+		produce(t, m.Producer(), "deferred", "a", start.Add(2*time.Second))
+		produce(t, m.Producer(), "deferred", "b", time.Time{})
+
+		q := NewDelayQueue(prefetching{m.Consumer("g", "deferred")}, clk, recorder{})
+		_, err := q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Contains(t, q.Paused(), broker.TopicPartition{Topic: "deferred"})
+
+		clk.Advance(2 * time.Second)
+		env, err := q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(env.Raw))
+		env, err = q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(env.Raw))
+	})
+
+	t.Run("wakes when a held message becomes due", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(start)
+		produce(t, m.Producer(), "deferred", "a", start.Add(time.Second))
+
+		q := NewDelayQueue(m.Consumer("g", "deferred"), clk, recorder{})
+		_, err := q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled)
+
+		done := make(chan messages.Envelope)
+		go func() {
+			env, err := q.Consume(context.Background())
+			assert.NoError(t, err)
+			done <- env
+		}()
+		require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		clk.Advance(time.Second)
+
+		select {
+		case env := <-done:
+			assert.Equal(t, "a", string(env.Raw))
+		case <-time.After(time.Second):
+			t.Fatal("held message was not delivered")
+		}
+	})
+
+	t.Run("resumes the partition once its held messages are delivered", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		clk := clock.NewManual(start)
+		produce(t, m.Producer(), "deferred", "a", start.Add(time.Second))
+
+		q := NewDelayQueue(m.Consumer("g", "deferred"), clk, recorder{})
+		_, err := q.Consume(drained())
+		require.ErrorIs(t, err, context.Canceled)
+
+		clk.Advance(time.Second)
+		env, err := q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(env.Raw))
+
+		produce(t, m.Producer(), "deferred", "b", time.Time{})
+		env, err = q.Consume(drained())
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(env.Raw))
+	})
+}
+
+func TestDelayQueueHold(t *testing.T) {
+
+	start := time.Unix(0, 0).UTC()
+	drained, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := broker.NewMemory(1)
+	clk := clock.NewManual(start)
+	for _, body := range []string{"a", "b"} {
+		require.NoError(t, m.Producer().Produce(context.Background(), messages.Envelope{Topic: "orders", Raw: []byte(body)}))
+	}
+
+	stats := recorder{}
+	q := NewDelayQueue(m.Consumer("g", "orders"), clk, stats)
+	env, err := q.Consume(drained)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(env.Raw))
+
+	require.NoError(t, q.Hold(env, start.Add(time.Second)))
+	tp := broker.TopicPartition{Topic: "orders", Partition: 0}
+	_, err = q.Consume(drained)
+	require.ErrorIs(t, err, context.Canceled)
+
+	clk.Advance(500 * time.Millisecond)
+	assert.Equal(t, map[broker.TopicPartition]time.Duration{tp: 500 * time.Millisecond}, q.Paused())
+
+	clk.Advance(500 * time.Millisecond)
+	env, err = q.Consume(drained)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(env.Raw), "a held message is redelivered before the rest of its partition")
+	env, err = q.Consume(drained)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(env.Raw))
+
+	assert.Empty(t, q.Paused())
+	assert.Equal(t, recorder{`pause-ms{partition="orders[0]"}`: 1000}, stats)
+}
+
+// prefetching ignores Pause, like a broker client that has already fetched messages for a
+// partition when it's paused.
+type prefetching struct {
+	broker.Consumer
+}
+
+func (prefetching) Pause(...broker.TopicPartition) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+// Package pipeline implements the consumer's message handling: deciding whether a message can be
+// processed now and either calling the dependency or deferring the message for later.
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
+)
+
+const (
+	// DeferralCountHeader counts how many times a message has been deferred.
+	DeferralCountHeader = "deferral-count"
+
+	// DeferredFromHeader names the topic a message was consumed from when it was first deferred.
+	DeferredFromHeader = "deferred-from"
+)
+
+// A Recorder records measurements; metrics.Count is the usual implementation.
+type Recorder interface {
+	Record(name string, labels metrics.Labels, value int)
+}
+
+// A Limiter decides whether a message with the given key can be processed now.
+type Limiter interface {
+	Allow(key string) bool
+}
+
+// A Dependency is the downstream component the consumer calls to process a message.
+type Dependency interface {
+	Call(ctx context.Context, env messages.Envelope) error
+}
+
+// DependencyFunc adapts a function to the [Dependency] interface.
+type DependencyFunc func(ctx context.Context, env messages.Envelope) error
+
+func (f DependencyFunc) Call(ctx context.Context, env messages.Envelope) error {
+	return f(ctx, env)
+}
+
+// Handler processes messages that the limiter allows and either defers the rest to another topic
+// or asks for their partition to be paused, so they don't use up the dependency's capacity.
+type Handler struct {
+	stats      Recorder
+	limiter    Limiter
+	dependency Dependency
+	deferrals  broker.Producer
+	deferTopic string
+	backoff    Backoff
+	actions    map[string]Action
+	tracer     *tracing.Tracer
+}
+
+// NewHandler creates a handler that defers messages the limiter doesn't allow by producing them to
+// deferTopic with deferrals. Deferred messages are stamped with a not-before time from backoff; a
+// nil backoff leaves them due immediately. actions chooses what happens to limited messages by the
+// topic they were consumed from; topics that aren't in actions are deferred. tracer records the
+// limiter decision, dependency call, and deferral as children of the span in Handle's context; it
+// may be nil.
+func NewHandler(
+	stats Recorder,
+	limiter Limiter,
+	dependency Dependency,
+	deferrals broker.Producer,
+	deferTopic string,
+	backoff Backoff,
+	actions map[string]Action,
+	tracer *tracing.Tracer,
+) *Handler {
+	return &Handler{
+		stats:      stats,
+		limiter:    limiter,
+		dependency: dependency,
+		deferrals:  deferrals,
+		deferTopic: deferTopic,
+		backoff:    backoff,
+		actions:    actions,
+		tracer:     tracer,
+	}
+}
+
+// Key returns the key messages are rate limited and measured by.
+func Key(msg messages.Message) string {
+	return fmt.Sprintf("%s:%s", msg.CustomerID, msg.Type)
+}
+
+// Labels returns the labels measurements of msg are recorded with.
+func Labels(msg messages.Message) metrics.Labels {
+	return metrics.Labels{"customer": msg.CustomerID, "type": msg.Type}
+}
+
+// SpanAttributes returns the attributes spans about env are recorded with.
+func SpanAttributes(env messages.Envelope) tracing.Attributes {
+	return tracing.Attributes{
+		"customer":  env.Message.CustomerID,
+		"type":      env.Message.Type,
+		"topic":     env.Topic,
+		"partition": env.Partition,
+		"offset":    env.Offset,
+	}
+}
+
+// Handle processes env if the limiter allows it and otherwise applies the action configured for
+// env's topic. Messages consumed from the defer topic are limited the same way, so they're
+// deferred again if their key is still over its limit. When the action is [Pause] Handle returns a
+// [*PauseError] and env must not be committed.
+func (h *Handler) Handle(ctx context.Context, env messages.Envelope) error {
+	key := Key(env.Message)
+	attrs := SpanAttributes(env)
+
+	_, span := h.tracer.Start(ctx, "limit", tracing.KindInternal, attrs)
+	allowed := h.limiter.Allow(key)
+	span.SetAttributes(tracing.Attributes{"allowed": allowed})
+	span.End()
+
+	if !allowed {
+		if h.actions[env.Topic] == Pause {
+			h.stats.Record("paused", Labels(env.Message), 1)
+			return &PauseError{Key: key, Until: h.retryAt(env, key)}
+		}
+		if err := h.deferMessage(ctx, key, env); err != nil {
+			return fmt.Errorf("defer message: %w", err)
+		}
+		h.stats.Record("deferred", Labels(env.Message), 1)
+		return nil
+	}
+
+	callCtx, span := h.tracer.Start(ctx, "call dependency", tracing.KindClient, attrs)
+	err := h.dependency.Call(callCtx, env)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return fmt.Errorf("call dependency: %w", err)
+	}
+	h.stats.Record("handled", Labels(env.Message), 1)
+	return nil
+}
+
+// deferMessage produces env's original bytes to the defer topic, keeping its key, headers, and
+// timestamp so the deferral is lossless.
+func (h *Handler) deferMessage(ctx context.Context, key string, env messages.Envelope) error {
+	deferred := env
+	deferred.Topic = h.deferTopic
+	deferred.SetHeader(DeferralCountHeader, []byte(strconv.Itoa(DeferralCount(env)+1)))
+	if _, ok := env.Header(DeferredFromHeader); !ok {
+		deferred.SetHeader(DeferredFromHeader, []byte(env.Topic))
+	}
+	if h.backoff != nil {
+		notBefore := h.backoff.NotBefore(env, key)
+		deferred.SetHeader(NotBeforeHeader, []byte(notBefore.UTC().Format(time.RFC3339Nano)))
+	}
+
+	ctx, span := h.tracer.Start(ctx, "defer", tracing.KindProducer, SpanAttributes(env))
+	defer span.End()
+	span.SetAttributes(tracing.Attributes{"defer_topic": h.deferTopic})
+	err := h.deferrals.Produce(ctx, deferred)
+	span.SetError(err)
+	return err
+}
+
+// retryAt returns when a message that's over its limit should be retried: when the limiter
+// expects to have capacity for key if it can tell, otherwise according to the backoff.
+func (h *Handler) retryAt(env messages.Envelope, key string) time.Time {
+	if estimator, ok := h.limiter.(RefillEstimator); ok {
+		return estimator.NextAllowed(key)
+	}
+	if h.backoff != nil {
+		return h.backoff.NotBefore(env, key)
+	}
+	return time.Time{}
+}
+
+// DeferralCount returns the number of times env has been deferred.
+func DeferralCount(env messages.Envelope) int {
+	v, ok := env.Header(DeferralCountHeader)
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(string(v))
+	if err != nil {
+		return 0
+	}
+	return n
+}
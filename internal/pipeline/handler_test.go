@@ -0,0 +1,233 @@
+package pipeline
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/tracing"
+)
+
+type recorder map[string]int
+
+func (r recorder) Record(name string, labels metrics.Labels, value int) {
+	r[metrics.SeriesKey(name, labels)] += value
+}
+
+type allowKeys map[string]bool
+
+func (a allowKeys) Allow(key string) bool {
+	return a[key]
+}
+
+func TestHandler(t *testing.T) {
+
+	env := messages.Envelope{
+		Message: messages.Message{CustomerID: "c", Type: "t"},
+		Topic:   "messages",
+		Key:     []byte("c"),
+		Raw:     []byte("raw"),
+	}
+
+	t.Run("calls dependency when allowed", func(t *testing.T) {
+		stats := recorder{}
+		called := 0
+		h := NewHandler(stats, allowKeys{"c:t": true}, DependencyFunc(func(context.Context, messages.Envelope) error {
+			called++
+			return nil
+		}), nil, "deferred", nil, nil, nil)
+
+		require.NoError(t, h.Handle(context.Background(), env))
+		assert.Equal(t, 1, called)
+		assert.Equal(t, recorder{`handled{customer="c",type="t"}`: 1}, stats)
+	})
+
+	t.Run("defers losslessly when limited", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		stats := recorder{}
+		h := NewHandler(stats, allowKeys{}, DependencyFunc(func(context.Context, messages.Envelope) error {
+			t.Fatal("dependency should not be called")
+			return nil
+		}), m.Producer(), "deferred", nil, nil, nil)
+
+		require.NoError(t, h.Handle(context.Background(), env))
+		assert.Equal(t, recorder{`deferred{customer="c",type="t"}`: 1}, stats)
+
+		c := m.Consumer("g", "deferred")
+		deferred, err := c.Consume(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, c.Commit(context.Background(), deferred))
+		assert.Equal(t, env.Raw, deferred.Raw)
+		assert.Equal(t, env.Key, deferred.Key)
+		assert.Equal(t, 1, DeferralCount(deferred))
+		from, _ := deferred.Header(DeferredFromHeader)
+		assert.Equal(t, "messages", string(from))
+
+		deferred.Message = env.Message
+		require.NoError(t, h.Handle(context.Background(), deferred))
+		again, err := m.Consumer("g", "deferred").Consume(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 2, DeferralCount(again))
+		from, _ = again.Header(DeferredFromHeader)
+		assert.Equal(t, "messages", string(from))
+	})
+
+	t.Run("asks for a pause when the topic's action is pause", func(t *testing.T) {
+		clk := clock.NewManual(time.Unix(0, 0).UTC())
+		limiter := ratelimit.NewKeyed(1, time.Second, clk)
+		stats := recorder{}
+		h := NewHandler(stats, limiter, DependencyFunc(func(context.Context, messages.Envelope) error {
+			return nil
+		}), nil, "deferred", nil, map[string]Action{"messages": Pause}, nil)
+
+		require.NoError(t, h.Handle(context.Background(), env))
+		err := h.Handle(context.Background(), env)
+		var pause *PauseError
+		require.ErrorAs(t, err, &pause)
+		assert.Equal(t, "c:t", pause.Key)
+		assert.Equal(t, clk.Now().Add(time.Second), pause.Until)
+		assert.Equal(t, recorder{`handled{customer="c",type="t"}`: 1, `paused{customer="c",type="t"}`: 1}, stats)
+	})
+
+	t.Run("traces decisions under the message's span", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		exported := &spans{}
+		tracer := tracing.NewTracer(clock.NewManual(time.Unix(0, 0)), exported, 0)
+		limiter := ratelimit.NewKeyed(1, time.Second, clock.NewManual(time.Unix(0, 0)))
+		h := NewHandler(recorder{}, limiter, DependencyFunc(func(context.Context, messages.Envelope) error {
+			return nil
+		}), m.Producer(), "deferred", nil, nil, tracer)
+
+		ctx, parent := tracer.Start(context.Background(), "consume", tracing.KindConsumer, nil)
+		require.NoError(t, h.Handle(ctx, env))
+		require.NoError(t, h.Handle(ctx, env))
+		parent.End()
+		require.NoError(t, tracer.Flush(context.Background()))
+
+		names := []string{}
+		for _, s := range exported.data {
+			names = append(names, s.Name)
+			if s.Name == "consume" {
+				continue
+			}
+			assert.Equal(t, exported.data[len(exported.data)-1].SpanID, s.ParentSpanID, s.Name)
+			assert.Equal(t, "c", s.Attributes["customer"], s.Name)
+			assert.Equal(t, "messages", s.Attributes["topic"], s.Name)
+		}
+		assert.Equal(t, []string{"limit", "call dependency", "limit", "defer", "consume"}, names)
+		assert.Equal(t, true, exported.data[0].Attributes["allowed"])
+		assert.Equal(t, false, exported.data[2].Attributes["allowed"])
+		assert.Equal(t, "deferred", exported.data[3].Attributes["defer_topic"])
+	})
+}
+
+type spans struct {
+	data []tracing.SpanData
+}
+
+func (s *spans) ExportSpans(_ context.Context, data []tracing.SpanData) error {
+	s.data = append(s.data, data...)
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+
+	clk := clock.NewManual(time.Unix(0, 0).UTC())
+	deferred := func(n int) messages.Envelope {
+		env := messages.Envelope{}
+		if n > 0 {
+			env.SetHeader(DeferralCountHeader, []byte(strconv.Itoa(n)))
+		}
+		return env
+	}
+
+	t.Run("exponential backoff doubles up to max", func(t *testing.T) {
+		b := ExponentialBackoff{Clock: clk, Base: time.Second, Max: 5 * time.Second}
+		assert.Equal(t, clk.Now().Add(time.Second), b.NotBefore(deferred(0), "k"))
+		assert.Equal(t, clk.Now().Add(2*time.Second), b.NotBefore(deferred(1), "k"))
+		assert.Equal(t, clk.Now().Add(4*time.Second), b.NotBefore(deferred(2), "k"))
+		assert.Equal(t, clk.Now().Add(5*time.Second), b.NotBefore(deferred(3), "k"))
+		assert.Equal(t, clk.Now().Add(5*time.Second), b.NotBefore(deferred(100), "k"))
+	})
+
+	t.Run("exponential backoff never overflows", func(t *testing.T) {
+		unbounded := ExponentialBackoff{Clock: clk, Base: time.Second}
+		assert.Equal(t, clk.Now().Add(maxExponentialDelay), unbounded.NotBefore(deferred(1000), "k"))
+
+		longest := ExponentialBackoff{Clock: clk, Base: time.Second, Max: math.MaxInt64}
+		assert.Equal(t, clk.Now().Add(math.MaxInt64), longest.NotBefore(deferred(1000), "k"))
+	})
+
+	t.Run("refill backoff uses the limiter's estimate", func(t *testing.T) {
+		limiter := ratelimit.NewKeyed(1, time.Second, clk)
+		limiter.Allow("k")
+		b, err := ParseBackoff("refill", limiter, clk, 0, 0)
+		require.NoError(t, err)
+		assert.Equal(t, clk.Now().Add(time.Second), b.NotBefore(deferred(0), "k"))
+	})
+
+	t.Run("handler stamps deferred messages", func(t *testing.T) {
+		m := broker.NewMemory(1)
+		h := NewHandler(recorder{}, allowKeys{}, nil, m.Producer(), "deferred",
+			ExponentialBackoff{Clock: clk, Base: time.Second}, nil, nil)
+
+		env := messages.Envelope{Message: messages.Message{CustomerID: "c", Type: "t"}, Topic: "messages"}
+		require.NoError(t, h.Handle(context.Background(), env))
+		deferred, err := m.Consumer("g", "deferred").Consume(context.Background())
+		require.NoError(t, err)
+		notBefore, ok := NotBefore(deferred)
+		require.True(t, ok)
+		assert.True(t, clk.Now().Add(time.Second).Equal(notBefore))
+	})
+
+	t.Run("rejects unknown backoffs", func(t *testing.T) {
+		_, err := ParseBackoff("linear", nil, clk, 0, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("policies default their window and exponential delays", func(t *testing.T) {
+		assert.Equal(t, ratelimit.Unlimited{}, Policy{}.Limiter(clk))
+
+		limiter := Policy{Limit: 1}.Limiter(clk)
+		assert.True(t, limiter.Allow("k"))
+		assert.False(t, limiter.Allow("k"))
+		clk.Advance(time.Second)
+		assert.True(t, limiter.Allow("k"))
+
+		b, err := Policy{Backoff: "exponential"}.NewBackoff(limiter, clk)
+		require.NoError(t, err)
+		assert.Equal(t, ExponentialBackoff{Clock: clk, Base: time.Second, Max: time.Minute}, b)
+	})
+}
+
+func TestParseActions(t *testing.T) {
+
+	t.Run("parses topic action pairs", func(t *testing.T) {
+		actions, err := ParseActions(" orders=pause, messages=defer,")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]Action{"orders": Pause, "messages": Defer}, actions)
+	})
+
+	t.Run("empty means every topic defers", func(t *testing.T) {
+		actions, err := ParseActions("")
+		require.NoError(t, err)
+		assert.Equal(t, Defer, actions["orders"])
+	})
+
+	t.Run("rejects malformed pairs", func(t *testing.T) {
+		for _, s := range []string{"orders", "=pause", "orders=drop"} {
+			_, err := ParseActions(s)
+			assert.Error(t, err, s)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+)
+
+// A Policy is how messages are limited per key and when deferred messages are retried. The
+// consumer and replay build their limiter and backoff from the same policy so a replay handles
+// messages the way the consumer would.
+type Policy struct {
+	// Limit is the number of messages per key allowed per Window. Zero disables limiting.
+	Limit int
+
+	// Window defaults to one second.
+	Window time.Duration
+
+	// Backoff is the name of a backoff [ParseBackoff] accepts. BackoffBase and BackoffMax configure
+	// the exponential backoff and default to one second and one minute.
+	Backoff     string
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+}
+
+// Limiter creates the policy's per-key limiter.
+func (p Policy) Limiter(clk clock.Clock) Limiter {
+	if p.Limit <= 0 {
+		return ratelimit.Unlimited{}
+	}
+	window := p.Window
+	if window <= 0 {
+		window = time.Second
+	}
+	return ratelimit.NewKeyed(p.Limit, window, clk)
+}
+
+// NewBackoff creates the backoff deferred messages are stamped with, which estimates refills with
+// limiter.
+func (p Policy) NewBackoff(limiter Limiter, clk clock.Clock) (Backoff, error) {
+	base, maxDelay := p.BackoffBase, p.BackoffMax
+	if base <= 0 {
+		base = time.Second
+	}
+	if maxDelay <= 0 {
+		maxDelay = time.Minute
+	}
+	return ParseBackoff(p.Backoff, limiter, clk, base, maxDelay)
+}
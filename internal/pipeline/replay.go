@@ -0,0 +1,207 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// A Position identifies a point in every partition of a topic: the earliest or latest offset, a
+// specific offset, or the first message at or after a timestamp.
+type Position struct {
+	kind   positionKind
+	offset int64
+	time   time.Time
+}
+
+type positionKind int
+
+const (
+	positionEarliest positionKind = iota
+	positionLatest
+	positionOffset
+	positionTime
+)
+
+var (
+	Earliest = Position{kind: positionEarliest}
+	Latest   = Position{kind: positionLatest}
+)
+
+// AtOffset returns the position of offset in each partition.
+func AtOffset(offset int64) Position {
+	return Position{kind: positionOffset, offset: offset}
+}
+
+// AtTime returns the position of the first message in each partition whose timestamp is at or
+// after t.
+func AtTime(t time.Time) Position {
+	return Position{kind: positionTime, time: t}
+}
+
+// ParsePosition parses "earliest", "latest", an offset, or an RFC 3339 timestamp.
+func ParsePosition(s string) (Position, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "earliest":
+		return Earliest, nil
+	case "latest":
+		return Latest, nil
+	}
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if offset < 0 {
+			return Position{}, fmt.Errorf("offset %d is negative", offset)
+		}
+		return AtOffset(offset), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return Position{}, fmt.Errorf("position %q is not earliest, latest, an offset, or an RFC 3339 timestamp", s)
+	}
+	return AtTime(t), nil
+}
+
+func (p Position) String() string {
+	switch p.kind {
+	case positionEarliest:
+		return "earliest"
+	case positionLatest:
+		return "latest"
+	case positionOffset:
+		return strconv.FormatInt(p.offset, 10)
+	default:
+		return p.time.Format(time.RFC3339Nano)
+	}
+}
+
+// resolve returns the offset p refers to in tp, clamped to the partition's watermarks.
+func (p Position) resolve(ctx context.Context, s broker.Seeker, tp broker.TopicPartition) (int64, error) {
+	low, high, err := s.Watermarks(ctx, tp)
+	if err != nil {
+		return 0, fmt.Errorf("query watermarks: %w", err)
+	}
+	switch p.kind {
+	case positionEarliest:
+		return low, nil
+	case positionLatest:
+		return high, nil
+	case positionOffset:
+		return min(max(p.offset, low), high), nil
+	default:
+		offset, err := s.OffsetForTime(ctx, tp, p.time)
+		if err != nil {
+			return 0, fmt.Errorf("query offset for time: %w", err)
+		}
+		return min(max(offset, low), high), nil
+	}
+}
+
+// replayPollInterval is how long Replay waits for a message before checking whether the consumer
+// has moved past the end of the range without returning one.
+const replayPollInterval = 100 * time.Millisecond
+
+// Replay feeds the messages in every partition of topic from start (inclusive) to end (exclusive)
+// through handle and commits them for the seeker's consumer group. Partitions with nothing to
+// replay are paused. It returns the number of messages handled once every partition reaches its
+// end, or when ctx is cancelled.
+func Replay(
+	ctx context.Context,
+	s broker.Seeker,
+	topic string,
+	start Position,
+	end Position,
+	handle func(context.Context, messages.Envelope) error,
+) (int, error) {
+	partitions, err := s.Partitions(ctx, topic)
+	if err != nil {
+		return 0, fmt.Errorf("list partitions of %q: %w", topic, err)
+	}
+
+	remaining := map[broker.TopicPartition]int64{}
+	for _, p := range partitions {
+		tp := broker.TopicPartition{Topic: topic, Partition: p}
+		from, err := start.resolve(ctx, s, tp)
+		if err != nil {
+			return 0, fmt.Errorf("resolve start of %v: %w", tp, err)
+		}
+		to, err := end.resolve(ctx, s, tp)
+		if err != nil {
+			return 0, fmt.Errorf("resolve end of %v: %w", tp, err)
+		}
+		if from >= to {
+			if err := s.Pause(tp); err != nil {
+				return 0, fmt.Errorf("pause %v: %w", tp, err)
+			}
+			continue
+		}
+		fmt.Printf("info: replaying %v offsets [%d, %d)\n", tp, from, to)
+		if err := s.Seek(tp, from); err != nil {
+			return 0, fmt.Errorf("seek %v to %d: %w", tp, from, err)
+		}
+		remaining[tp] = to
+	}
+
+	finish := func(tp broker.TopicPartition) error {
+		delete(remaining, tp)
+		if err := s.Pause(tp); err != nil {
+			return fmt.Errorf("pause %v: %w", tp, err)
+		}
+		return nil
+	}
+
+	handled := 0
+	for len(remaining) > 0 {
+		// A range can end in offsets Consume never returns, like transaction markers or compacted
+		// messages, so when nothing arrives for a while the consumer's position is checked instead.
+		pollCtx, cancel := context.WithTimeout(ctx, replayPollInterval)
+		env, err := s.Consume(pollCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			for tp, to := range remaining {
+				position, err := s.Position(tp)
+				if err != nil {
+					return handled, fmt.Errorf("get position of %v: %w", tp, err)
+				}
+				if position >= to {
+					if err := finish(tp); err != nil {
+						return handled, err
+					}
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return handled, err
+		}
+		tp := broker.TopicPartition{Topic: env.Topic, Partition: env.Partition}
+		to, ok := remaining[tp]
+		if !ok || env.Offset >= to {
+			continue
+		}
+
+		if err := messages.Decode(&env); err != nil {
+			fmt.Printf("error: decode %v@%d: %v\n", tp, env.Offset, err)
+		} else if err := handle(ctx, env); err != nil {
+			return handled, fmt.Errorf("handle %v@%d: %w", tp, env.Offset, err)
+		} else {
+			handled++
+		}
+
+		if err := s.Commit(ctx, env); err != nil {
+			return handled, fmt.Errorf("commit %v@%d: %w", tp, env.Offset, err)
+		}
+
+		if env.Offset+1 >= to {
+			if err := finish(tp); err != nil {
+				return handled, err
+			}
+		}
+	}
+	return handled, nil
+}
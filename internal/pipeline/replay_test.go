@@ -0,0 +1,126 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestReplay(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	// Produce 5 messages to each of 2 partitions, one second apart, with bodies "<partition>-<i>".
+	setup := func(t *testing.T) *broker.Memory {
+		m := broker.NewMemory(2)
+		for i := 0; i < 10; i++ {
+			data, headers, err := messages.Encode(messages.JSON{}, messages.CurrentSchemaVersion, messages.Message{
+				Body: string(rune('a' + i)),
+			})
+			require.NoError(t, err)
+			require.NoError(t, m.Producer().Produce(context.Background(), messages.Envelope{
+				Topic:     "messages",
+				Headers:   headers,
+				Timestamp: start.Add(time.Duration(i/2) * time.Second),
+				Raw:       data,
+			}))
+		}
+		return m
+	}
+
+	replay := func(t *testing.T, s broker.Seeker, from, to Position) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		bodies := []string{}
+		n, err := Replay(ctx, s, "messages", from, to,
+			func(_ context.Context, env messages.Envelope) error {
+				bodies = append(bodies, env.Message.Body)
+				return nil
+			})
+		require.NoError(t, err)
+		assert.Equal(t, len(bodies), n)
+		return bodies
+	}
+
+	t.Run("replays an offset range in every partition", func(t *testing.T) {
+		m := setup(t)
+		bodies := replay(t, m.Consumer("replay", "messages"), AtOffset(1), AtOffset(3))
+		assert.ElementsMatch(t, []string{"c", "d", "e", "f"}, bodies)
+		assert.Equal(t, int64(3), m.Committed("replay", broker.TopicPartition{Topic: "messages", Partition: 0}))
+	})
+
+	t.Run("replays a time range", func(t *testing.T) {
+		m := setup(t)
+		bodies := replay(t, m.Consumer("replay", "messages"), AtTime(start.Add(3*time.Second)), Latest)
+		assert.ElementsMatch(t, []string{"g", "h", "i", "j"}, bodies)
+	})
+
+	t.Run("replays everything from earliest to latest", func(t *testing.T) {
+		m := setup(t)
+		assert.Len(t, replay(t, m.Consumer("replay", "messages"), Earliest, Latest), 10)
+	})
+
+	t.Run("returns when there is nothing to replay", func(t *testing.T) {
+		m := setup(t)
+		assert.Empty(t, replay(t, m.Consumer("replay", "messages"), Latest, Latest))
+	})
+
+	t.Run("returns when the range ends in offsets that aren't consumed", func(t *testing.T) {
+		m := setup(t)
+		// Like a transaction marker, the last offset in each partition moves the consumer's
+		// position without being returned.
+		s := skippingSeeker{MemoryConsumer: m.Consumer("replay", "messages"), skip: 4}
+		bodies := replay(t, s, Earliest, Latest)
+		assert.Len(t, bodies, 8)
+	})
+}
+
+// skippingSeeker doesn't return messages at the skip offset, the way a Kafka consumer doesn't
+// return transaction markers.
+type skippingSeeker struct {
+	*broker.MemoryConsumer
+	skip int64
+}
+
+func (s skippingSeeker) Consume(ctx context.Context) (messages.Envelope, error) {
+	for {
+		env, err := s.MemoryConsumer.Consume(ctx)
+		if err != nil || env.Offset != s.skip {
+			return env, err
+		}
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected Position
+	}{
+		{input: "earliest", expected: Earliest},
+		{input: "LATEST", expected: Latest},
+		{input: "42", expected: AtOffset(42)},
+		{input: "2026-10-19T01:00:00Z", expected: AtTime(time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC))},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.input, func(t *testing.T) {
+			actual, err := ParsePosition(tt.input)
+			assert.NoError(t, err)
+			assert.True(t, tt.expected.time.Equal(actual.time))
+			actual.time = tt.expected.time
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+
+	for _, input := range []string{"-1", "yesterday"} {
+		t.Run("returns error for "+input, func(t *testing.T) {
+			_, err := ParsePosition(input)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// TokenBucket is a [Limiter] that refills a bucket of limit tokens at limit per window and allows
+// an event for each token it takes. Unlike the sliding windows it allows a full burst again as soon
+// as the bucket refills, rather than once the burst leaves the window.
+type TokenBucket struct {
+	burst  float64
+	rate   float64
+	clock  clock.Clock
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket that allows limit events per window. limit must be
+// positive.
+func NewTokenBucket(limit int, window time.Duration, clk clock.Clock) *TokenBucket {
+	return &TokenBucket{
+		burst:  float64(limit),
+		rate:   float64(limit) / window.Seconds(),
+		clock:  clk,
+		tokens: float64(limit),
+		last:   clk.Now(),
+	}
+}
+
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(b.clock.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *TokenBucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(b.clock.Now())
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	return sleep(ctx, b.clock, b.Reserve())
+}
+
+// refill must be called with b.mu held.
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
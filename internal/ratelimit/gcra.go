@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// GCRA is a [Limiter] implementing the generic cell rate algorithm. It behaves like a
+// [TokenBucket] but only stores the theoretical arrival time of the next event: events are spaced
+// window/limit apart and may arrive early by up to a burst of limit.
+type GCRA struct {
+	interval  time.Duration
+	tolerance time.Duration
+	clock     clock.Clock
+	mu        sync.Mutex
+	tat       time.Time
+}
+
+// NewGCRA creates a limiter that allows limit events per window. limit must be positive.
+func NewGCRA(limit int, window time.Duration, clk clock.Clock) *GCRA {
+	interval := window / time.Duration(limit)
+	return &GCRA{
+		interval:  interval,
+		tolerance: window - interval,
+		clock:     clk,
+	}
+}
+
+func (g *GCRA) Allow() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	tat := latest(g.tat, now)
+	if tat.Sub(now) > g.tolerance {
+		return false
+	}
+	g.tat = tat.Add(g.interval)
+	return true
+}
+
+func (g *GCRA) Reserve() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.clock.Now()
+	tat := latest(g.tat, now)
+	g.tat = tat.Add(g.interval)
+	return max(0, tat.Add(-g.tolerance).Sub(now))
+}
+
+func (g *GCRA) Wait(ctx context.Context) error {
+	return sleep(ctx, g.clock, g.Reserve())
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
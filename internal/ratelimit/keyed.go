@@ -0,0 +1,94 @@
+// Package ratelimit implements the rate limiters the producer paces sends with and the consumer
+// uses to decide whether a message can be processed now or should be deferred.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// Keyed allows up to limit events per window for each key using a [SlidingWindowLog] per key.
+type Keyed struct {
+	limit  int
+	window time.Duration
+	clock  clock.Clock
+	mu     sync.Mutex
+	logs   map[string]*SlidingWindowLog
+}
+
+// NewKeyed creates a limiter that allows limit events per window for each key.
+func NewKeyed(limit int, window time.Duration, clk clock.Clock) *Keyed {
+	return &Keyed{
+		limit:  limit,
+		window: window,
+		clock:  clk,
+		logs:   map[string]*SlidingWindowLog{},
+	}
+}
+
+// Allow reports whether an event for key is allowed now and, if it is, records it.
+func (k *Keyed) Allow(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.limit <= 0 {
+		return false
+	}
+
+	log, ok := k.logs[key]
+	if !ok {
+		log = NewSlidingWindowLog(k.limit, k.window, k.clock)
+		k.logs[key] = log
+	}
+	return log.Allow()
+}
+
+// Limit returns the number of events allowed per window for each key.
+func (k *Keyed) Limit() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.limit
+}
+
+// SetLimit changes the number of events allowed per window for each key. The most recent events
+// for each key are kept, so a key that's used its new limit stays limited until they age out.
+func (k *Keyed) SetLimit(limit int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if limit == k.limit {
+		return
+	}
+	k.limit = limit
+	for key, log := range k.logs {
+		if limit <= 0 {
+			delete(k.logs, key)
+			continue
+		}
+		log.setLimit(limit)
+	}
+}
+
+// NextAllowed returns the earliest time an event for key would be allowed.
+func (k *Keyed) NextAllowed(key string) time.Time {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.limit <= 0 {
+		return k.clock.Now().Add(k.window)
+	}
+	log, ok := k.logs[key]
+	if !ok {
+		return k.clock.Now()
+	}
+	return log.NextAllowed()
+}
+
+// Unlimited is a limiter that allows every event.
+type Unlimited struct{}
+
+func (Unlimited) Allow(string) bool {
+	return true
+}
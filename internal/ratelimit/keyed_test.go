@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+func TestKeyed(t *testing.T) {
+
+	t.Run("allows limit events per window", func(t *testing.T) {
+		clk := clock.NewManual(time.Unix(0, 0))
+		k := NewKeyed(2, time.Second, clk)
+		assert.True(t, k.Allow("a"))
+		assert.True(t, k.Allow("a"))
+		assert.False(t, k.Allow("a"))
+
+		clk.Advance(999 * time.Millisecond)
+		assert.False(t, k.Allow("a"))
+
+		clk.Advance(time.Millisecond)
+		assert.True(t, k.Allow("a"))
+		assert.True(t, k.Allow("a"))
+		assert.False(t, k.Allow("a"))
+	})
+
+	t.Run("limits keys independently", func(t *testing.T) {
+		k := NewKeyed(1, time.Second, clock.NewManual(time.Unix(0, 0)))
+		assert.True(t, k.Allow("a"))
+		assert.False(t, k.Allow("a"))
+		assert.True(t, k.Allow("b"))
+	})
+
+	t.Run("allows nothing when limit is zero", func(t *testing.T) {
+		k := NewKeyed(0, time.Second, clock.NewManual(time.Unix(0, 0)))
+		assert.False(t, k.Allow("a"))
+	})
+}
+
+func TestKeyedNextAllowed(t *testing.T) {
+	clk := clock.NewManual(time.Unix(0, 0))
+	k := NewKeyed(2, time.Second, clk)
+	assert.Equal(t, clk.Now(), k.NextAllowed("a"))
+
+	k.Allow("a")
+	clk.Advance(100 * time.Millisecond)
+	k.Allow("a")
+	assert.Equal(t, time.Unix(1, 0), k.NextAllowed("a"))
+
+	clk.Advance(time.Second)
+	assert.Equal(t, clk.Now(), k.NextAllowed("a"))
+}
+
+func TestKeyedSetLimit(t *testing.T) {
+
+	t.Run("raising the limit allows more events in the window", func(t *testing.T) {
+		k := NewKeyed(1, time.Second, clock.NewManual(time.Unix(0, 0)))
+		assert.True(t, k.Allow("a"))
+		assert.False(t, k.Allow("a"))
+
+		k.SetLimit(3)
+		assert.Equal(t, 3, k.Limit())
+		assert.True(t, k.Allow("a"))
+		assert.True(t, k.Allow("a"))
+		assert.False(t, k.Allow("a"))
+	})
+
+	t.Run("lowering the limit keeps the most recent events", func(t *testing.T) {
+		clk := clock.NewManual(time.Unix(0, 0))
+		k := NewKeyed(3, time.Second, clk)
+		for range 3 {
+			assert.True(t, k.Allow("a"))
+			clk.Advance(100 * time.Millisecond)
+		}
+
+		k.SetLimit(1)
+		assert.False(t, k.Allow("a"))
+		assert.Equal(t, time.Unix(1, 200*int64(time.Millisecond)), k.NextAllowed("a"))
+	})
+}
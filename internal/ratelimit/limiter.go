@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// A Limiter allows a number of events per window. Limiters are safe for concurrent use.
+type Limiter interface {
+
+	// Allow reports whether an event is allowed now and, if it is, records it.
+	Allow() bool
+
+	// Reserve records an event at the earliest time it's allowed and returns how long until then.
+	// The caller is expected to wait that long before acting.
+	Reserve() time.Duration
+
+	// Wait blocks until an event is allowed and records it. If ctx is cancelled first Wait returns
+	// ctx.Err() and the reserved event still counts against the limit.
+	Wait(ctx context.Context) error
+}
+
+// sleep blocks for d or until ctx is cancelled.
+func sleep(ctx context.Context, clk clock.Clock, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-clk.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+var limiters = map[string]func(limit int, window time.Duration, clk clock.Clock) Limiter{
+	"sliding window log":     func(l int, w time.Duration, c clock.Clock) Limiter { return NewSlidingWindowLog(l, w, c) },
+	"sliding window counter": func(l int, w time.Duration, c clock.Clock) Limiter { return NewSlidingWindowCounter(l, w, c) },
+	"token bucket":           func(l int, w time.Duration, c clock.Clock) Limiter { return NewTokenBucket(l, w, c) },
+	"GCRA":                   func(l int, w time.Duration, c clock.Clock) Limiter { return NewGCRA(l, w, c) },
+}
+
+func TestLimiters(t *testing.T) {
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+
+			t.Run("allows a burst of limit events", func(t *testing.T) {
+				clk := clock.NewManual(time.Unix(0, 0))
+				l := newLimiter(4, time.Second, clk)
+				for range 4 {
+					assert.True(t, l.Allow())
+				}
+				assert.False(t, l.Allow())
+
+				clk.Advance(2 * time.Second)
+				for range 4 {
+					assert.True(t, l.Allow())
+				}
+				assert.False(t, l.Allow())
+			})
+
+			t.Run("reserves the next allowed time", func(t *testing.T) {
+				clk := clock.NewManual(time.Unix(0, 0))
+				l := newLimiter(4, time.Second, clk)
+				for range 4 {
+					assert.Zero(t, l.Reserve())
+				}
+				delay := l.Reserve()
+				assert.Positive(t, delay)
+				assert.LessOrEqual(t, delay, 2*time.Second)
+
+				next := l.Reserve()
+				assert.GreaterOrEqual(t, next, delay, "reservations queue up")
+				assert.False(t, l.Allow(), "reservations count against the limit")
+			})
+
+			t.Run("waits for the next allowed time", func(t *testing.T) {
+				clk := clock.NewManual(time.Unix(0, 0))
+				l := newLimiter(1, time.Second, clk)
+				require.NoError(t, l.Wait(context.Background()))
+
+				done := make(chan error)
+				go func() {
+					done <- l.Wait(context.Background())
+				}()
+				// The counter waits for the previous window to slide out entirely, which takes up to two
+				// windows.
+				require.Eventually(t, func() bool { return clk.Waiters() == 1 }, time.Second, time.Millisecond)
+				clk.Advance(2 * time.Second)
+				assert.NoError(t, <-done)
+			})
+
+			t.Run("stops waiting when ctx is cancelled", func(t *testing.T) {
+				l := newLimiter(1, time.Second, clock.NewManual(time.Unix(0, 0)))
+				assert.True(t, l.Allow())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				assert.ErrorIs(t, l.Wait(ctx), context.Canceled)
+			})
+		})
+	}
+}
+
+func TestSlidingWindowLog(t *testing.T) {
+	clk := clock.NewManual(time.Unix(0, 0))
+	l := NewSlidingWindowLog(2, time.Second, clk)
+	assert.True(t, l.Allow())
+	clk.Advance(100 * time.Millisecond)
+	assert.True(t, l.Allow())
+
+	assert.Equal(t, 900*time.Millisecond, l.Reserve())
+	assert.Equal(t, time.Unix(1, 100*int64(time.Millisecond)), l.NextAllowed())
+}
+
+func TestSlidingWindowCounter(t *testing.T) {
+	clk := clock.NewManual(time.Unix(0, 0))
+	l := NewSlidingWindowCounter(4, time.Second, clk)
+	for range 4 {
+		assert.True(t, l.Allow())
+	}
+
+	// A quarter into the next window the previous window's 4 events are weighted as 3.
+	clk.Advance(1250 * time.Millisecond)
+	assert.True(t, l.Allow())
+	assert.False(t, l.Allow())
+
+	// At half way they're weighted as 2, leaving room for one more.
+	assert.Equal(t, 250*time.Millisecond, l.Reserve())
+}
+
+func BenchmarkLimiters(b *testing.B) {
+	for name, newLimiter := range limiters {
+		b.Run(name, func(b *testing.B) {
+			// The clock moves on by the time the limit allows one event in, so calls are measured
+			// at the limit instead of rejected once the first window fills.
+			clk := clock.NewManual(time.Unix(0, 0))
+			l := newLimiter(1000, time.Second, clk)
+			rejected := 0
+			b.ResetTimer()
+			for range b.N {
+				clk.Advance(time.Millisecond)
+				if !l.Allow() {
+					rejected++
+				}
+			}
+			b.ReportMetric(float64(rejected)/float64(b.N), "rejected/op")
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ringbuf"
+)
+
+// SlidingWindowLog is a [Limiter] that keeps the time of the last limit events in a ring buffer
+// and allows an event when the oldest of them is at least a window ago. It's exact, but it stores
+// an entry per allowed event.
+type SlidingWindowLog struct {
+	limit  int
+	window time.Duration
+	clock  clock.Clock
+	mu     sync.Mutex
+	log    ringbuf.Buffer[time.Time]
+}
+
+// NewSlidingWindowLog creates a limiter that allows limit events per window. limit must be
+// positive.
+func NewSlidingWindowLog(limit int, window time.Duration, clk clock.Clock) *SlidingWindowLog {
+	return &SlidingWindowLog{
+		limit:  limit,
+		window: window,
+		clock:  clk,
+		log:    ringbuf.New[time.Time](limit),
+	}
+}
+
+func (l *SlidingWindowLog) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if l.nextAt(now).After(now) {
+		return false
+	}
+	l.log.Push(now)
+	return true
+}
+
+func (l *SlidingWindowLog) Reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	at := l.nextAt(now)
+	l.log.Push(at)
+	return at.Sub(now)
+}
+
+func (l *SlidingWindowLog) Wait(ctx context.Context) error {
+	return sleep(ctx, l.clock, l.Reserve())
+}
+
+// NextAllowed returns the earliest time an event would be allowed.
+func (l *SlidingWindowLog) NextAllowed() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextAt(l.clock.Now())
+}
+
+// setLimit changes the limit, keeping the most recent events. limit must be positive.
+func (l *SlidingWindowLog) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := ringbuf.New[time.Time](limit)
+	for i := max(0, l.log.Len()-limit); i < l.log.Len(); i++ {
+		t, _ := l.log.Get(i)
+		b.Push(t)
+	}
+	l.limit = limit
+	l.log = b
+}
+
+// nextAt must be called with l.mu held.
+func (l *SlidingWindowLog) nextAt(now time.Time) time.Time {
+	if l.log.Len() < l.limit {
+		return now
+	}
+	oldest, _ := l.log.Get(0)
+	if next := oldest.Add(l.window); next.After(now) {
+		return next
+	}
+	return now
+}
+
+// SlidingWindowCounter is a [Limiter] that only counts events per fixed window and estimates the
+// number in the sliding window by weighting the previous window's count by how much of it the
+// sliding window still overlaps. It uses constant memory but it's approximate: it assumes the
+// previous window's events were spread evenly across it.
+type SlidingWindowCounter struct {
+	limit  int
+	window time.Duration
+	clock  clock.Clock
+	mu     sync.Mutex
+
+	// counts holds the number of events in each window, by window number, for the previous and
+	// current windows and any future windows with reserved events.
+	counts map[int64]int
+
+	// current is the window counts were last expired in.
+	current int64
+}
+
+// NewSlidingWindowCounter creates a limiter that allows about limit events per window. limit must
+// be positive.
+func NewSlidingWindowCounter(limit int, window time.Duration, clk clock.Clock) *SlidingWindowCounter {
+	return &SlidingWindowCounter{
+		limit:  limit,
+		window: window,
+		clock:  clk,
+		counts: map[int64]int{},
+	}
+}
+
+func (c *SlidingWindowCounter) Allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	c.expire(now)
+	if c.nextAt(now).After(now) {
+		return false
+	}
+	c.counts[c.windowOf(now)]++
+	return true
+}
+
+func (c *SlidingWindowCounter) Reserve() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	c.expire(now)
+	at := c.nextAt(now)
+	c.counts[c.windowOf(at)]++
+	return at.Sub(now)
+}
+
+func (c *SlidingWindowCounter) Wait(ctx context.Context) error {
+	return sleep(ctx, c.clock, c.Reserve())
+}
+
+func (c *SlidingWindowCounter) windowOf(t time.Time) int64 {
+	return t.UnixNano() / int64(c.window)
+}
+
+// expire forgets windows before the previous one. It must be called with c.mu held.
+func (c *SlidingWindowCounter) expire(now time.Time) {
+	current := c.windowOf(now)
+	if current == c.current {
+		return
+	}
+	c.current = current
+	for n := range c.counts {
+		if n < current-1 {
+			delete(c.counts, n)
+		}
+	}
+}
+
+// nextAt returns the earliest time at or after now that the estimate leaves room for another
+// event. It must be called with c.mu held.
+func (c *SlidingWindowCounter) nextAt(now time.Time) time.Time {
+	for n := c.windowOf(now); ; n++ {
+		curr, prev := c.counts[n], c.counts[n-1]
+		if curr >= c.limit {
+			continue
+		}
+		at := time.Unix(0, n*int64(c.window))
+		if prev > 0 {
+			// The previous window's weight falls linearly to zero across this one, so there's room
+			// once it's no more than the capacity this window has left.
+			overlap := float64(c.limit-1-curr) / float64(prev)
+			if overlap < 1 {
+				at = at.Add(time.Duration(math.Ceil((1 - overlap) * float64(c.window))))
+			}
+		}
+		if at.Before(now) {
+			return now
+		}
+		return at
+	}
+}
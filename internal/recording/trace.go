@@ -0,0 +1,249 @@
+// Package recording records produced messages to JSON Lines traces and replays them with their
+// original timing, so captured traffic can be reproduced against the consumer.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+// An Entry is one line of a trace: a message and when it was produced relative to the start of
+// the recording.
+type Entry struct {
+	// At is the time since the recording started, in nanoseconds.
+	At time.Duration `json:"at_ns"`
+
+	Topic   string   `json:"topic,omitempty"`
+	Key     []byte   `json:"key,omitempty"`
+	Headers []Header `json:"headers,omitempty"`
+
+	// Value is the message exactly as it was produced. Hand-written traces can leave it out and
+	// set Message instead, which is encoded when the entry is replayed.
+	Value []byte `json:"value,omitempty"`
+
+	// Message is the decoded message, when it could be decoded, so traces can be read and
+	// filtered without decoding Value.
+	Message *messages.Message `json:"message,omitempty"`
+}
+
+// A Header is a message header. Values are bytes like Key and Value, so binary headers are
+// recorded exactly.
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// A Writer writes entries to a trace. It's safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	clock clock.Clock
+	start time.Time
+	w     *bufio.Writer
+	enc   *json.Encoder
+}
+
+// NewWriter creates a writer that writes entries to w, timed relative to now.
+func NewWriter(w io.Writer, clk clock.Clock) *Writer {
+	bw := bufio.NewWriter(w)
+	return &Writer{
+		clock: clk,
+		start: clk.Now(),
+		w:     bw,
+		enc:   json.NewEncoder(bw),
+	}
+}
+
+// Write appends env to the trace.
+func (w *Writer) Write(env messages.Envelope) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := Entry{
+		At:    w.clock.Now().Sub(w.start),
+		Topic: env.Topic,
+		Key:   env.Key,
+		Value: env.Raw,
+	}
+	for _, h := range env.Headers {
+		entry.Headers = append(entry.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	decoded := env
+	if err := messages.Decode(&decoded); err == nil {
+		entry.Message = &decoded.Message
+	}
+	return w.enc.Encode(entry)
+}
+
+// Flush writes any buffered entries to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
+
+// Recorder is a [broker.Producer] that writes every message it produces successfully to a trace.
+type Recorder struct {
+	broker.Producer
+	trace *Writer
+}
+
+// NewRecorder wraps producer so its messages are recorded to trace.
+func NewRecorder(producer broker.Producer, trace *Writer) *Recorder {
+	return &Recorder{Producer: producer, trace: trace}
+}
+
+func (r *Recorder) Produce(ctx context.Context, env messages.Envelope) error {
+	if err := r.Producer.Produce(ctx, env); err != nil {
+		return err
+	}
+	if err := r.trace.Write(env); err != nil {
+		return fmt.Errorf("record message: %w", err)
+	}
+	return nil
+}
+
+func (r *Recorder) Flush(ctx context.Context) error {
+	if err := r.trace.Flush(); err != nil {
+		return fmt.Errorf("flush trace: %w", err)
+	}
+	return r.Producer.Flush(ctx)
+}
+
+// Close flushes the trace and closes the wrapped producer.
+func (r *Recorder) Close() error {
+	return errors.Join(r.trace.Flush(), r.Producer.Close())
+}
+
+// A Reader reads entries from a trace.
+type Reader struct {
+	dec  *json.Decoder
+	line int
+}
+
+// NewReader creates a reader that reads entries from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next entry, or [io.EOF] at the end of the trace.
+func (r *Reader) Read() (Entry, error) {
+	entry := Entry{}
+	if err := r.dec.Decode(&entry); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Entry{}, io.EOF
+		}
+		return Entry{}, fmt.Errorf("entry %d: %w", r.line+1, err)
+	}
+	r.line++
+	return entry, nil
+}
+
+// ReplayOptions controls how a trace is replayed.
+type ReplayOptions struct {
+	// Speed scales time: 2 replays the trace twice as fast as it was recorded. Defaults to 1.
+	Speed float64
+
+	// Topic overrides the topic every entry is produced to when it's set. Entries without a topic
+	// need it.
+	Topic string
+
+	// Codec and Version encode entries that only have a Message. Codec defaults to JSON and
+	// Version to the current schema version.
+	Codec   messages.Codec
+	Version int
+}
+
+// Replay produces the entries in trace with producer, waiting between them so they're produced
+// with their recorded inter-arrival times scaled by opts.Speed. It returns the number of entries
+// produced when the trace ends or ctx is cancelled.
+func Replay(
+	ctx context.Context,
+	clk clock.Clock,
+	trace *Reader,
+	producer broker.Producer,
+	opts ReplayOptions,
+) (int, error) {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.Codec == nil {
+		opts.Codec = messages.JSON{}
+	}
+	if opts.Version == 0 {
+		opts.Version = messages.CurrentSchemaVersion
+	}
+
+	start := clk.Now()
+	produced := 0
+	for {
+		entry, err := trace.Read()
+		if errors.Is(err, io.EOF) {
+			return produced, nil
+		}
+		if err != nil {
+			return produced, err
+		}
+
+		env, err := envelope(entry, opts)
+		if err != nil {
+			return produced, fmt.Errorf("entry %d: %w", produced+1, err)
+		}
+
+		due := start.Add(time.Duration(float64(entry.At) / opts.Speed))
+		select {
+		case <-clk.After(due.Sub(clk.Now())):
+		case <-ctx.Done():
+			return produced, ctx.Err()
+		}
+
+		env.Timestamp = clk.Now()
+		if err := producer.Produce(ctx, env); err != nil {
+			return produced, fmt.Errorf("produce entry %d: %w", produced+1, err)
+		}
+		produced++
+	}
+}
+
+// envelope returns the message entry describes.
+func envelope(entry Entry, opts ReplayOptions) (messages.Envelope, error) {
+	env := messages.Envelope{
+		Topic: entry.Topic,
+		Key:   entry.Key,
+		Raw:   entry.Value,
+	}
+	if opts.Topic != "" {
+		env.Topic = opts.Topic
+	}
+	if env.Topic == "" {
+		return messages.Envelope{}, errors.New("entry has no topic")
+	}
+	// Headers are appended rather than set so repeated keys are replayed as they were produced.
+	for _, h := range entry.Headers {
+		env.Headers = append(env.Headers, messages.Header{Key: h.Key, Value: h.Value})
+	}
+	if env.Raw != nil {
+		return env, nil
+	}
+	if entry.Message == nil {
+		return messages.Envelope{}, errors.New("entry has neither a value nor a message")
+	}
+	data, headers, err := messages.Encode(opts.Codec, opts.Version, *entry.Message)
+	if err != nil {
+		return messages.Envelope{}, fmt.Errorf("encode message: %w", err)
+	}
+	env.Raw = data
+	for _, h := range headers {
+		env.SetHeader(h.Key, h.Value)
+	}
+	return env, nil
+}
@@ -0,0 +1,133 @@
+package recording
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+)
+
+func TestRecording(t *testing.T) {
+
+	start := time.Unix(0, 0).UTC()
+	tp := broker.TopicPartition{Topic: "messages", Partition: 0}
+
+	encode := func(t *testing.T, customerID string) messages.Envelope {
+		data, headers, err := messages.Encode(messages.Avro{}, messages.CurrentSchemaVersion, messages.Message{
+			CustomerID: customerID,
+			Type:       "foo",
+		})
+		require.NoError(t, err)
+		return messages.Envelope{Topic: "messages", Key: []byte(customerID), Headers: headers, Raw: data}
+	}
+
+	t.Run("records produced messages with relative times", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		m := broker.NewMemory(1)
+		buf := &bytes.Buffer{}
+		recorder := NewRecorder(m.Producer(), NewWriter(buf, clk))
+
+		clk.Advance(time.Second)
+		require.NoError(t, recorder.Produce(context.Background(), encode(t, "a")))
+		clk.Advance(250 * time.Millisecond)
+		require.NoError(t, recorder.Produce(context.Background(), messages.Envelope{Topic: "messages", Raw: []byte("not avro")}))
+		require.NoError(t, recorder.Close())
+		assert.Equal(t, int64(2), m.Len(tp))
+
+		r := NewReader(buf)
+		first, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, time.Second, first.At)
+		assert.Equal(t, []byte("a"), first.Key)
+		require.NotNil(t, first.Message)
+		assert.Equal(t, "a", first.Message.CustomerID)
+
+		second, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, 1250*time.Millisecond, second.At)
+		assert.Equal(t, []byte("not avro"), second.Value)
+		assert.Nil(t, second.Message, "messages that can't be decoded are recorded as they are")
+	})
+
+	t.Run("replays a trace exactly with scaled timing", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, clock.NewManual(start))
+		original := encode(t, "a")
+		require.NoError(t, w.Write(original))
+		require.NoError(t, w.Flush())
+		buf.WriteString(`{"at_ns": 2000000000, "message": {"customer_id": "b", "type": "bar"}}` + "\n")
+
+		clk := clock.NewManual(start)
+		m := broker.NewMemory(1)
+		done := make(chan int)
+		go func() {
+			n, err := Replay(context.Background(), clk, NewReader(buf), m.Producer(), ReplayOptions{Speed: 2, Topic: "messages"})
+			assert.NoError(t, err)
+			done <- n
+		}()
+
+		require.Eventually(t, func() bool { return m.Len(tp) == 1 && clk.Waiters() == 1 }, time.Second, time.Millisecond)
+		clk.Advance(999 * time.Millisecond)
+		assert.Equal(t, int64(1), m.Len(tp), "the second entry is due after one second at double speed")
+		clk.Advance(time.Millisecond)
+		assert.Equal(t, 2, <-done)
+
+		consumer := m.Consumer("test", "messages")
+		replayed, err := consumer.Consume(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, original.Raw, replayed.Raw)
+		assert.Equal(t, original.Key, replayed.Key)
+		assert.Equal(t, original.Headers, replayed.Headers)
+		require.NoError(t, consumer.Commit(context.Background(), replayed))
+
+		encoded, err := consumer.Consume(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, messages.Decode(&encoded))
+		assert.Equal(t, "b", encoded.Message.CustomerID)
+		assert.Equal(t, start.Add(time.Second), encoded.Timestamp)
+	})
+
+	t.Run("replays binary and repeated headers exactly", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf, clock.NewManual(start))
+		original := messages.Envelope{
+			Topic: "messages",
+			Headers: []messages.Header{
+				{Key: "traceparent", Value: []byte{0x00, 0xff, 0xfe, 0x80}},
+				{Key: "hop", Value: []byte("a")},
+				{Key: "hop", Value: []byte("b")},
+			},
+			Raw: []byte("raw"),
+		}
+		require.NoError(t, w.Write(original))
+		require.NoError(t, w.Flush())
+
+		m := broker.NewMemory(1)
+		n, err := Replay(context.Background(), clock.NewManual(start), NewReader(buf), m.Producer(), ReplayOptions{Speed: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		replayed, err := m.Consumer("test", "messages").Consume(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, original.Headers, replayed.Headers)
+	})
+
+	t.Run("rejects entries it can't produce", func(t *testing.T) {
+		for _, trace := range []string{
+			`{"at_ns": 0, "value": "eA=="}`,
+			`{"at_ns": 0, "topic": "messages"}`,
+			`{"at_ns": "soon"}`,
+		} {
+			_, err := Replay(context.Background(), clock.NewManual(start), NewReader(strings.NewReader(trace)), broker.NewMemory(1).Producer(), ReplayOptions{})
+			assert.Error(t, err, trace)
+		}
+	})
+}
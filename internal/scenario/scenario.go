@@ -0,0 +1,385 @@
+// Package scenario describes producer load profiles: which customers and message types are
+// produced, how often each is picked, and how the rate changes over time, so specific incident
+// shapes can be reproduced against the consumer.
+package scenario
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// A Scenario is a base rate of messages spread over weighted customers and message types, and
+// timed phases that change the rate or add traffic.
+type Scenario struct {
+	Name string `json:"name"`
+
+	// Seed seeds the random choice of customers and types. Zero picks a different seed each run.
+	Seed int64 `json:"seed"`
+
+	// BaseRate is the number of messages per second produced outside of any phase.
+	BaseRate float64 `json:"base_rate"`
+
+	Customers []Weighted `json:"customers"`
+	Types     []Weighted `json:"types"`
+	Phases    []Phase    `json:"phases"`
+
+	// TimeScale is how many seconds of the scenario pass per second of producing, so long
+	// patterns can be compressed: 1440 runs a day in a minute. Phase times are in scenario time
+	// but rates are still per real second. Defaults to 1.
+	TimeScale float64 `json:"time_scale"`
+
+	// Arrivals is how messages are spaced: [Uniform], the default, or [Poisson].
+	Arrivals string `json:"arrivals"`
+}
+
+// Arrival processes.
+const (
+	// Uniform spaces messages evenly at the rate.
+	Uniform = "uniform"
+
+	// Poisson spaces messages randomly with exponentially distributed gaps that average out to
+	// the rate, like independent clients would.
+	Poisson = "poisson"
+)
+
+// Weighted is a customer or message type that's picked with probability proportional to Weight.
+type Weighted struct {
+	Name string `json:"name"`
+
+	// Weight defaults to 1.
+	Weight float64 `json:"weight"`
+}
+
+// Phase kinds.
+const (
+	// Step replaces the base rate with Rate.
+	Step = "step"
+
+	// Ramp moves the base rate linearly from From to To over the phase.
+	Ramp = "ramp"
+
+	// Spike multiplies the base rate by Multiplier.
+	Spike = "spike"
+
+	// Noisy adds Rate messages per second for Customer, with the message type picked as usual or
+	// fixed to Type.
+	Noisy = "noisy"
+
+	// Sine multiplies the base rate by a sine wave that swings Amplitude either side of 1 every
+	// Period, starting Offset into the wave.
+	Sine = "sine"
+
+	// Daily multiplies the base rate by a daily Curve, interpolated linearly between its points
+	// and repeated every 24 hours. Offset is the time of day the phase starts at.
+	Daily = "daily"
+)
+
+// Day is the length of a [Daily] curve.
+const Day = 24 * time.Hour
+
+// A Phase changes the traffic between Start and Start+Duration.
+type Phase struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+
+	Start Duration `json:"start"`
+
+	// Duration is how long the phase lasts. Zero means it lasts forever.
+	Duration Duration `json:"duration"`
+
+	Rate       float64 `json:"rate"`
+	From       float64 `json:"from"`
+	To         float64 `json:"to"`
+	Multiplier float64 `json:"multiplier"`
+	Customer   string  `json:"customer"`
+	Type       string  `json:"type"`
+
+	Period    Duration     `json:"period"`
+	Amplitude float64      `json:"amplitude"`
+	Offset    Duration     `json:"offset"`
+	Curve     []CurvePoint `json:"curve"`
+}
+
+// A CurvePoint is the multiplier a [Daily] phase applies at a time of day.
+type CurvePoint struct {
+	At         Duration `json:"at"`
+	Multiplier float64  `json:"multiplier"`
+}
+
+// Duration is a [time.Duration] that's written as a string like "1m30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s := ""
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default is the producer's traffic when no scenario is given: four customers and three message
+// types picked uniformly at 900 messages per second, 90% of the producer's default max rate.
+func Default() *Scenario {
+	return &Scenario{
+		Name:     "default",
+		BaseRate: 900,
+		Customers: []Weighted{
+			{Name: "faa108f9-0815-4035-89c4-403b4f2f7948", Weight: 1},
+			{Name: "e62358f4-47bb-4a45-9db3-a1c5ad6cdab2", Weight: 1},
+			{Name: "139b70a3-60e8-47a0-9b7d-d8a369d18417", Weight: 1},
+			{Name: "432556b3-0a3b-4dbb-83fc-187115228f67", Weight: 1},
+		},
+		Types: []Weighted{
+			{Name: "foo", Weight: 1},
+			{Name: "bar", Weight: 1},
+			{Name: "baz", Weight: 1},
+		},
+	}
+}
+
+// Load reads and validates a JSON scenario file.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parse scenario: %w", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %w", err)
+	}
+	return s, nil
+}
+
+// Validate checks s for mistakes and fills in default weights.
+func (s *Scenario) Validate() error {
+	if s.BaseRate < 0 {
+		return errors.New("base_rate must not be negative")
+	}
+	if len(s.Customers) == 0 {
+		return errors.New("at least one customer is required")
+	}
+	if len(s.Types) == 0 {
+		return errors.New("at least one type is required")
+	}
+	for _, weighted := range [][]Weighted{s.Customers, s.Types} {
+		for i, w := range weighted {
+			if w.Name == "" {
+				return fmt.Errorf("customer or type %d has no name", i)
+			}
+			if w.Weight < 0 {
+				return fmt.Errorf("%q has a negative weight", w.Name)
+			}
+			if w.Weight == 0 {
+				weighted[i].Weight = 1
+			}
+		}
+	}
+	for i, p := range s.Phases {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("phase %d", i)
+		}
+		switch p.Kind {
+		case Step:
+			if p.Rate < 0 {
+				return fmt.Errorf("%s: rate must not be negative", name)
+			}
+		case Ramp:
+			if p.Duration <= 0 {
+				return fmt.Errorf("%s: a ramp needs a duration", name)
+			}
+			if p.From < 0 || p.To < 0 {
+				return fmt.Errorf("%s: from and to must not be negative", name)
+			}
+		case Spike:
+			if p.Multiplier < 0 {
+				return fmt.Errorf("%s: multiplier must not be negative", name)
+			}
+		case Noisy:
+			if p.Customer == "" {
+				return fmt.Errorf("%s: a noisy phase needs a customer", name)
+			}
+			if p.Rate < 0 {
+				return fmt.Errorf("%s: rate must not be negative", name)
+			}
+		case Sine:
+			if p.Period <= 0 {
+				return fmt.Errorf("%s: a sine phase needs a period", name)
+			}
+			if p.Amplitude < 0 || p.Amplitude > 1 {
+				return fmt.Errorf("%s: amplitude must be between 0 and 1", name)
+			}
+		case Daily:
+			if len(p.Curve) == 0 {
+				return fmt.Errorf("%s: a daily phase needs a curve", name)
+			}
+			for j, point := range p.Curve {
+				if point.At < 0 || time.Duration(point.At) >= Day {
+					return fmt.Errorf("%s: curve times must be within a day", name)
+				}
+				if j > 0 && point.At <= p.Curve[j-1].At {
+					return fmt.Errorf("%s: curve times must be in increasing order", name)
+				}
+				if point.Multiplier < 0 {
+					return fmt.Errorf("%s: curve multipliers must not be negative", name)
+				}
+			}
+		default:
+			return fmt.Errorf("%s: unsupported kind %q", name, p.Kind)
+		}
+		if p.Start < 0 || p.Duration < 0 {
+			return fmt.Errorf("%s: start and duration must not be negative", name)
+		}
+	}
+	if s.TimeScale < 0 {
+		return errors.New("time_scale must not be negative")
+	}
+	switch s.Arrivals {
+	case "", Uniform, Poisson:
+	default:
+		return fmt.Errorf("unsupported arrivals %q", s.Arrivals)
+	}
+	return nil
+}
+
+// scaled converts time spent producing to time into the scenario.
+func (s *Scenario) scaled(elapsed time.Duration) time.Duration {
+	if s.TimeScale == 0 {
+		return elapsed
+	}
+	return time.Duration(float64(elapsed) * s.TimeScale)
+}
+
+// NewRand returns the source of randomness for picking customers and types, seeded with Seed if
+// it's set.
+func (s *Scenario) NewRand() *rand.Rand {
+	seed := s.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+func (p Phase) active(elapsed time.Duration) bool {
+	start := time.Duration(p.Start)
+	return elapsed >= start && (p.Duration == 0 || elapsed < start+time.Duration(p.Duration))
+}
+
+// baseRate returns the rate of the weighted traffic elapsed into the scenario. Phases apply in
+// order, so a spike after a step multiplies the step's rate.
+func (s *Scenario) baseRate(elapsed time.Duration) float64 {
+	rate := s.BaseRate
+	for _, p := range s.Phases {
+		if !p.active(elapsed) {
+			continue
+		}
+		switch p.Kind {
+		case Step:
+			rate = p.Rate
+		case Ramp:
+			progress := float64(elapsed-time.Duration(p.Start)) / float64(p.Duration)
+			rate = p.From + (p.To-p.From)*progress
+		case Spike:
+			rate *= p.Multiplier
+		case Sine:
+			angle := 2 * math.Pi * float64(elapsed-time.Duration(p.Start)+time.Duration(p.Offset)) / float64(p.Period)
+			rate *= 1 + p.Amplitude*math.Sin(angle)
+		case Daily:
+			rate *= p.curve(elapsed - time.Duration(p.Start) + time.Duration(p.Offset))
+		}
+	}
+	return rate
+}
+
+// curve returns the daily curve's multiplier at a time of day, interpolating between the points
+// either side of it and wrapping around midnight.
+func (p Phase) curve(at time.Duration) float64 {
+	at %= Day
+	last := p.Curve[len(p.Curve)-1]
+	prev := CurvePoint{At: last.At - Duration(Day), Multiplier: last.Multiplier}
+	for _, next := range p.Curve {
+		if time.Duration(next.At) > at {
+			return interpolate(prev, next, at)
+		}
+		prev = next
+	}
+	first := p.Curve[0]
+	return interpolate(prev, CurvePoint{At: first.At + Duration(Day), Multiplier: first.Multiplier}, at)
+}
+
+func interpolate(a CurvePoint, b CurvePoint, at time.Duration) float64 {
+	if b.At == a.At {
+		return a.Multiplier
+	}
+	progress := float64(at-time.Duration(a.At)) / float64(b.At-a.At)
+	return a.Multiplier + (b.Multiplier-a.Multiplier)*progress
+}
+
+// Rate returns the total number of messages per second elapsed into the scenario, where elapsed
+// is the time spent producing before it's scaled by TimeScale.
+func (s *Scenario) Rate(elapsed time.Duration) float64 {
+	elapsed = s.scaled(elapsed)
+	rate := s.baseRate(elapsed)
+	for _, p := range s.Phases {
+		if p.Kind == Noisy && p.active(elapsed) {
+			rate += p.Rate
+		}
+	}
+	return rate
+}
+
+// Pick chooses the customer and message type of a message produced elapsed into the scenario.
+// Noisy phases are picked in proportion to their share of the total rate.
+func (s *Scenario) Pick(elapsed time.Duration, rng *rand.Rand) (customer string, type_ string) {
+	n := rng.Float64() * s.Rate(elapsed)
+	elapsed = s.scaled(elapsed)
+	n -= s.baseRate(elapsed)
+	for _, p := range s.Phases {
+		if n < 0 {
+			break
+		}
+		if p.Kind != Noisy || !p.active(elapsed) {
+			continue
+		}
+		if n < p.Rate {
+			if p.Type != "" {
+				return p.Customer, p.Type
+			}
+			return p.Customer, pick(s.Types, rng)
+		}
+		n -= p.Rate
+	}
+	return pick(s.Customers, rng), pick(s.Types, rng)
+}
+
+func pick(weighted []Weighted, rng *rand.Rand) string {
+	total := 0.0
+	for _, w := range weighted {
+		total += w.Weight
+	}
+	n := rng.Float64() * total
+	for _, w := range weighted {
+		if n < w.Weight {
+			return w.Name
+		}
+		n -= w.Weight
+	}
+	return weighted[len(weighted)-1].Name
+}
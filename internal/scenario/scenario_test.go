@@ -0,0 +1,182 @@
+package scenario
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenario(t *testing.T) {
+
+	t.Run("phases change the rate while they're active", func(t *testing.T) {
+		s := &Scenario{
+			BaseRate:  100,
+			Customers: []Weighted{{Name: "a"}},
+			Types:     []Weighted{{Name: "foo"}},
+			Phases: []Phase{
+				{Kind: Ramp, Start: Duration(10 * time.Second), Duration: Duration(10 * time.Second), From: 100, To: 200},
+				{Kind: Step, Start: Duration(20 * time.Second), Duration: Duration(10 * time.Second), Rate: 50},
+				{Kind: Spike, Start: Duration(25 * time.Second), Duration: Duration(time.Second), Multiplier: 4},
+				{Kind: Noisy, Start: Duration(40 * time.Second), Customer: "b", Rate: 300},
+			},
+		}
+		require.NoError(t, s.Validate())
+
+		assert.Equal(t, 100.0, s.Rate(5*time.Second))
+		assert.Equal(t, 150.0, s.Rate(15*time.Second))
+		assert.Equal(t, 50.0, s.Rate(20*time.Second))
+		assert.Equal(t, 200.0, s.Rate(25*time.Second))
+		assert.Equal(t, 100.0, s.Rate(30*time.Second))
+		assert.Equal(t, 400.0, s.Rate(time.Hour), "a phase without a duration lasts forever")
+	})
+
+	t.Run("picks customers and types by weight", func(t *testing.T) {
+		s := &Scenario{
+			BaseRate:  100,
+			Customers: []Weighted{{Name: "a", Weight: 3}, {Name: "b", Weight: 1}},
+			Types:     []Weighted{{Name: "foo"}},
+		}
+		require.NoError(t, s.Validate())
+
+		rng := rand.New(rand.NewSource(1))
+		counts := map[string]int{}
+		for range 10000 {
+			customer, type_ := s.Pick(0, rng)
+			assert.Equal(t, "foo", type_)
+			counts[customer]++
+		}
+		assert.InDelta(t, 7500, counts["a"], 250)
+		assert.InDelta(t, 2500, counts["b"], 250)
+	})
+
+	t.Run("noisy customers get their share of the rate", func(t *testing.T) {
+		s := &Scenario{
+			BaseRate:  100,
+			Customers: []Weighted{{Name: "a"}},
+			Types:     []Weighted{{Name: "foo"}, {Name: "bar"}},
+			Phases:    []Phase{{Kind: Noisy, Customer: "noisy", Type: "bar", Rate: 300}},
+		}
+		require.NoError(t, s.Validate())
+
+		rng := rand.New(rand.NewSource(1))
+		counts := map[string]int{}
+		for range 10000 {
+			customer, type_ := s.Pick(0, rng)
+			if customer == "noisy" {
+				assert.Equal(t, "bar", type_)
+			}
+			counts[customer]++
+		}
+		assert.InDelta(t, 7500, counts["noisy"], 250)
+	})
+
+	t.Run("the same seed picks the same traffic", func(t *testing.T) {
+		s := Default()
+		s.Seed = 42
+		first, second := s.NewRand(), s.NewRand()
+		for range 100 {
+			c1, t1 := s.Pick(0, first)
+			c2, t2 := s.Pick(0, second)
+			assert.Equal(t, c1+t1, c2+t2)
+		}
+	})
+
+	t.Run("periodic phases shape the base rate", func(t *testing.T) {
+		s := &Scenario{
+			BaseRate:  100,
+			Customers: []Weighted{{Name: "a"}},
+			Types:     []Weighted{{Name: "foo"}},
+			Phases: []Phase{
+				{Kind: Sine, Duration: Duration(time.Hour), Period: Duration(time.Minute), Amplitude: 0.5},
+				{
+					Kind:   Daily,
+					Start:  Duration(time.Hour),
+					Offset: Duration(12 * time.Hour),
+					Curve: []CurvePoint{
+						{At: Duration(6 * time.Hour), Multiplier: 0.5},
+						{At: Duration(18 * time.Hour), Multiplier: 2},
+					},
+				},
+			},
+		}
+		require.NoError(t, s.Validate())
+
+		assert.InDelta(t, 100, s.Rate(0), 0.001)
+		assert.InDelta(t, 150, s.Rate(15*time.Second), 0.001)
+		assert.InDelta(t, 50, s.Rate(45*time.Second), 0.001)
+
+		// The daily phase starts at noon, half way between the curve's points, and wraps around
+		// midnight between 18:00 and 06:00.
+		assert.InDelta(t, 125, s.Rate(time.Hour), 0.001)
+		assert.InDelta(t, 200, s.Rate(7*time.Hour), 0.001)
+		assert.InDelta(t, 125, s.Rate(13*time.Hour), 0.001)
+		assert.InDelta(t, 50, s.Rate(19*time.Hour), 0.001)
+	})
+
+	t.Run("time scale compresses the scenario", func(t *testing.T) {
+		s := &Scenario{
+			BaseRate:  100,
+			Customers: []Weighted{{Name: "a"}},
+			Types:     []Weighted{{Name: "foo"}},
+			Phases:    []Phase{{Kind: Step, Start: Duration(time.Hour), Rate: 10}},
+			TimeScale: 60,
+		}
+		require.NoError(t, s.Validate())
+		assert.Equal(t, 100.0, s.Rate(59*time.Second))
+		assert.Equal(t, 10.0, s.Rate(time.Minute))
+	})
+}
+
+func TestLoad(t *testing.T) {
+
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "scenario.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	t.Run("loads a scenario and defaults weights", func(t *testing.T) {
+		s, err := Load(write(t, `{
+			"name": "spike",
+			"base_rate": 10,
+			"customers": [{ "name": "a" }],
+			"types": [{ "name": "foo", "weight": 2 }],
+			"phases": [{ "kind": "spike", "start": "1m", "duration": "30s", "multiplier": 5 }]
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, "spike", s.Name)
+		assert.Equal(t, 1.0, s.Customers[0].Weight)
+		assert.Equal(t, 2.0, s.Types[0].Weight)
+		assert.Equal(t, 50.0, s.Rate(time.Minute))
+	})
+
+	t.Run("rejects invalid scenarios", func(t *testing.T) {
+		for _, content := range []string{
+			`{ "base_rate": 10, "types": [{ "name": "foo" }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "phases": [{ "kind": "ramp", "to": 5 }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "phases": [{ "kind": "noisy", "rate": 5 }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "phases": [{ "kind": "wobble" }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "phases": [{ "kind": "sine", "amplitude": 0.5 }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "phases": [{ "kind": "daily", "curve": [{ "at": "12h" }, { "at": "6h" }] }] }`,
+			`{ "base_rate": 10, "customers": [{ "name": "a" }], "types": [{ "name": "foo" }], "arrivals": "bursty" }`,
+		} {
+			_, err := Load(write(t, content))
+			assert.Error(t, err, content)
+		}
+	})
+
+	t.Run("loads the checked in scenarios", func(t *testing.T) {
+		paths, err := filepath.Glob("../../scenarios/*.json")
+		require.NoError(t, err)
+		require.NotEmpty(t, paths)
+		for _, path := range paths {
+			_, err := Load(path)
+			assert.NoError(t, err, path)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Config describes a simulation: the workload the producer generates, how fast the consumer can
+// pull messages, the dependency's capacity, and the limiter policies to compare.
+type Config struct {
+	// Duration is how much simulated time each policy runs for.
+	Duration Duration `json:"duration"`
+
+	// Step is the resolution of the simulation. Defaults to 10ms.
+	Step Duration `json:"step"`
+
+	Workload []Stream `json:"workload"`
+
+	// ConsumerRate is the number of messages per second the consumer can pull from the broker. Zero
+	// means the consumer keeps up with whatever is available.
+	ConsumerRate float64 `json:"consumer_rate"`
+
+	Dependency DependencyModel `json:"dependency"`
+
+	// Policies are run one after the other against the same workload.
+	Policies []Policy `json:"policies"`
+}
+
+// A Stream is a constant rate of messages for one customer and message type between Start and End.
+type Stream struct {
+	CustomerID string   `json:"customer_id"`
+	Type       string   `json:"type"`
+	Rate       float64  `json:"rate"`
+	Start      Duration `json:"start"`
+
+	// End is when the stream stops. Zero means it runs until the end of the simulation.
+	End Duration `json:"end"`
+}
+
+// DependencyModel models the README's dependency: each processed message puts Cost (`s`) pressure
+// on it and calls fail once the pressure within a second exceeds Limit (`l`).
+type DependencyModel struct {
+	// Limit is the pressure per second the dependency can handle. Zero means unlimited.
+	Limit float64 `json:"limit"`
+
+	// Cost is the pressure a single message puts on the dependency. Defaults to 1.
+	Cost float64 `json:"cost"`
+}
+
+// A Policy configures the consumer's per-key limiter.
+type Policy struct {
+	Name string `json:"name"`
+
+	// Limit is the number of messages per key allowed per Window. Zero disables limiting.
+	Limit int `json:"limit"`
+
+	// Window defaults to one second.
+	Window Duration `json:"window"`
+
+	// Action is what happens to limited messages from the consume topic: "defer" (the default) or
+	// "pause".
+	Action string `json:"action"`
+
+	// Backoff decides when deferred messages are retried: "refill" (the default), "exponential",
+	// or "none". BackoffBase and BackoffMax configure the exponential backoff and default to one
+	// second and one minute.
+	Backoff     string   `json:"backoff"`
+	BackoffBase Duration `json:"backoff_base"`
+	BackoffMax  Duration `json:"backoff_max"`
+}
+
+// Duration is a [time.Duration] that's written as a string like "1m30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s := ""
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = Duration(10 * time.Millisecond)
+	}
+	if time.Second%time.Duration(cfg.Step) != 0 {
+		return errors.New("step must evenly divide one second")
+	}
+	if cfg.Dependency.Cost <= 0 {
+		cfg.Dependency.Cost = 1
+	}
+	if len(cfg.Policies) == 0 {
+		cfg.Policies = []Policy{{Name: "unlimited"}}
+	}
+	for i, policy := range cfg.Policies {
+		if policy.Name == "" {
+			return fmt.Errorf("policy %d has no name", i)
+		}
+		if policy.Window <= 0 {
+			cfg.Policies[i].Window = Duration(time.Second)
+		}
+		if policy.BackoffBase <= 0 {
+			cfg.Policies[i].BackoffBase = Duration(time.Second)
+		}
+		if policy.BackoffMax <= 0 {
+			cfg.Policies[i].BackoffMax = Duration(time.Minute)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package sim
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+var csvHeader = []string{
+	"policy",
+	"second",
+	"key",
+	"produced",
+	"processed",
+	"deferred",
+	"failed",
+	"lag",
+	"deferred_backlog",
+	"latency_p50_ms",
+	"latency_p99_ms",
+	"latency_max_ms",
+}
+
+// WriteCSV writes samples as CSV with a header row.
+func WriteCSV(w io.Writer, samples []Sample) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, s := range samples {
+		err := cw.Write([]string{
+			s.Policy,
+			strconv.Itoa(s.Second),
+			s.Key,
+			strconv.Itoa(s.Produced),
+			strconv.Itoa(s.Processed),
+			strconv.Itoa(s.Deferred),
+			strconv.Itoa(s.Failed),
+			strconv.Itoa(s.Lag),
+			strconv.Itoa(s.DeferredBacklog),
+			strconv.FormatFloat(s.LatencyP50, 'f', -1, 64),
+			strconv.FormatFloat(s.LatencyP99, 'f', -1, 64),
+			strconv.FormatFloat(s.LatencyMax, 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes samples as a JSON array.
+func WriteJSON(w io.Writer, samples []Sample) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "   ")
+	return enc.Encode(samples)
+}
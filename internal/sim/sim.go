@@ -0,0 +1,347 @@
+// Package sim runs the consumer's real handler and limiter against a virtual clock, a synthetic
+// workload, and a modeled dependency so limiter policies can be compared in seconds rather than by
+// running the whole system for minutes.
+package sim
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/broker"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/messages"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/metrics"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/pipeline"
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/ratelimit"
+)
+
+const (
+	consumeTopic = "messages"
+	deferTopic   = "messages-deferred"
+)
+
+// ErrOverloaded is returned by the modeled dependency when the pressure on it exceeds its limit.
+var ErrOverloaded = errors.New("dependency overloaded")
+
+// A Sample describes what happened to one key during one second of a policy's simulation.
+type Sample struct {
+	Policy string `json:"policy"`
+
+	// Second is the number of simulated seconds since the start of the run when the sample ends.
+	Second int    `json:"second"`
+	Key    string `json:"key"`
+
+	Produced  int `json:"produced"`
+	Processed int `json:"processed"`
+	Deferred  int `json:"deferred"`
+
+	// Failed counts messages the dependency rejected because it was overloaded.
+	Failed int `json:"failed"`
+
+	// Lag is the number of messages produced for the key that have been neither processed nor
+	// failed at the end of the second.
+	Lag int `json:"lag"`
+
+	// DeferredBacklog is the number of the key's messages waiting in the defer topic.
+	DeferredBacklog int `json:"deferred_backlog"`
+
+	// Latencies are the time from production to processing, in milliseconds, of the messages
+	// processed during the second.
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+	LatencyMax float64 `json:"latency_max_ms"`
+}
+
+// Run simulates each of cfg's policies in turn and returns their samples.
+func Run(cfg Config) ([]Sample, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	samples := []Sample{}
+	for _, policy := range cfg.Policies {
+		sim, err := newSimulation(cfg, policy)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", policy.Name, err)
+		}
+		s, err := sim.run()
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", policy.Name, err)
+		}
+		samples = append(samples, s...)
+	}
+	return samples, nil
+}
+
+type simulation struct {
+	cfg     Config
+	policy  Policy
+	clock   *clock.Manual
+	broker  *broker.Memory
+	handler *pipeline.Handler
+
+	// queued is the number of messages in the broker, or held by the delay queue, that haven't been
+	// handled yet.
+	queued int
+
+	// pressure is the load on the dependency in the current second.
+	pressure float64
+
+	keys    []string
+	current map[string]*keyStats
+}
+
+type keyStats struct {
+	produced, processed, deferred, failed int
+	lag, deferredBacklog                  int
+	latencies                             []time.Duration
+}
+
+func newSimulation(cfg Config, policy Policy) (*simulation, error) {
+	s := &simulation{
+		cfg:     cfg,
+		policy:  policy,
+		clock:   clock.NewManual(time.Unix(0, 0).UTC()),
+		broker:  broker.NewMemory(1),
+		current: map[string]*keyStats{},
+	}
+
+	limiter := pipeline.Limiter(ratelimit.Unlimited{})
+	if policy.Limit > 0 {
+		limiter = ratelimit.NewKeyed(policy.Limit, time.Duration(policy.Window), s.clock)
+	}
+	backoff, err := pipeline.ParseBackoff(
+		policy.Backoff,
+		limiter,
+		s.clock,
+		time.Duration(policy.BackoffBase),
+		time.Duration(policy.BackoffMax))
+	if err != nil {
+		return nil, err
+	}
+	actions, err := pipeline.ParseActions(consumeTopic + "=" + cmp.Or(policy.Action, "defer"))
+	if err != nil {
+		return nil, err
+	}
+
+	s.handler = pipeline.NewHandler(
+		discard{},
+		limiter,
+		pipeline.DependencyFunc(s.callDependency),
+		deferralCounter{s: s, producer: s.broker.Producer()},
+		deferTopic,
+		backoff,
+		actions,
+		nil)
+
+	return s, nil
+}
+
+func (s *simulation) run() ([]Sample, error) {
+	ctx := context.Background()
+	producer := s.broker.Producer()
+	consumer := pipeline.NewDelayQueue(s.broker.Consumer("sim", consumeTopic, deferTopic), s.clock, discard{})
+
+	// Cancelled so Consume returns immediately when there's nothing to consume.
+	drained, cancel := context.WithCancel(ctx)
+	cancel()
+
+	step := time.Duration(s.cfg.Step)
+	stepsPerSecond := int(time.Second / step)
+	pending := make([]float64, len(s.cfg.Workload))
+	budget := 0.0
+	samples := []Sample{}
+
+	for i := 1; time.Duration(i)*step <= time.Duration(s.cfg.Duration); i++ {
+		s.clock.Advance(step)
+		elapsed := time.Duration(i) * step
+
+		if (i-1)%stepsPerSecond == 0 {
+			s.pressure = 0
+		}
+
+		// Produce the workload. Fractional messages carry over to the next step so low rates still
+		// produce messages at the right average rate.
+		for j, stream := range s.cfg.Workload {
+			if elapsed <= time.Duration(stream.Start) || (stream.End > 0 && elapsed > time.Duration(stream.End)) {
+				continue
+			}
+			pending[j] += stream.Rate * step.Seconds()
+			for ; pending[j] >= 1; pending[j]-- {
+				if err := s.produce(ctx, producer, stream); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		// Consume. When the consumer rate is unlimited we only consume the messages that were
+		// available at the start of the step, otherwise a message the limiter keeps deferring would
+		// be consumed forever.
+		if s.cfg.ConsumerRate > 0 {
+			budget = math.Min(budget+s.cfg.ConsumerRate*step.Seconds(), math.Max(1, s.cfg.ConsumerRate))
+		} else {
+			budget = float64(s.queued)
+		}
+		for ; budget >= 1; budget-- {
+			env, err := consumer.Consume(drained)
+			if err != nil {
+				break
+			}
+			var pause *pipeline.PauseError
+			if err := s.handle(ctx, env); errors.As(err, &pause) {
+				if err := consumer.Hold(env, pause.Until); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			s.queued--
+			if err := consumer.Commit(ctx, env); err != nil {
+				return nil, err
+			}
+		}
+
+		if i%stepsPerSecond == 0 {
+			samples = append(samples, s.sample(i/stepsPerSecond)...)
+		}
+	}
+
+	return samples, nil
+}
+
+func (s *simulation) produce(ctx context.Context, producer broker.Producer, stream Stream) error {
+	msg := messages.Message{CustomerID: stream.CustomerID, Type: stream.Type}
+	data, headers, err := messages.Encode(messages.JSON{}, messages.CurrentSchemaVersion, msg)
+	if err != nil {
+		return err
+	}
+	err = producer.Produce(ctx, messages.Envelope{
+		Topic:     consumeTopic,
+		Headers:   headers,
+		Timestamp: s.clock.Now(),
+		Raw:       data,
+	})
+	if err != nil {
+		return err
+	}
+	s.queued++
+	ks := s.stats(pipeline.Key(msg))
+	ks.produced++
+	ks.lag++
+	return nil
+}
+
+func (s *simulation) handle(ctx context.Context, env messages.Envelope) error {
+	if err := messages.Decode(&env); err != nil {
+		return err
+	}
+	ks := s.stats(pipeline.Key(env.Message))
+	if env.Topic == deferTopic {
+		ks.deferredBacklog--
+	}
+
+	err := s.handler.Handle(ctx, env)
+	if errors.Is(err, ErrOverloaded) {
+		ks.failed++
+		ks.lag--
+		return nil
+	}
+	return err
+}
+
+func (s *simulation) callDependency(_ context.Context, env messages.Envelope) error {
+	s.pressure += s.cfg.Dependency.Cost
+	if s.cfg.Dependency.Limit > 0 && s.pressure > s.cfg.Dependency.Limit {
+		return ErrOverloaded
+	}
+	ks := s.stats(pipeline.Key(env.Message))
+	ks.processed++
+	ks.lag--
+	ks.latencies = append(ks.latencies, s.clock.Now().Sub(env.Timestamp))
+	return nil
+}
+
+func (s *simulation) stats(key string) *keyStats {
+	ks, ok := s.current[key]
+	if !ok {
+		ks = &keyStats{}
+		s.current[key] = ks
+		s.keys = append(s.keys, key)
+		slices.Sort(s.keys)
+	}
+	return ks
+}
+
+// sample returns a sample for every key seen so far and resets the per-second counters.
+func (s *simulation) sample(second int) []Sample {
+	samples := make([]Sample, 0, len(s.keys))
+	for _, key := range s.keys {
+		ks := s.current[key]
+		sample := Sample{
+			Policy:          s.policy.Name,
+			Second:          second,
+			Key:             key,
+			Produced:        ks.produced,
+			Processed:       ks.processed,
+			Deferred:        ks.deferred,
+			Failed:          ks.failed,
+			Lag:             ks.lag,
+			DeferredBacklog: ks.deferredBacklog,
+		}
+		if len(ks.latencies) > 0 {
+			slices.Sort(ks.latencies)
+			sample.LatencyP50 = milliseconds(percentile(ks.latencies, 0.5))
+			sample.LatencyP99 = milliseconds(percentile(ks.latencies, 0.99))
+			sample.LatencyMax = milliseconds(ks.latencies[len(ks.latencies)-1])
+		}
+		samples = append(samples, sample)
+
+		ks.produced, ks.processed, ks.deferred, ks.failed = 0, 0, 0, 0
+		ks.latencies = ks.latencies[:0]
+	}
+	return samples
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// deferralCounter counts the messages the handler defers before producing them.
+type deferralCounter struct {
+	s        *simulation
+	producer broker.Producer
+}
+
+func (d deferralCounter) Produce(ctx context.Context, env messages.Envelope) error {
+	if err := d.producer.Produce(ctx, env); err != nil {
+		return err
+	}
+	d.s.queued++
+	ks := d.s.stats(pipeline.Key(env.Message))
+	ks.deferred++
+	ks.deferredBacklog++
+	return nil
+}
+
+func (d deferralCounter) Flush(ctx context.Context) error {
+	return d.producer.Flush(ctx)
+}
+
+func (d deferralCounter) Close() error {
+	return d.producer.Close()
+}
+
+type discard struct{}
+
+func (discard) Record(string, metrics.Labels, int) {}
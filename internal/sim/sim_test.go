@@ -0,0 +1,85 @@
+package sim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+
+	// Two customers share a dependency that can handle 100 messages per second. Customer "b" goes
+	// noisy at 200 messages per second from the third second.
+	cfg := Config{
+		Duration: Duration(6 * time.Second),
+		Workload: []Stream{
+			{CustomerID: "a", Type: "t", Rate: 50},
+			{CustomerID: "b", Type: "t", Rate: 20, End: Duration(2 * time.Second)},
+			{CustomerID: "b", Type: "t", Rate: 200, Start: Duration(2 * time.Second)},
+		},
+		Dependency: DependencyModel{Limit: 100},
+		Policies: []Policy{
+			{Name: "unlimited"},
+			{Name: "per-key", Limit: 50},
+		},
+	}
+
+	samples, err := Run(cfg)
+	require.NoError(t, err)
+
+	find := func(policy string, second int, key string) Sample {
+		for _, s := range samples {
+			if s.Policy == policy && s.Second == second && s.Key == key {
+				return s
+			}
+		}
+		t.Fatalf("no sample for %s/%d/%s", policy, second, key)
+		return Sample{}
+	}
+
+	t.Run("produces one sample per policy, second, and key", func(t *testing.T) {
+		assert.Len(t, samples, 2*6*2)
+	})
+
+	t.Run("quiet customer fails when noisy customer is unlimited", func(t *testing.T) {
+		a := find("unlimited", 5, "a:t")
+		assert.Equal(t, 50, a.Produced)
+		assert.Greater(t, a.Failed, 0)
+	})
+
+	t.Run("quiet customer is unaffected when noisy customer is limited", func(t *testing.T) {
+		a := find("per-key", 5, "a:t")
+		assert.Equal(t, 50, a.Processed)
+		assert.Equal(t, 0, a.Failed)
+		assert.Equal(t, 0, a.Deferred)
+
+		b := find("per-key", 5, "b:t")
+		assert.Equal(t, 0, b.Failed)
+		assert.Equal(t, 50, b.Processed)
+		assert.Greater(t, b.DeferredBacklog, find("per-key", 4, "b:t").DeferredBacklog)
+		assert.Greater(t, b.LatencyMax, float64(0))
+	})
+
+	t.Run("is deterministic", func(t *testing.T) {
+		again, err := Run(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, samples, again)
+	})
+
+	t.Run("writes CSV", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		require.NoError(t, WriteCSV(&buf, samples))
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		assert.Len(t, lines, len(samples)+1)
+		assert.True(t, strings.HasPrefix(lines[0], "policy,second,key,"))
+	})
+
+	t.Run("returns error for invalid step", func(t *testing.T) {
+		_, err := Run(Config{Duration: Duration(time.Second), Step: Duration(300 * time.Millisecond)})
+		assert.Error(t, err)
+	})
+}
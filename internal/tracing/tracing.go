@@ -0,0 +1,226 @@
+// Package tracing records spans of the work done producing and handling messages and exports them
+// in batches, so a message's path through the consumer can be followed in a tracing backend.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+// SpanKind is the role a span plays, numbered as OTLP numbers them.
+type SpanKind int
+
+const (
+	// KindInternal is work inside the process, like a limiter decision.
+	KindInternal SpanKind = 1
+
+	// KindClient is a call to another service, like the dependency.
+	KindClient SpanKind = 3
+
+	// KindProducer is sending a message to the broker.
+	KindProducer SpanKind = 4
+
+	// KindConsumer is handling a message received from the broker.
+	KindConsumer SpanKind = 5
+)
+
+// Attributes describe what a span worked on. Values are strings, bools, ints, int32s, int64s, or
+// float64s.
+type Attributes map[string]any
+
+// SpanData is a finished span.
+type SpanData struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+
+	// ParentSpanID is zero for the root span of a trace.
+	ParentSpanID [8]byte
+
+	Name       string
+	Kind       SpanKind
+	Start      time.Time
+	End        time.Time
+	Attributes Attributes
+
+	// Err describes why the span's work failed, or is empty if it succeeded.
+	Err string
+}
+
+// An Exporter sends finished spans to a tracing backend.
+type Exporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// pendingPerSecond is how many finished spans per second of the export interval
+// [DefaultMaxPending] makes room for, which covers a few thousand messages a second with several
+// spans each.
+const pendingPerSecond = 5000
+
+// dropWarningInterval is the least time between warnings about dropped spans.
+const dropWarningInterval = time.Minute
+
+// DefaultMaxPending returns how many finished spans a tracer that exports every interval keeps
+// waiting to be exported.
+func DefaultMaxPending(interval time.Duration) int {
+	return max(1, int(interval/time.Second)) * pendingPerSecond
+}
+
+// A Tracer starts spans and exports them in batches. A nil *Tracer starts nil spans, which do
+// nothing, so code can be traced without checking whether tracing is enabled.
+type Tracer struct {
+	clock    clock.Clock
+	exporter Exporter
+
+	// maxPending is how many finished spans are kept waiting to be exported before new ones are
+	// dropped, so a backend that's down or slow can't use up the process's memory. Run exports
+	// early when half of them are waiting so spans aren't dropped between intervals.
+	maxPending int
+	half       chan struct{}
+
+	mu      sync.Mutex
+	pending []SpanData
+	dropped int
+	warned  time.Time
+}
+
+// NewTracer creates a tracer that keeps up to maxPending finished spans waiting to be exported,
+// or [DefaultMaxPending] for a ten second interval if maxPending isn't positive.
+func NewTracer(clk clock.Clock, exporter Exporter, maxPending int) *Tracer {
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPending(10 * time.Second)
+	}
+	return &Tracer{
+		clock:      clk,
+		exporter:   exporter,
+		maxPending: maxPending,
+		half:       make(chan struct{}, 1),
+	}
+}
+
+type spanKey struct{}
+
+// Start starts a span as a child of the span in ctx, if there is one, and returns a context
+// carrying the new span for its children.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind, attrs Attributes) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		tracer: t,
+		data: SpanData{
+			Name:       name,
+			Kind:       kind,
+			Start:      t.clock.Now(),
+			Attributes: Attributes{},
+		},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentSpanID = parent.data.SpanID
+	} else {
+		rand.Read(s.data.TraceID[:])
+	}
+	rand.Read(s.data.SpanID[:])
+	s.SetAttributes(attrs)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Run exports finished spans every interval, and whenever half the spans the tracer keeps are
+// waiting, until ctx is cancelled, and then exports any that are left.
+func (t *Tracer) Run(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := t.Flush(flushCtx); err != nil {
+				fmt.Printf("error: export spans: %v\n", err)
+			}
+			return
+		case <-t.clock.After(interval):
+		case <-t.half:
+		}
+		if err := t.Flush(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("error: export spans: %v\n", err)
+		}
+	}
+}
+
+// Flush exports the spans that have finished since the last export. Spans that fail to export
+// are dropped rather than retried. Spans dropped because too many were waiting are logged at most
+// once every dropWarningInterval.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	dropped := 0
+	if now := t.clock.Now(); t.dropped > 0 && now.Sub(t.warned) >= dropWarningInterval {
+		dropped, t.dropped, t.warned = t.dropped, 0, now
+	}
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		fmt.Printf("warn: dropped %d spans waiting to be exported\n", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.ExportSpans(ctx, spans)
+}
+
+func (t *Tracer) finish(data SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= t.maxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, data)
+	if len(t.pending) == (t.maxPending+1)/2 {
+		select {
+		case t.half <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// A Span times a piece of work. Its methods do nothing on a nil *Span. A span belongs to the
+// goroutine that started it.
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+	ended  bool
+}
+
+// SetAttributes adds attrs to the span, replacing any with the same keys.
+func (s *Span) SetAttributes(attrs Attributes) {
+	if s == nil {
+		return
+	}
+	for key, value := range attrs {
+		s.data.Attributes[key] = value
+	}
+}
+
+// SetError marks the span as failed with err, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.data.Err = err.Error()
+}
+
+// End finishes the span and queues it to be exported. Calls after the first do nothing.
+func (s *Span) End() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.clock.Now()
+	s.tracer.finish(s.data)
+}
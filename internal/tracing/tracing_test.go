@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ttd2089/rate-limited-consumer-poc/internal/clock"
+)
+
+type collector struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (c *collector) ExportSpans(_ context.Context, spans []SpanData) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = append(c.spans, spans...)
+	return nil
+}
+
+func (c *collector) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.spans)
+}
+
+func TestTracer(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+
+	t.Run("children share their parent's trace", func(t *testing.T) {
+		clk := clock.NewManual(start)
+		exported := &collector{}
+		tracer := NewTracer(clk, exported, 0)
+
+		ctx, parent := tracer.Start(context.Background(), "consume", KindConsumer, Attributes{"customer": "a"})
+		_, child := tracer.Start(ctx, "commit", KindInternal, nil)
+		clk.Advance(time.Second)
+		child.SetError(errors.New("broker unavailable"))
+		child.End()
+		parent.End()
+		parent.End()
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		require.Len(t, exported.spans, 2)
+		c, p := exported.spans[0], exported.spans[1]
+		assert.Equal(t, p.TraceID, c.TraceID)
+		assert.Equal(t, p.SpanID, c.ParentSpanID)
+		assert.Equal(t, [8]byte{}, p.ParentSpanID)
+		assert.NotEqual(t, [16]byte{}, p.TraceID)
+		assert.Equal(t, "a", p.Attributes["customer"])
+		assert.Equal(t, "broker unavailable", c.Err)
+		assert.Equal(t, start, c.Start)
+		assert.Equal(t, start.Add(time.Second), c.End)
+
+		require.NoError(t, tracer.Flush(context.Background()))
+		assert.Len(t, exported.spans, 2, "spans are only exported once")
+	})
+
+	t.Run("a nil tracer does nothing", func(t *testing.T) {
+		var tracer *Tracer
+		ctx, span := tracer.Start(context.Background(), "consume", KindConsumer, nil)
+		assert.Equal(t, context.Background(), ctx)
+		span.SetAttributes(Attributes{"customer": "a"})
+		span.SetError(errors.New("failed"))
+		span.End()
+	})
+
+	t.Run("drops spans when too many are waiting", func(t *testing.T) {
+		exported := &collector{}
+		clk := clock.NewManual(start)
+		tracer := NewTracer(clk, exported, 10)
+		end := func(n int) {
+			for range n {
+				_, span := tracer.Start(context.Background(), "produce", KindProducer, nil)
+				span.End()
+			}
+		}
+
+		end(15)
+		require.NoError(t, tracer.Flush(context.Background()))
+		assert.Len(t, exported.spans, 10)
+		assert.Equal(t, 0, tracer.dropped, "the first drops are warned about")
+
+		end(12)
+		require.NoError(t, tracer.Flush(context.Background()))
+		assert.Equal(t, 2, tracer.dropped, "drops aren't warned about again within a minute")
+
+		clk.Advance(dropWarningInterval)
+		end(11)
+		require.NoError(t, tracer.Flush(context.Background()))
+		assert.Equal(t, 0, tracer.dropped, "drops are warned about once a minute has passed")
+		assert.Len(t, exported.spans, 30)
+	})
+
+	t.Run("exports early when half the spans it keeps are waiting", func(t *testing.T) {
+		exported := &collector{}
+		clk := clock.NewManual(start)
+		tracer := NewTracer(clk, exported, 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			tracer.Run(ctx, time.Hour)
+			close(done)
+		}()
+
+		for range 5 {
+			_, span := tracer.Start(context.Background(), "produce", KindProducer, nil)
+			span.End()
+		}
+		assert.Eventually(t, func() bool { return exported.len() == 5 }, time.Second, time.Millisecond)
+
+		cancel()
+		<-done
+	})
+
+	t.Run("sizes the default buffer from the interval", func(t *testing.T) {
+		assert.Equal(t, 10*pendingPerSecond, DefaultMaxPending(10*time.Second))
+		assert.Equal(t, pendingPerSecond, DefaultMaxPending(time.Millisecond))
+	})
+}